@@ -1,19 +1,25 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/4r7hur0/PBL-2/api/delivery"
+	"github.com/4r7hur0/PBL-2/api/heuristic"
 	"github.com/4r7hur0/PBL-2/api/mqtt"
 	"github.com/4r7hur0/PBL-2/api/router"
+	"github.com/4r7hur0/PBL-2/api/saga"
 	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/api/timeline"
+	"github.com/4r7hur0/PBL-2/api/txlog"
 	rc "github.com/4r7hur0/PBL-2/registry/registry_client"
 	"github.com/4r7hur0/PBL-2/schemas"
 	"github.com/gin-gonic/gin"
@@ -29,16 +35,35 @@ var (
 	stateMgr        *state.StateManager
 	allSystemCities []string
 	registryClient  *rc.RegistryClient // Cliente do Registry
-
+	txLog           *txlog.Log         // Log de decisões do coordenador 2PC
+	selfAPIURL      string             // URL pela qual as outras APIs alcançam esta instância
+	deliveryQueue   *delivery.Queue    // Fila de reenvio de COMMIT/ABORT aos participantes remotos
 )
 
 func main() {
 
-	enterpriseName := os.Getenv("ENTERPRISE_NAME")
-	enterprisePort := os.Getenv("ENTERPRISE_PORT")
+	enterpriseName = os.Getenv("ENTERPRISE_NAME")
+	enterprisePort = os.Getenv("ENTERPRISE_PORT")
 	postsQuantityStr := os.Getenv("POSTS_QUANTITY")
+	postsLayoutStr := os.Getenv("POSTS_LAYOUT") // Tipos de posto: "quantidade:nível:conector,..."; substitui POSTS_QUANTITY
 	ownedCity = os.Getenv("OWNED_CITY")
 	registryURL := os.Getenv("REGISTRY_URL") // Ex: http://localhost:9000
+	dataDir := os.Getenv("DATA_DIR")         // Diretório para os arquivos persistentes desta API
+	prepareLeaseStr := os.Getenv("PREPARE_LEASE_SECONDS")
+	noShowGraceStr := os.Getenv("NO_SHOW_GRACE_SECONDS")   // Tolerância para o check-in depois do início da janela
+	offerTimeoutStr := os.Getenv("WAITLIST_OFFER_SECONDS") // Prazo para aceitar uma oferta da fila de espera
+	victimPolicyStr := os.Getenv("CAPACITY_VICTIM_POLICY") // "latest-start" (padrão) ou "longest"
+	prepareTimeoutStr := os.Getenv("PREPARE_TIMEOUT_SECONDS")
+	protocolStr := os.Getenv("RESERVATION_PROTOCOL") // "2pc" (padrão), "3pc" ou "saga"
+	prepareModeStr := os.Getenv("PREPARE_MODE")      // "sync" (padrão) ou "async"
+	inProcessCitiesStr := os.Getenv("IN_PROCESS_CITIES") // Cidades extras neste processo: "Cidade=postos,..."
+	prepareOrderStr := os.Getenv("PREPARE_ORDER")         // "parallel" (padrão) ou "ordered"
+	conflictPolicyStr := os.Getenv("CONFLICT_POLICY")     // "none" (padrão), "wait-die" ou "wound-wait"
+	transportStr := os.Getenv("INTERAPI_TRANSPORT")       // "http" (padrão) ou "mqtt"
+	coordinatorStr := os.Getenv("COORDINATOR_SELECTION")  // "self" (padrão) ou "first-segment"
+	historySizeStr := os.Getenv("TRANSACTION_HISTORY_SIZE")
+	txLogRetentionStr := os.Getenv("TXLOG_RETENTION_HOURS") // Por quanto tempo transações encerradas ficam no log
+	adminToken = os.Getenv("ADMIN_TOKEN") // Protege os endpoints de decisão heurística e de capacidade
 
 	if enterpriseName == "" {
 		fmt.Println("AVISO: ENTERPRISE_NAME não definido. Usando 'SolAtlantico'.")
@@ -59,32 +84,240 @@ func main() {
 			postsQuantity = 5
 		}
 	}
+	var postLayout []state.PostSpec
+	if postsLayoutStr != "" {
+		specs, err := state.ParsePostLayout(postsLayoutStr)
+		if err != nil {
+			log.Printf("Valor inválido para POSTS_LAYOUT (%q): %v. Usando %d postos %s/%s.", postsLayoutStr, err, postsQuantity, schemas.PowerLevelFast, schemas.ConnectorCCS2)
+		} else {
+			postLayout = specs
+			postsQuantity = 0
+			for _, spec := range specs {
+				postsQuantity += spec.Count
+			}
+		}
+	}
+	if dataDir == "" {
+		dataDir = "data"
+	}
+	prepareLease := state.DefaultPrepareLease
+	if prepareLeaseStr != "" {
+		seconds, err := strconv.Atoi(prepareLeaseStr)
+		if err != nil || seconds <= 0 {
+			log.Printf("Valor inválido para PREPARE_LEASE_SECONDS (%q). Usando %s.", prepareLeaseStr, prepareLease)
+		} else {
+			prepareLease = time.Duration(seconds) * time.Second
+		}
+	}
+	noShowGrace := state.DefaultNoShowGrace
+	if noShowGraceStr != "" {
+		seconds, err := strconv.Atoi(noShowGraceStr)
+		if err != nil || seconds < 0 {
+			log.Printf("Valor inválido para NO_SHOW_GRACE_SECONDS (%q). Usando %s.", noShowGraceStr, noShowGrace)
+		} else {
+			noShowGrace = time.Duration(seconds) * time.Second
+		}
+	}
+	offerTimeout := state.DefaultWaitlistOfferTimeout
+	if offerTimeoutStr != "" {
+		seconds, err := strconv.Atoi(offerTimeoutStr)
+		if err != nil || seconds <= 0 {
+			log.Printf("Valor inválido para WAITLIST_OFFER_SECONDS (%q). Usando %s.", offerTimeoutStr, offerTimeout)
+		} else {
+			offerTimeout = time.Duration(seconds) * time.Second
+		}
+	}
+	victimPolicy := state.VictimPolicyLatestStart
+	if victimPolicyStr != "" {
+		if state.ValidVictimPolicy(victimPolicyStr) {
+			victimPolicy = victimPolicyStr
+		} else {
+			log.Printf("Valor inválido para CAPACITY_VICTIM_POLICY (%q). Usando %s.", victimPolicyStr, victimPolicy)
+		}
+	}
+	if prepareTimeoutStr != "" {
+		seconds, err := strconv.Atoi(prepareTimeoutStr)
+		if err != nil || seconds <= 0 {
+			log.Printf("Valor inválido para PREPARE_TIMEOUT_SECONDS (%q). Usando %s.", prepareTimeoutStr, prepareTimeout)
+		} else {
+			prepareTimeout = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if txLogRetentionStr != "" {
+		hours, err := strconv.Atoi(txLogRetentionStr)
+		if err != nil || hours <= 0 {
+			log.Printf("Valor inválido para TXLOG_RETENTION_HOURS (%q). Usando %s.", txLogRetentionStr, txLogRetention)
+		} else {
+			txLogRetention = time.Duration(hours) * time.Hour
+		}
+	}
+	if historySizeStr != "" {
+		size, err := strconv.Atoi(historySizeStr)
+		if err != nil || size <= 0 {
+			log.Printf("Valor inválido para TRANSACTION_HISTORY_SIZE (%q). Usando %d.", historySizeStr, timeline.DefaultCapacity)
+		} else {
+			history = timeline.New(size)
+		}
+	}
+
+	switch protocolStr {
+	case "", protocol2PC:
+		reservationProtocol = protocol2PC
+	case protocol3PC:
+		reservationProtocol = protocol3PC
+	case protocolSaga:
+		reservationProtocol = protocolSaga
+	default:
+		log.Printf("Valor inválido para RESERVATION_PROTOCOL (%q). Usando %s.", protocolStr, protocol2PC)
+		reservationProtocol = protocol2PC
+	}
+
+	switch prepareModeStr {
+	case "", prepareModeSync:
+		prepareMode = prepareModeSync
+	case prepareModeAsync:
+		prepareMode = prepareModeAsync
+	default:
+		log.Printf("Valor inválido para PREPARE_MODE (%q). Usando %s.", prepareModeStr, prepareModeSync)
+		prepareMode = prepareModeSync
+	}
+
+	switch prepareOrderStr {
+	case "", prepareOrderParallel:
+		prepareOrder = prepareOrderParallel
+	case prepareOrderCanonical:
+		prepareOrder = prepareOrderCanonical
+	default:
+		log.Printf("Valor inválido para PREPARE_ORDER (%q). Usando %s.", prepareOrderStr, prepareOrderParallel)
+		prepareOrder = prepareOrderParallel
+	}
+
+	switch conflictPolicyStr {
+	case "", conflictPolicyNone:
+		conflictPolicy = conflictPolicyNone
+	case conflictPolicyWaitDie, conflictPolicyWoundWait:
+		conflictPolicy = conflictPolicyStr
+	default:
+		log.Printf("Valor inválido para CONFLICT_POLICY (%q). Usando %s.", conflictPolicyStr, conflictPolicyNone)
+		conflictPolicy = conflictPolicyNone
+	}
+
+	switch transportStr {
+	case "", transportHTTP:
+		interAPITransportMode = transportHTTP
+	case transportMQTT:
+		interAPITransportMode = transportMQTT
+	default:
+		log.Printf("Valor inválido para INTERAPI_TRANSPORT (%q). Usando %s.", transportStr, transportHTTP)
+		interAPITransportMode = transportHTTP
+	}
+
+	switch coordinatorStr {
+	case "", coordinatorSelf:
+		coordinatorSelection = coordinatorSelf
+	case coordinatorFirstSegment:
+		coordinatorSelection = coordinatorFirstSegment
+	default:
+		log.Printf("Valor inválido para COORDINATOR_SELECTION (%q). Usando %s.", coordinatorStr, coordinatorSelf)
+		coordinatorSelection = coordinatorSelf
+	}
 
 	log.Printf("Iniciando API para a empresa: %s na porta %s, gerenciando a cidade: %s com %d postos.", enterpriseName, enterprisePort, ownedCity, postsQuantity)
 
 	// Inicializar o StateManager APENAS para a cidade que esta API possui
 	stateMgr = state.NewStateManager(ownedCity, postsQuantity)
+	if postLayout != nil {
+		stateMgr.SetPostLayout(postLayout)
+	}
+	stateMgr.SetPrepareLease(prepareLease)
+	stateMgr.SetNoShowGrace(noShowGrace)
+	stateMgr.SetWaitlistOfferTimeout(offerTimeout)
+	stateMgr.SetVictimPolicy(victimPolicy)
+	// Recuperar as reservas gravadas antes de um reinício, para não reservar de novo postos ocupados
+	if err := useCityStorage(stateMgr, dataDir, ownedCity); err != nil {
+		log.Fatalf("[%s] Falha ao abrir o estado da cidade %s: %v", enterpriseName, ownedCity, err)
+	}
+	parseInProcessCities(inProcessCitiesStr, dataDir)
 
 	// Inicializar e usar o Registry Client
-	registryClient := rc.NewRegistryClient(registryURL)
-  
-	myAPIURL := fmt.Sprintf("http://%v:%s", enterpriseName, enterprisePort) // Ajuste se estiver atrás de um proxy ou em rede Docker diferente
+	registryClient = rc.NewRegistryClient(registryURL)
+
+	selfAPIURL = fmt.Sprintf("http://%v:%s", enterpriseName, enterprisePort) // Ajuste se estiver atrás de um proxy ou em rede Docker diferente
+	if interAPITransportMode == transportMQTT {
+		selfAPIURL = mqtt.RPCURL(enterpriseName) // As outras APIs chegam aqui pelo broker
+	}
 
-	err := registryClient.RegisterService(enterpriseName, ownedCity, myAPIURL)
+	err := registryClient.RegisterService(enterpriseName, ownedCity, selfAPIURL)
 	if err != nil {
 		log.Fatalf("[%s] Falha ao registrar no Registry: %v", enterpriseName, err)
 	} else {
-		log.Printf("[%s] Registrado com sucesso no Registry como gerenciador de '%s' em %s", enterpriseName, ownedCity, myAPIURL)
+		log.Printf("[%s] Registrado com sucesso no Registry como gerenciador de '%s' em %s", enterpriseName, ownedCity, selfAPIURL)
 	}
 
 	allSystemCities = []string{"Salvador", "Feira de Santana", "Ilheus"}
 
+	// Abrir o log de decisões do coordenador (2PC)
+	txLog, err = txlog.Open(filepath.Join(dataDir, fmt.Sprintf("%s-coordinator.log", enterpriseName)))
+	if err != nil {
+		log.Fatalf("[%s] Falha ao abrir o log de transações: %v", enterpriseName, err)
+	}
+	if err := txLog.Subscribe(history.Observe); err != nil {
+		log.Fatalf("[%s] Falha ao carregar o histórico de transações: %v", enterpriseName, err)
+	}
+
+	deliveryQueue, err = delivery.Open(filepath.Join(dataDir, fmt.Sprintf("%s-delivery.json", enterpriseName)), sendDeliveryItem, onDeliveryAck)
+	if err != nil {
+		log.Fatalf("[%s] Falha ao abrir a fila de entregas: %v", enterpriseName, err)
+	}
+	go deliveryQueue.Run(nil)
+
+	sagaStore, err = saga.Open(filepath.Join(dataDir, fmt.Sprintf("%s-sagas.json", enterpriseName)))
+	if err != nil {
+		log.Fatalf("[%s] Falha ao abrir o armazenamento de sagas: %v", enterpriseName, err)
+	}
+
+	heuristicStore, err = heuristic.Open(filepath.Join(dataDir, fmt.Sprintf("%s-heuristics.json", enterpriseName)))
+	if err != nil {
+		log.Fatalf("[%s] Falha ao abrir o registro de decisões heurísticas: %v", enterpriseName, err)
+	}
+	restoreHeuristics()
+	watchDisplacements()
+	log.Printf("[%s] Protocolo de reserva de rotas: %s (PREPARE %s, ordem %s, conflitos %s, transporte %s, coordenador %s)", enterpriseName, reservationProtocol, prepareMode, prepareOrder, conflictPolicy, interAPITransportMode, coordinatorSelection)
+
 	// Inicializar MQTT
 
 	mqtt.InitializeMQTT("tcp://mosquitto:1883")
+	if err := mqtt.StartRPCClient(enterpriseName); err != nil {
+		log.Fatalf("[%s] Falha ao assinar o tópico de respostas MQTT: %v", enterpriseName, err)
+	}
+
+	// Concluir transações interrompidas por uma queda anterior desta API
+	recoverTransactions()
+	recoverSagas()
+
+	// Goroutine para descartar as sagas e as transações do log de decisões encerradas há muito tempo
+	go func() {
+		ticker := time.NewTicker(txLogCompactInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			pruneSagas()
+			compactTransactionLog()
+		}
+	}()
+
 	messageChannel := mqtt.StartListening(enterpriseName, 10)
 	chosenRouteTopic := fmt.Sprintf("car/route/%s", enterpriseName)
 	chosenRouteMessageChannel := mqtt.StartListening(chosenRouteTopic, 10)
+	chosenRoutes = chosenRouteMessageChannel // Rotas delegadas por outras empresas entram na mesma fila
+	cancelTopic := fmt.Sprintf("car/cancel/%s", enterpriseName)
+	cancelMessageChannel := mqtt.StartListening(cancelTopic, 10)
+	rescheduleTopic := fmt.Sprintf("car/reschedule/%s", enterpriseName)
+	rescheduleMessageChannel := mqtt.StartListening(rescheduleTopic, 10)
+	checkInMessageChannel := mqtt.StartListening(checkInTopic, 10)
+	checkOutMessageChannel := mqtt.StartListening(checkOutTopic, 10)
+	waitlistJoinMessageChannel := mqtt.StartListening(waitlistJoinTopic, 10)
+	waitlistAcceptMessageChannel := mqtt.StartListening(waitlistAcceptTopic, 10)
 
 	// Goroutine para processar os pedidos de rota e retornar as opções de rota
 
@@ -110,11 +343,19 @@ func main() {
 			// 3. Gerar um RequestID único
 			requestID := uuid.New().String()
 
+			// Registrar o RequestID emitido: só rotas escolhidas para RequestIDs emitidos aqui são aceitas
+			if err := txLog.IssueRequest(requestID, routeReq.VehicleID); err != nil {
+				log.Printf("[%s] Falha ao registrar RequestID %s para VehicleID %s: %v", enterpriseName, requestID, routeReq.VehicleID, err)
+				continue
+			}
+
 			var possibleRoutes [][]schemas.RouteSegment
 
 			if routeReq.Origin != "" && routeReq.Destination != "" {
 				// Chamar a função do pacote 'router'
 				possibleRoutes = router.GeneratePossibleRoutes(routeReq.Origin, routeReq.Destination, allSystemCities)
+				// Conector e potência do veículo seguem em cada segmento e dimensionam as janelas
+				possibleRoutes = router.ApplyChargeProfile(possibleRoutes, routeReq.Connector, routeReq.MaxChargePowerKW)
 				if len(possibleRoutes) == 0 {
 					log.Printf("[%s] Nenhuma rota retornada pelo módulo de roteamento para '%s' -> '%s'.", enterpriseName, routeReq.Origin, routeReq.Destination)
 				}
@@ -156,7 +397,7 @@ func main() {
 			transactionID := uuid.New().String()
 
 			fmt.Printf("[%s] TX[%s] Mensagem de ROTA ESCOLHIDA recebida no tópico '%s': %s\n", enterpriseName, transactionID, chosenRouteTopic, messagePayload)
-			fmt.Println("Iniciando 2PC...")
+			fmt.Printf("Iniciando reserva da rota (%s)...\n", reservationProtocol)
 
 			// 1. Deserializar a mensagem recebida (payload) para ChosenRouteMsg
 			var chosenRoute schemas.ChosenRouteMsg
@@ -169,133 +410,59 @@ func main() {
 				log.Printf("[%s] TX[%s]: VehicleID ou RequestID ausente na ChosenRouteMsg. Payload: %s", enterpriseName, transactionID, messagePayload)
 				continue
 			}
+			if !acceptChosenRoute(chosenRoute) {
+				continue
+			}
 			if len(chosenRoute.Route) == 0 {
 				log.Printf("[%s] TX[%s]: Rota escolhida está vazia para VehicleID %s.", enterpriseName, transactionID, chosenRoute.VehicleID)
 				publishReservationStatus(chosenRoute.VehicleID, transactionID, "REJECTED", "Rota escolhida estava vazia", nil, enterpriseName)
 
 				continue
 			}
-			// Fase de PREPARE
-			preparedParticipants := make(map[string]string) // cidade -> "local" ou URL da API remota
-			prepareOverallSuccess := true
-
-			for _, segment := range chosenRoute.Route {
-				cityToReserve := segment.City
-				windowToReserve := segment.ReservationWindow
-
-				if cityToReserve == ownedCity { // Reserva LOCAL
-					log.Printf("[%s] TX[%s]: Iniciando PREPARE LOCAL para %s em %s", enterpriseName, transactionID, chosenRoute.VehicleID, cityToReserve)
-					success, err := stateMgr.PrepareReservation(transactionID, chosenRoute.VehicleID, chosenRoute.RequestID, windowToReserve)
-					if !success || err != nil {
-						log.Printf("[%s] TX[%s]: FALHA PREPARE LOCAL para %s: %v", enterpriseName, transactionID, cityToReserve, err)
-						prepareOverallSuccess = false
-						break
-					}
-					log.Printf("[%s] TX[%s]: SUCESSO PREPARE LOCAL para %s", enterpriseName, transactionID, cityToReserve)
-					preparedParticipants[cityToReserve] = "local"
-				} else { // Reserva REMOTA
-					log.Printf("[%s] TX[%s]: Descobrindo API para cidade remota '%s'", enterpriseName, transactionID, cityToReserve)
-					discoveredService, err_discover := registryClient.DiscoverService(cityToReserve)
-					if err_discover != nil || !discoveredService.Found {
-						log.Printf("[%s] TX[%s]: FALHA ao descobrir API para cidade remota '%s': %v. Found: %v", enterpriseName, transactionID, cityToReserve, err_discover, discoveredService.Found)
-						prepareOverallSuccess = false
-						break
-					}
-					remoteAPIURL := discoveredService.ApiURL
-					log.Printf("[%s] TX[%s]: Iniciando PREPARE REMOTO para %s em %s (API: %s)", enterpriseName, transactionID, chosenRoute.VehicleID, cityToReserve, remoteAPIURL)
-
-					remoteReqPayload := schemas.RemotePrepareRequest{
-						TransactionID:     transactionID,
-						VehicleID:         chosenRoute.VehicleID,
-						RequestID:         chosenRoute.RequestID,
-						City:              cityToReserve, // Importante: enviar a cidade correta
-						ReservationWindow: windowToReserve,
-					}
-					payloadBytes, _ := json.Marshal(remoteReqPayload)
-
-					httpClient := &http.Client{Timeout: time.Second * 10} // Adicionar timeout
-					resp, httpErr := httpClient.Post(fmt.Sprintf("%s/2pc_remote/prepare", remoteAPIURL), "application/json", bytes.NewBuffer(payloadBytes))
-
-					if httpErr != nil {
-						log.Printf("[%s] TX[%s]: ERRO HTTP no PREPARE REMOTO para %s: %v", enterpriseName, transactionID, cityToReserve, httpErr)
-						prepareOverallSuccess = false
-						break
-					}
-
-					var remoteResp schemas.RemotePrepareResponse
-					bodyBytes, _ := io.ReadAll(resp.Body)
-					resp.Body.Close() // Fechar o corpo
-
-					if err := json.Unmarshal(bodyBytes, &remoteResp); err != nil {
-						log.Printf("[%s] TX[%s]: Erro ao deserializar resposta PREPARE REMOTO de %s (Status: %s, Corpo: %s): %v", enterpriseName, transactionID, cityToReserve, resp.Status, string(bodyBytes), err)
-						prepareOverallSuccess = false
-						break
-					}
-
-					if resp.StatusCode == http.StatusOK && remoteResp.Status == schemas.StatusReservationPrepared {
-						log.Printf("[%s] TX[%s]: SUCESSO PREPARE REMOTO para %s", enterpriseName, transactionID, cityToReserve)
-						preparedParticipants[cityToReserve] = remoteAPIURL
-					} else {
-						log.Printf("[%s] TX[%s]: FALHA PREPARE REMOTO para %s. Status: %s, Resposta: %+v", enterpriseName, transactionID, cityToReserve, resp.Status, remoteResp)
-						prepareOverallSuccess = false
-						break
-					}
-				}
+			if forwardChosenRoute(chosenRoute) {
+				continue
 			}
+			startReservationTransaction(transactionID, chosenRoute)
+		}
+	}()
 
-			// Fase de COMMIT ou ABORT
-			if prepareOverallSuccess {
-				log.Printf("[%s] TX[%s]: FASE DE PREPARAÇÃO GLOBAL SUCESSO. Iniciando COMMIT.", enterpriseName, transactionID)
-				for city, participantTypeOrURL := range preparedParticipants {
-					if participantTypeOrURL == "local" {
-						stateMgr.CommitReservation(transactionID)
-						log.Printf("[%s] TX[%s]: COMMIT LOCAL para %s", enterpriseName, transactionID, city)
-					} else {
-						// Enviar COMMIT REMOTO
-						log.Printf("[%s] TX[%s]: Enviando COMMIT REMOTO para %s (API: %s)", enterpriseName, transactionID, city, participantTypeOrURL)
-						remoteCmdPayload := schemas.RemoteCommitAbortRequest{TransactionID: transactionID}
-						payloadBytes, _ := json.Marshal(remoteCmdPayload)
-						httpClient := &http.Client{Timeout: time.Second * 10}
-						resp, httpErr := httpClient.Post(fmt.Sprintf("%s/2pc_remote/commit", participantTypeOrURL), "application/json", bytes.NewBuffer(payloadBytes))
-						if httpErr != nil {
-							log.Printf("[%s] TX[%s]: ERRO HTTP no COMMIT REMOTO para %s: %v. A transação pode ficar inconsistente.", enterpriseName, transactionID, city, httpErr)
-						} else {
-							if resp.StatusCode != http.StatusOK {
-								bodyBytes, _ := io.ReadAll(resp.Body)
-								log.Printf("[%s] TX[%s]: AVISO - COMMIT REMOTO para %s falhou. Status: %s, Corpo: %s. A transação pode ficar inconsistente.", enterpriseName, transactionID, city, resp.Status, string(bodyBytes))
-								resp.Body.Close()
-							} else {
-								resp.Body.Close()
-								log.Printf("[%s] TX[%s]: COMMIT REMOTO para %s enviado com sucesso.", enterpriseName, transactionID, city)
-							}
-						}
-					}
-				}
-				publishReservationStatus(chosenRoute.VehicleID, transactionID, "CONFIRMED", "Reserva confirmada com sucesso", &chosenRoute, enterpriseName)
-			} else {
-				log.Printf("[%s] TX[%s]: FASE DE PREPARAÇÃO GLOBAL FALHOU. Iniciando ABORT.", enterpriseName, transactionID)
-				for city, participantTypeOrURL := range preparedParticipants { // Abortar apenas os que foram preparados
-					if participantTypeOrURL == "local" {
-						stateMgr.AbortReservation(transactionID)
-						log.Printf("[%s] TX[%s]: ABORT LOCAL para %s", enterpriseName, transactionID, city)
-					} else {
-						// Enviar ABORT REMOTO
-						log.Printf("[%s] TX[%s]: Enviando ABORT REMOTO para %s (API: %s)", enterpriseName, transactionID, city, participantTypeOrURL)
-						// ... (lógica de chamada HTTP POST para /2pc_remote/abort, similar ao commit) ...
-						remoteCmdPayload := schemas.RemoteCommitAbortRequest{TransactionID: transactionID}
-						payloadBytes, _ := json.Marshal(remoteCmdPayload)
-						httpClient := &http.Client{Timeout: time.Second * 10}
-						resp, httpErr := httpClient.Post(fmt.Sprintf("%s/2pc_remote/abort", participantTypeOrURL), "application/json", bytes.NewBuffer(payloadBytes))
-						if httpErr != nil {
-							log.Printf("[%s] TX[%s]: ERRO HTTP no ABORT REMOTO para %s: %v.", enterpriseName, transactionID, city, httpErr)
-						} else {
-							resp.Body.Close() // Sempre fechar
-							log.Printf("[%s] TX[%s]: ABORT REMOTO para %s enviado. Status: %s", enterpriseName, transactionID, city, resp.Status)
-						}
-					}
-				}
-				publishReservationStatus(chosenRoute.VehicleID, transactionID, "REJECTED", "Falha ao alocar postos necessários ou conflito de reserva", &chosenRoute, enterpriseName)
-			}
+	// Goroutine para processar os cancelamentos pedidos pelos carros
+	go func() {
+		for messagePayload := range cancelMessageChannel {
+			log.Printf("[%s] Pedido de CANCELAMENTO recebido no tópico '%s': %s", enterpriseName, cancelTopic, messagePayload)
+			handleCancelMessage(messagePayload)
+		}
+	}()
+
+	// Goroutine para processar as remarcações pedidas pelos carros
+	go func() {
+		for messagePayload := range rescheduleMessageChannel {
+			log.Printf("[%s] Pedido de REMARCAÇÃO recebido no tópico '%s': %s", enterpriseName, rescheduleTopic, messagePayload)
+			handleRescheduleMessage(messagePayload)
+		}
+	}()
+
+	// Goroutine para processar os check-ins dos carros nos postos das cidades desta API
+	go func() {
+		for messagePayload := range checkInMessageChannel {
+			handleCheckInMessage(messagePayload)
+		}
+	}()
+
+	// Goroutines para a fila de espera e o fim antecipado das recargas nas cidades desta API
+	go func() {
+		for messagePayload := range checkOutMessageChannel {
+			handleCheckOutMessage(messagePayload)
+		}
+	}()
+	go func() {
+		for messagePayload := range waitlistJoinMessageChannel {
+			handleWaitlistJoinMessage(messagePayload)
+		}
+	}()
+	go func() {
+		for messagePayload := range waitlistAcceptMessageChannel {
+			handleWaitlistAcceptMessage(messagePayload)
 		}
 	}()
 
@@ -304,13 +471,21 @@ func main() {
 				ticker := time.NewTicker(10 * time.Second) // Verificar a cada 10 segundos
 				defer ticker.Stop()
 				for range ticker.C {
-						stateMgr.CheckAndEndReservations()
+						for _, sm := range localStateManagers() {
+								sm.CheckAndEndReservations()
+						}
+						resolveExpiredPrepares()
 				}
 		}()
 
 	// Configurar e iniciar o servidor Gin (HTTP)
 	r := gin.Default()
 	setupRouter(r, stateMgr, enterpriseName) // Passar dependências
+	if interAPITransportMode == transportMQTT {
+		if err := mqtt.ServeRPC(enterpriseName, r, interAPIRouteGroups...); err != nil {
+			log.Fatalf("[%s] Falha ao assinar os tópicos de requisições MQTT: %v", enterpriseName, err)
+		}
+	}
 	log.Printf("[%s] Servidor HTTP escutando na porta %s", enterpriseName, enterprisePort)
 	if err := r.Run(":" + enterprisePort); err != nil {
 		log.Fatalf("Falha ao iniciar o servidor Gin: %v", err)
@@ -327,22 +502,152 @@ func setupRouter(r *gin.Engine, sm *state.StateManager, entName string) {
 			"enterprise":          enterpriseName,
 			"managed_city":        cName,
 			"max_posts":           maxP,
+			"posts":               sm.Posts(),
 			"active_reservations": activeR,
 		})
 	})
 
+	// Cidades hospedadas neste processo (IN_PROCESS_CITIES)
+	r.GET("/status/in_process", func(c *gin.Context) {
+		cities := make([]gin.H, 0, len(inProcessCities))
+		for _, ipc := range inProcessCities {
+			cName, maxP, activeR := ipc.sm.GetCityAvailability()
+			cities = append(cities, gin.H{"managed_city": cName, "max_posts": maxP, "posts": ipc.sm.Posts(), "active_reservations": activeR})
+		}
+		c.JSON(http.StatusOK, cities)
+	})
+
+	// Linha do tempo das transações coordenadas por esta API
+	r.GET("/transactions", handleListTransactions)
+	r.GET("/transactions/:id", handleGetTransaction)
+
+	// Cancelamento de uma rota confirmada, pelo veículo dono da reserva
+	r.POST("/reservations/:id/cancel", handleCancelReservation)
+
+	// Remarcação atômica de segmentos de uma rota confirmada
+	r.POST("/reservations/:id/reschedule", handleRescheduleReservation)
+
+	// Check-in do veículo no posto reservado em uma cidade desta API
+	r.POST("/reservations/:id/checkin", handleCheckIn)
+
+	// Fim antecipado da recarga; o posto liberado é oferecido à fila de espera
+	r.POST("/reservations/:id/checkout", handleCheckOut)
+
+	// Fila de espera por janelas lotadas nas cidades desta API
+	r.POST("/waitlist", handleJoinWaitlist)
+	r.GET("/waitlist", handleListWaitlist)
+	r.DELETE("/waitlist/:id", handleLeaveWaitlist)
+	r.POST("/waitlist/:id/accept", handleAcceptOffer)
+
+	// Endpoints administrativos
+	adminGroup := r.Group("/admin")
+	{
+		// Comandos COMMIT/ABORT ainda não confirmados pelos participantes
+		adminGroup.GET("/delivery", func(c *gin.Context) {
+			pending := deliveryQueue.Pending()
+			c.JSON(http.StatusOK, gin.H{"pending_count": len(pending), "pending": pending})
+		})
+
+		// Decisões heurísticas para reservas PREPARED presas (exigem ADMIN_TOKEN)
+		heuristicGroup := adminGroup.Group("/heuristic", requireAdminToken)
+		heuristicGroup.GET("", handleListHeuristics)
+		heuristicGroup.POST("/:id/commit", handleHeuristicDecision(schemas.DecisionCommit))
+		heuristicGroup.POST("/:id/abort", handleHeuristicDecision(schemas.DecisionAbort))
+
+		// Postos e manutenções das cidades desta API (exigem ADMIN_TOKEN)
+		postsGroup := adminGroup.Group("/posts", requireAdminToken)
+		postsGroup.GET("", handleListPosts)
+		postsGroup.POST("", handleAddPosts)
+		postsGroup.DELETE("/:id", handleRemovePost)
+		postsGroup.POST("/:id/maintenance", handleScheduleMaintenance)
+		adminGroup.DELETE("/maintenance/:id", requireAdminToken, handleEndMaintenance)
+	}
+
+	// Sagas coordenadas por esta API (RESERVATION_PROTOCOL=saga)
+	r.GET("/sagas", func(c *gin.Context) {
+		c.JSON(http.StatusOK, sagaStore.List())
+	})
+	r.GET("/sagas/:id", func(c *gin.Context) {
+		sg, ok := sagaStore.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: c.Param("id"), Reason: "Saga não encontrada"})
+			return
+		}
+		c.JSON(http.StatusOK, sg)
+	})
+
+	// Endpoints para serem chamados por outras APIs (participantes de sagas)
+	sagaGroup := r.Group("/saga_remote")
+	{
+		sagaGroup.POST("/reserve", func(c *gin.Context) {
+			handleSagaReserve(c, sm, entName)
+		})
+		sagaGroup.POST("/compensate", func(c *gin.Context) {
+			handleSagaCompensate(c, sm, entName)
+		})
+	}
+
 	// Endpoints para serem chamados por outras APIs (participantes remotos do 2PC)
 	remoteGroup := r.Group("/2pc_remote")
 	{
 		remoteGroup.POST("/prepare", func(c *gin.Context) {
 			handleRemotePrepare(c, sm, entName)
 		})
+		// PREPARE assíncrono: aceito na hora, voto enviado depois às URLs de callback do coordenador
+		remoteGroup.POST("/prepare_async", func(c *gin.Context) {
+			handleRemotePrepareAsync(c, sm, entName)
+		})
 		remoteGroup.POST("/commit", func(c *gin.Context) {
 			handleRemoteCommit(c, sm, entName)
 		})
 		remoteGroup.POST("/abort", func(c *gin.Context) {
 			handleRemoteAbort(c, sm, entName)
 		})
+		// Cancelamento de uma reserva efetivada, pedido pelo veículo à coordenadora
+		remoteGroup.POST("/cancel", func(c *gin.Context) {
+			handleRemoteCancel(c, sm, entName)
+		})
+		// Pedido de uma transação mais antiga para abortar uma coordenada aqui (wound-wait)
+		remoteGroup.POST("/wound", handleWound)
+		// Consulta do estado de uma transação, usada na terminação de reservas PREPARED incertas
+		remoteGroup.GET("/transactions/:id", func(c *gin.Context) {
+			handleTransactionStatus(c, sm)
+		})
+	}
+
+	// Callbacks de voto dos participantes assíncronos (PREPARE_MODE=async)
+	coordinatorGroup := r.Group("/2pc_coordinator")
+	{
+		coordinatorGroup.POST("/votes/:id/:segment/commit", handleVoteCommit)
+		coordinatorGroup.POST("/votes/:id/:segment/abort", handleVoteAbort)
+		// Rotas escolhidas delegadas por outras empresas (COORDINATOR_SELECTION=first-segment)
+		coordinatorGroup.POST("/routes", handleForwardedRoute)
+		coordinatorGroup.GET("/requests/:id", handleIssuedRequest)
+		// Segmentos efetivados que as cidades tiraram numa redução de capacidade
+		coordinatorGroup.POST("/displaced", handleDisplaced)
+	}
+
+	// Endpoints para serem chamados por outras APIs (participantes remotos do 3PC)
+	threePCGroup := r.Group("/3pc_remote")
+	{
+		threePCGroup.POST("/prepare", func(c *gin.Context) {
+			handleRemotePrepare(c, sm, entName)
+		})
+		threePCGroup.POST("/prepare_async", func(c *gin.Context) {
+			handleRemotePrepareAsync(c, sm, entName)
+		})
+		threePCGroup.POST("/precommit", func(c *gin.Context) {
+			handleRemotePreCommit(c, sm, entName)
+		})
+		threePCGroup.POST("/docommit", func(c *gin.Context) {
+			handleRemoteCommit(c, sm, entName)
+		})
+		threePCGroup.POST("/abort", func(c *gin.Context) {
+			handleRemoteAbort(c, sm, entName)
+		})
+		threePCGroup.POST("/cancel", func(c *gin.Context) {
+			handleRemoteCancel(c, sm, entName)
+		})
 	}
 }
 
@@ -362,41 +667,103 @@ func handleRemotePrepare(c *gin.Context, sm *state.StateManager, localEntName st
 		return
 	}
 
+	if strings.HasPrefix(c.FullPath(), "/3pc_remote/") {
+		req.Protocol = protocol3PC // Habilita a decisão unilateral por tempo esgotado nesta reserva
+	}
+
 	log.Printf("[%s] TX[%s]: Recebido PREPARE REMOTO para VehicleID %s na cidade %s", localEntName, req.TransactionID, req.VehicleID, req.City)
-	success, err := sm.PrepareReservation(req.TransactionID, req.VehicleID, req.RequestID, req.ReservationWindow) // Passa a janela
+	reservation, err := sm.PrepareReservation(req)
 
-	if !success || err != nil {
+	if err != nil {
 		log.Printf("[%s] TX[%s]: FALHA PREPARE REMOTO (interno): %v", localEntName, req.TransactionID, err)
-		c.JSON(http.StatusConflict, schemas.RemotePrepareResponse{Status: "REJECTED", TransactionID: req.TransactionID, Reason: err.Error()})
+		resp := schemas.RemotePrepareResponse{Status: "REJECTED", TransactionID: req.TransactionID, Reason: err.Error()}
+		var conflict *state.ConflictError
+		if errors.As(err, &conflict) {
+			resp.Conflicts = conflict.Conflicts
+		}
+		c.JSON(http.StatusConflict, resp)
 		return
 	}
-	log.Printf("[%s] TX[%s]: SUCESSO PREPARE REMOTO (interno)", localEntName, req.TransactionID)
-	c.JSON(http.StatusOK, schemas.RemotePrepareResponse{Status: schemas.StatusReservationPrepared, TransactionID: req.TransactionID})
+	log.Printf("[%s] TX[%s]: SUCESSO PREPARE REMOTO (interno) no posto %s", localEntName, req.TransactionID, reservation.ChargingPointID)
+	c.JSON(http.StatusOK, schemas.RemotePrepareResponse{Status: schemas.StatusReservationPrepared, TransactionID: req.TransactionID, PreparedUntilUTC: reservation.PreparedUntilUTC.Format(schemas.ISOFormat), ChargingPointID: reservation.ChargingPointID, ReservationWindow: &reservation.ReservationWindow})
 }
 
 func handleRemoteCommit(c *gin.Context, sm *state.StateManager, localEntName string) {
 	var req schemas.RemoteCommitAbortRequest
-	if err := c.ShouldBindJSON(&req); err != nil { /* ... erro ... */
+	if err := c.ShouldBindJSON(&req); err != nil {
+		// Sem resposta explícita o Gin responderia 200, e a fila de entregas trataria como confirmado
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
 		return
 	}
 	log.Printf("[%s] TX[%s]: Recebido COMMIT REMOTO", localEntName, req.TransactionID)
-	sm.CommitReservation(req.TransactionID)
+	outcome := sm.CommitReservation(req.TransactionID)
+	if outcome == schemas.StatusHeuristicMixed {
+		// A decisão heurística não pode ser desfeita: o COMMIT é confirmado para o coordenador encerrar a transação
+		c.JSON(http.StatusOK, gin.H{"status": schemas.StatusHeuristicMixed, "transaction_id": req.TransactionID})
+		return
+	}
+	if outcome != schemas.StatusReservationCommitted {
+		// Sem 200 a fila de entregas não registra o ACK, e o coordenador vê a falha
+		log.Printf("[%s] TX[%s]: COMMIT REMOTO recusado; transação %s nesta cidade.", localEntName, req.TransactionID, outcome)
+		c.JSON(http.StatusConflict, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: req.TransactionID, Reason: "COMMIT não aplicado: transação " + outcome + " nesta cidade"})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"status": schemas.StatusReservationCommitted, "transaction_id": req.TransactionID})
 }
 
+// handleRemotePreCommit recebe o PRE-COMMIT do 3PC. Só é confirmado se a reserva ainda estiver PREPARED
+// (ou já PRECOMMITTED); caso contrário o coordenador precisa abortar.
+func handleRemotePreCommit(c *gin.Context, sm *state.StateManager, localEntName string) {
+	var req schemas.RemoteCommitAbortRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	log.Printf("[%s] TX[%s]: Recebido PRE-COMMIT REMOTO", localEntName, req.TransactionID)
+	if !sm.PreCommitReservation(req.TransactionID) {
+		c.JSON(http.StatusConflict, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: req.TransactionID, Reason: "Nenhuma reserva PREPARED para esta transação"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": schemas.StatusReservationPreCommitted, "transaction_id": req.TransactionID})
+}
+
 func handleRemoteAbort(c *gin.Context, sm *state.StateManager, localEntName string) {
 	var req schemas.RemoteCommitAbortRequest
-	if err := c.ShouldBindJSON(&req); err != nil { /* ... erro ... */
+	if err := c.ShouldBindJSON(&req); err != nil {
+		// Sem resposta explícita o Gin responderia 200, e a fila de entregas trataria como confirmado
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
 		return
 	}
 	log.Printf("[%s] TX[%s]: Recebido ABORT REMOTO", localEntName, req.TransactionID)
-	sm.AbortReservation(req.TransactionID)
-	c.JSON(http.StatusOK, gin.H{"status": "ABORTED", "transaction_id": req.TransactionID})
+	// O status é o resultado local: ABORTED, HEURISTIC_MIXED ou, num conflito, o resultado que a cidade já tinha
+	outcome := sm.AbortReservation(req.TransactionID)
+	if outcome != schemas.StatusAborted && outcome != schemas.StatusHeuristicMixed {
+		log.Printf("[%s] TX[%s]: ABORT REMOTO recebido, mas a transação já está %s nesta cidade.", localEntName, req.TransactionID, outcome)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": outcome, "transaction_id": req.TransactionID})
+}
+
+// handleTransactionStatus responde o estado local da transação e, se esta API a coordenou, a decisão
+// global. Com ?terminating=true a consulta vem da terminação cooperativa de outro participante, e
+// uma transação desconhecida aqui passa a ser ABORTED (ver StateManager.TerminationStatus).
+func handleTransactionStatus(c *gin.Context, sm *state.StateManager) {
+	transactionID := c.Param("id")
+	resp := schemas.TransactionStatusResponse{
+		TransactionID: transactionID,
+		City:          ownedCity,
+		State:         sm.TransactionStatus(transactionID),
+	}
+	if c.Query("terminating") == "true" {
+		resp.State = sm.TerminationStatus(transactionID)
+	}
+	if decision := coordinatorDecision(transactionID, c.Query("city")); decision != schemas.StatusUnknown {
+		resp.Decision = decision
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 // Função auxiliar para publicar o status da reserva (ajustada para incluir enterpriseName nos logs)
 func publishReservationStatus(vehicleID, transactionID, status, message string, chosenRoute *schemas.ChosenRouteMsg, pubEnterpriseName string) {
-	topic := fmt.Sprintf("car/reservation/status/%s", vehicleID)
 	statusPayload := schemas.ReservationStatus{
 		TransactionID: transactionID,
 		VehicleID:     vehicleID,
@@ -409,7 +776,20 @@ func publishReservationStatus(vehicleID, transactionID, status, message string,
 			statusPayload.ConfirmedRoute = chosenRoute.Route
 		}
 	}
+	sendReservationStatus(statusPayload, pubEnterpriseName)
+}
+
+// sendReservationStatus grava o status no log do coordenador (quando há RequestID) e o publica para o veículo.
+func sendReservationStatus(statusPayload schemas.ReservationStatus, pubEnterpriseName string) {
+	statusPayload.Coordinator = pubEnterpriseName // O veículo envia o cancelamento a quem coordenou
+	topic := fmt.Sprintf("car/reservation/status/%s", statusPayload.VehicleID)
+	if statusPayload.RequestID != "" {
+		// Guardar o status para responder a entregas duplicadas da mesma rota escolhida
+		if err := txLog.Append(txlog.Record{Type: txlog.RecordStatus, TransactionID: statusPayload.TransactionID, RequestID: statusPayload.RequestID, Status: &statusPayload}); err != nil {
+			log.Printf("[%s] TX[%s]: Falha ao gravar status da reserva no log: %v", pubEnterpriseName, statusPayload.TransactionID, err)
+		}
+	}
 	payloadBytes, _ := json.Marshal(statusPayload)
 	mqtt.Publish(topic, string(payloadBytes))
-	log.Printf("[%s] TX[%s]: Status da reserva '%s' publicado para VehicleID %s no tópico %s.", pubEnterpriseName, transactionID, status, vehicleID, topic)
+	log.Printf("[%s] TX[%s]: Status da reserva '%s' publicado para VehicleID %s no tópico %s.", pubEnterpriseName, statusPayload.TransactionID, statusPayload.Status, statusPayload.VehicleID, topic)
 }
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/api/saga"
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/api/txlog"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// actionCancel é a ação da fila de entregas que remove a reserva efetivada de uma cidade quando o
+// veículo cancela a rota.
+const actionCancel = "CANCEL"
+
+// Motivos de recusa de um pedido de cancelamento ou de remarcação.
+var (
+	errRouteUnknown      = errors.New("transação desconhecida nesta empresa")
+	errRouteForbidden    = errors.New("a transação pertence a outro veículo")
+	errRouteNotConfirmed = errors.New("a rota da transação não foi confirmada")
+	errRouteFinished     = errors.New("todas as recargas da rota já terminaram")
+	errRouteReplaced     = errors.New("a rota foi remarcada")
+	errRouteChanging     = errors.New("há uma alteração da rota em andamento")
+)
+
+var (
+	// routeChangeMux serializa os cancelamentos e remarcações, para que dois pedidos da mesma
+	// rota não gravem dois CANCEL nem iniciem duas remarcações.
+	routeChangeMux sync.Mutex
+	// reschedulesInFlight guarda as remarcações em andamento: transação substituída -> remarcação.
+	reschedulesInFlight = make(map[string]string)
+)
+
+// cancelRoute cancela, a pedido do veículo, uma rota confirmada e coordenada por esta API: o
+// cancelamento é gravado no log de decisões e cada cidade reservada recebe o cancelamento pela
+// fila de entregas, até confirmar. Rotas de saga são compensadas como numa falha. O status
+// CANCELLED é publicado para o veículo e retornado. Repetir o pedido publica o status de novo.
+func cancelRoute(req schemas.CancelReservationMsg) (schemas.ReservationStatus, error) {
+	routeChangeMux.Lock()
+	defer routeChangeMux.Unlock()
+
+	tx, err := txLog.Transaction(req.TransactionID)
+	if err != nil {
+		return schemas.ReservationStatus{}, fmt.Errorf("falha ao ler o log de transações: %w", err)
+	}
+	if tx == nil || len(tx.Route) == 0 {
+		return schemas.ReservationStatus{}, errRouteUnknown
+	}
+	if tx.VehicleID != req.VehicleID {
+		return schemas.ReservationStatus{}, errRouteForbidden
+	}
+	if err := checkRouteChangeable(tx.ID); err != nil {
+		return schemas.ReservationStatus{}, err
+	}
+	if info, _ := txLog.Request(tx.RequestID); info.TransactionID == tx.ID && info.Status != nil && info.Status.Status == schemas.StatusCancelled {
+		// Pedido repetido: as cidades que ainda não confirmaram recebem o cancelamento de novo
+		if tx.Protocol != protocolSaga {
+			deliverCancellations(tx)
+		}
+		republishReservationStatus(*info.Status)
+		return *info.Status, nil
+	}
+	reason := req.Reason
+	if reason == "" {
+		reason = "cancelada pelo veículo"
+	}
+
+	var reserved map[string]txlog.Allocation // Cidades com reserva efetivada: posto e janela
+	if tx.Protocol == protocolSaga {
+		reserved, err = cancelSagaRoute(tx, reason)
+	} else {
+		reserved, err = cancelAtomicRoute(tx, reason)
+	}
+	if err != nil {
+		return schemas.ReservationStatus{}, err
+	}
+
+	status := schemas.ReservationStatus{
+		TransactionID: tx.ID,
+		VehicleID:     tx.VehicleID,
+		RequestID:     tx.RequestID,
+		Status:        schemas.StatusCancelled,
+		Message:       "Reserva cancelada: " + reason,
+	}
+	for _, segment := range tx.Route {
+		alloc, ok := reserved[segment.City]
+		if !ok {
+			continue
+		}
+		segment = allocatedSegment(segment, alloc)
+		status.Segments = append(status.Segments, schemas.SegmentOutcome{City: segment.City, ReservationWindow: segment.ReservationWindow, Optional: segment.Optional, Status: schemas.StatusCancelled, ChargingPointID: segment.ChargingPointID})
+	}
+	sendReservationStatus(status, enterpriseName)
+	return status, nil
+}
+
+// cancelAtomicRoute grava o CANCEL de uma transação 2PC/3PC efetivada e entrega o cancelamento às
+// cidades que ainda não o confirmaram. Retorna as cidades que tinham a reserva. O cancelamento só é
+// aceito depois que todas as cidades confirmaram o COMMIT: um CANCEL aplicado antes do COMMIT
+// removeria a reserva PREPARED e o COMMIT seria recusado para sempre.
+func cancelAtomicRoute(tx *txlog.Transaction, reason string) (map[string]txlog.Allocation, error) {
+	if tx.Decision != txlog.DecisionCommit {
+		return nil, errRouteNotConfirmed
+	}
+	if !tx.Cancelled && !tx.Completed() {
+		return nil, fmt.Errorf("%w: COMMIT ainda não confirmado por %v", errRouteChanging, tx.PendingCities())
+	}
+	reserved := reservedAllocations(tx)
+	if !tx.Cancelled {
+		if routeFinished(tx.Route, reserved) {
+			return nil, errRouteFinished
+		}
+		if err := txLog.Append(txlog.Record{Type: txlog.RecordCancel, TransactionID: tx.ID, Reason: reason}); err != nil {
+			return nil, fmt.Errorf("falha ao gravar o cancelamento: %w", err)
+		}
+		tx.Cancelled = true
+		log.Printf("[%s] TX[%s]: Cancelamento pedido pelo veículo %s (%s).", enterpriseName, tx.ID, tx.VehicleID, reason)
+	}
+	deliverCancellations(tx)
+	return reserved, nil
+}
+
+// reservedAllocations retorna o posto e a janela de cada cidade que efetivou a reserva de uma
+// transação 2PC/3PC e ainda a mantém: as que votaram SIM, menos as que perderam a vaga numa
+// redução de capacidade.
+func reservedAllocations(tx *txlog.Transaction) map[string]txlog.Allocation {
+	reserved := make(map[string]txlog.Allocation)
+	for city, p := range tx.Participants {
+		if p.Vote == txlog.VoteYes && !p.Displaced {
+			reserved[city] = p.Allocation
+		}
+	}
+	return reserved
+}
+
+// cancelSagaRoute compensa todas as cidades de uma saga concluída. Retorna as cidades que tinham a reserva.
+func cancelSagaRoute(tx *txlog.Transaction, reason string) (map[string]txlog.Allocation, error) {
+	sg, ok := sagaStore.Get(tx.ID)
+	if !ok || sg.Status != saga.StatusCompleted {
+		return nil, errRouteNotConfirmed
+	}
+	reserved := make(map[string]txlog.Allocation)
+	for _, step := range sg.Steps {
+		if step.Status == saga.StepReserved {
+			reserved[step.City] = txlog.Allocation{}
+		}
+	}
+	if routeFinished(tx.Route, reserved) {
+		return nil, errRouteFinished
+	}
+	log.Printf("[%s] SAGA[%s]: Cancelamento pedido pelo veículo %s (%s).", enterpriseName, tx.ID, tx.VehicleID, reason)
+	compensateSaga(tx.ID, reason)
+	return reserved, nil
+}
+
+// checkRouteChangeable recusa mudar uma rota já substituída por uma remarcação ou com uma
+// remarcação em andamento. Requer routeChangeMux travado.
+func checkRouteChangeable(transactionID string) error {
+	if replacement := txLog.ReplacedBy(transactionID); replacement != "" {
+		return fmt.Errorf("%w: use a transação %s", errRouteReplaced, replacement)
+	}
+	if pending, ok := reschedulesInFlight[transactionID]; ok {
+		return fmt.Errorf("%w: remarcação na transação %s", errRouteChanging, pending)
+	}
+	return nil
+}
+
+// routeFinished indica se todas as recargas reservadas da rota já terminaram.
+func routeFinished(route []schemas.RouteSegment, reserved map[string]txlog.Allocation) bool {
+	now := time.Now().UTC()
+	for _, segment := range route {
+		alloc, ok := reserved[segment.City]
+		if !ok {
+			continue
+		}
+		if allocatedSegment(segment, alloc).ReservationWindow.EndTimeUTC.After(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// deliverCancellations envia o cancelamento às cidades da transação que ainda não o confirmaram:
+// na hora, se local, ou pela fila de entregas, que o reenvia até o participante confirmar.
+func deliverCancellations(tx *txlog.Transaction) {
+	for _, city := range tx.PendingCancellations() {
+		endpoint, err := resolveParticipantEndpoint(tx, city)
+		if err != nil {
+			log.Printf("[%s] TX[%s]: Não foi possível localizar %s para cancelar a reserva: %v", enterpriseName, tx.ID, city, err)
+			continue
+		}
+		if endpoint == txlog.EndpointLocal {
+			stateMgr.CancelReservation(tx.ID)
+			logCancelAck(tx.ID, city, endpoint)
+			continue
+		}
+		log.Printf("[%s] TX[%s]: Enfileirando CANCELAMENTO para %s (API: %s)", enterpriseName, tx.ID, city, endpoint)
+		if err := deliveryQueue.Enqueue(tx.ID, city, endpoint, actionCancel); err != nil {
+			log.Printf("[%s] TX[%s]: ERRO ao agendar cancelamento para %s: %v", enterpriseName, tx.ID, city, err)
+		}
+	}
+}
+
+// logCancelAck grava no log de decisões que a cidade removeu a reserva cancelada.
+func logCancelAck(transactionID, city, endpoint string) {
+	if err := txLog.Append(txlog.Record{Type: txlog.RecordCancelAck, TransactionID: transactionID, City: city, Endpoint: endpoint}); err != nil {
+		log.Printf("[%s] TX[%s]: Falha ao gravar confirmação de cancelamento de %s no log: %v", enterpriseName, transactionID, city, err)
+	}
+}
+
+// handleCancelMessage trata um pedido de cancelamento recebido do veículo por MQTT. Se for
+// recusado, o veículo recebe CANCEL_REJECTED e a reserva continua valendo.
+func handleCancelMessage(payload string) {
+	var req schemas.CancelReservationMsg
+	if err := json.Unmarshal([]byte(payload), &req); err != nil || req.TransactionID == "" || req.VehicleID == "" {
+		log.Printf("[%s] Pedido de cancelamento inválido: %v. Mensagem original: %s", enterpriseName, err, payload)
+		return
+	}
+	if _, err := cancelRoute(req); err != nil {
+		log.Printf("[%s] TX[%s]: Cancelamento recusado para VehicleID %s: %v", enterpriseName, req.TransactionID, req.VehicleID, err)
+		// Não é gravado no log: o status da rota continua sendo o anterior
+		publishUnloggedStatus(schemas.ReservationStatus{TransactionID: req.TransactionID, VehicleID: req.VehicleID, Status: schemas.StatusCancelRejected, Message: "Cancelamento recusado: " + err.Error()})
+	}
+}
+
+// handleCancelReservation é o cancelamento por HTTP (POST /reservations/:id/cancel), com o
+// VehicleID dono da reserva no corpo. Responde com o status CANCELLED publicado para o veículo.
+func handleCancelReservation(c *gin.Context) {
+	var req schemas.CancelReservationMsg
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	req.TransactionID = c.Param("id")
+	if req.VehicleID == "" {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: req.TransactionID, Reason: "vehicle_id é obrigatório"})
+		return
+	}
+	status, err := cancelRoute(req)
+	if err != nil {
+		c.JSON(routeChangeErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: req.TransactionID, Reason: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// handleRemoteCancel remove desta cidade a reserva efetivada de uma transação 2PC/3PC cancelada
+// pelo veículo. Repetir o cancelamento também é confirmado, para que a fila de entregas registre o
+// CANCEL_ACK.
+func handleRemoteCancel(c *gin.Context, sm *state.StateManager, localEntName string) {
+	var req schemas.RemoteCommitAbortRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	log.Printf("[%s] TX[%s]: Recebido CANCELAMENTO REMOTO", localEntName, req.TransactionID)
+	sm.CancelReservation(req.TransactionID)
+	c.JSON(http.StatusOK, gin.H{"status": schemas.StatusCancelled, "transaction_id": req.TransactionID})
+}
+
+// routeChangeErrorCode é o status HTTP da recusa de um cancelamento ou remarcação.
+func routeChangeErrorCode(err error) int {
+	switch {
+	case errors.Is(err, errRouteUnknown):
+		return http.StatusNotFound
+	case errors.Is(err, errRouteForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errRescheduleInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errRouteNotConfirmed), errors.Is(err, errRouteFinished), errors.Is(err, errRouteReplaced), errors.Is(err, errRouteChanging), errors.Is(err, errRescheduleSaga):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// publishUnloggedStatus publica para o veículo um status que não muda o da rota (uma recusa),
+// sem gravá-lo no log.
+func publishUnloggedStatus(status schemas.ReservationStatus) {
+	status.Coordinator = enterpriseName
+	payloadBytes, _ := json.Marshal(status)
+	mqtt.Publish(fmt.Sprintf("car/reservation/status/%s", status.VehicleID), string(payloadBytes))
+}
+
+// recoverCancellations retoma os cancelamentos interrompidos por uma queda: as cidades que ainda
+// não confirmaram recebem o cancelamento de novo.
+func recoverCancellations(transactions []*txlog.Transaction) {
+	for _, tx := range transactions {
+		if len(tx.PendingCancellations()) == 0 {
+			continue
+		}
+		log.Printf("[%s] TX[%s]: Cancelamento interrompido. Reenviando às cidades pendentes.", enterpriseName, tx.ID)
+		deliverCancellations(tx)
+	}
+}
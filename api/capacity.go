@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/api/txlog"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// capacityErrorCode traduz um erro de alteração de capacidade em código HTTP.
+func capacityErrorCode(err error) int {
+	switch {
+	case errors.Is(err, state.ErrCapacityInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errCityNotServed), errors.Is(err, state.ErrUnknownPost):
+		return http.StatusNotFound
+	case errors.Is(err, state.ErrCapacityConflict):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleListPosts lista os postos e as manutenções da cidade (query "city", padrão: a cidade
+// desta API).
+func handleListPosts(c *gin.Context) {
+	sm, err := cityStateManager(c.DefaultQuery("city", ownedCity))
+	if err != nil {
+		c.JSON(capacityErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, Reason: err.Error()})
+		return
+	}
+	posts := sm.Posts()
+	c.JSON(http.StatusOK, gin.H{"max_posts": len(posts), "posts": posts, "maintenance": sm.Maintenance(), "policy": sm.VictimPolicy()})
+}
+
+// handleAddPosts acrescenta postos iguais à cidade. Responde 201 com os novos postos.
+func handleAddPosts(c *gin.Context) {
+	var req schemas.AddPostsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	sm, err := cityStateManager(c.DefaultQuery("city", ownedCity))
+	if err != nil {
+		c.JSON(capacityErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, Reason: err.Error()})
+		return
+	}
+	added, err := sm.AddPosts(state.PostSpec{Count: req.Quantity, PowerLevel: req.PowerLevel, Connector: req.Connector})
+	if err != nil {
+		c.JSON(capacityErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, Reason: err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"added": added, "max_posts": len(sm.Posts())})
+}
+
+// handleRemovePost tira o posto da cidade (query "policy" escolhe a política das reservas
+// deslocadas) e responde com as reservas transferidas e as que perderam a vaga.
+func handleRemovePost(c *gin.Context) {
+	sm, err := cityStateManager(c.DefaultQuery("city", ownedCity))
+	if err == nil {
+		var result schemas.CapacityChangeResult
+		if result, err = sm.RemovePost(c.Param("id"), c.Query("policy")); err == nil {
+			c.JSON(http.StatusOK, result)
+			return
+		}
+	}
+	c.JSON(capacityErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, Reason: err.Error()})
+}
+
+// handleScheduleMaintenance coloca o posto em manutenção durante a janela do corpo. Responde 201
+// com o bloqueio criado, as reservas transferidas e as que perderam a vaga.
+func handleScheduleMaintenance(c *gin.Context) {
+	var req schemas.MaintenanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	sm, err := cityStateManager(c.DefaultQuery("city", ownedCity))
+	if err == nil {
+		var result schemas.CapacityChangeResult
+		if result, err = sm.ScheduleMaintenance(c.Param("id"), req.ReservationWindow, req.Policy); err == nil {
+			c.JSON(http.StatusCreated, result)
+			return
+		}
+	}
+	c.JSON(capacityErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, Reason: err.Error()})
+}
+
+// handleEndMaintenance encerra antes do fim a manutenção e devolve o posto às reservas.
+func handleEndMaintenance(c *gin.Context) {
+	maintenanceID := c.Param("id")
+	sm, err := cityStateManager(c.DefaultQuery("city", ownedCity))
+	if err != nil {
+		c.JSON(capacityErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, Reason: err.Error()})
+		return
+	}
+	if !sm.EndMaintenance(maintenanceID) {
+		c.JSON(http.StatusNotFound, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Manutenção não encontrada: " + maintenanceID})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ENDED", "id": maintenanceID})
+}
+
+// actionDisplaced é a ação da fila de entregas que avisa a coordenadora de que uma cidade desta API
+// tirou a vaga do segmento efetivado de uma transação numa redução de capacidade.
+const actionDisplaced = "DISPLACED"
+
+// watchDisplacements passa a avisar as coordenadoras das reservas que as cidades desta API tiram
+// numa redução de capacidade. O aviso vai pela fila de entregas, que o reenvia até ser confirmado.
+func watchDisplacements() {
+	for _, sm := range localStateManagers() {
+		sm.SetDisplacedHook(func(res schemas.ActiveReservation) {
+			if err := deliveryQueue.Enqueue(res.TransactionID, res.City, res.CoordinatorURL, actionDisplaced); err != nil {
+				log.Printf("[%s] TX[%s]: ERRO ao agendar o aviso de vaga perdida em %s para a coordenadora: %v", enterpriseName, res.TransactionID, res.City, err)
+			}
+		})
+	}
+}
+
+// reportDisplacement avisa a coordenadora em coordinatorURL de que a cidade tirou a vaga do
+// segmento da transação. Só é confirmado com HTTP 200.
+func reportDisplacement(coordinatorURL, transactionID, city string) error {
+	if coordinatorURL == selfAPIURL {
+		return recordDisplacement(transactionID, city)
+	}
+	payloadBytes, _ := json.Marshal(schemas.DisplacementReport{TransactionID: transactionID, City: city})
+	ctx, cancel := context.WithTimeout(context.Background(), decisionTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, coordinatorURL+"/2pc_coordinator/displaced", bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := participantHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("aviso de vaga perdida recusado pela coordenadora (status %s)", resp.Status)
+	}
+	return nil
+}
+
+// recordDisplacement grava no log de decisões que a cidade tirou a vaga do segmento da transação
+// e troca o status guardado da rota, que deixa de aparecer como confirmada por inteiro. O veículo
+// já foi avisado pela cidade (DISPLACED), então o status não é publicado de novo. Um aviso
+// repetido, ou de uma transação que o log não tem mais, é apenas confirmado.
+func recordDisplacement(transactionID, city string) error {
+	routeChangeMux.Lock()
+	defer routeChangeMux.Unlock()
+
+	tx, err := txLog.Transaction(transactionID)
+	if err != nil {
+		return fmt.Errorf("falha ao ler o log de transações: %w", err)
+	}
+	if tx == nil {
+		log.Printf("[%s] TX[%s]: %s tirou a vaga de uma transação desconhecida; nada a registrar.", enterpriseName, transactionID, city)
+		return nil
+	}
+	if p, ok := tx.Participants[city]; ok && p.Displaced {
+		return nil
+	}
+	if err := txLog.Append(txlog.Record{Type: txlog.RecordDisplaced, TransactionID: tx.ID, City: city}); err != nil {
+		return fmt.Errorf("falha ao gravar a vaga perdida: %w", err)
+	}
+	log.Printf("[%s] TX[%s]: %s tirou a vaga do segmento do veículo %s numa redução de capacidade.", enterpriseName, tx.ID, city, tx.VehicleID)
+
+	info, _ := txLog.Request(tx.RequestID)
+	if info.TransactionID != tx.ID || info.Status == nil || (info.Status.Status != schemas.StatusConfirmed && info.Status.Status != schemas.StatusPartiallyConfirmed) {
+		return nil
+	}
+	status := displacedStatus(*info.Status, city)
+	if err := txLog.Append(txlog.Record{Type: txlog.RecordStatus, TransactionID: tx.ID, RequestID: tx.RequestID, Status: &status}); err != nil {
+		return fmt.Errorf("falha ao gravar o status da rota: %w", err)
+	}
+	return nil
+}
+
+// displacedStatus retorna o status da rota sem o segmento da cidade que perdeu a vaga: parcialmente
+// confirmada, ou cancelada se não sobrar nenhum segmento confirmado.
+func displacedStatus(status schemas.ReservationStatus, city string) schemas.ReservationStatus {
+	status.Segments = append([]schemas.SegmentOutcome(nil), status.Segments...)
+	confirmed := 0
+	for i := range status.Segments {
+		segment := &status.Segments[i]
+		if segment.City == city && segment.Status == schemas.StatusConfirmed {
+			segment.Status, segment.Reason = schemas.StatusReservationDisplaced, "Posto removido ou em manutenção"
+		}
+		if segment.Status == schemas.StatusConfirmed {
+			confirmed++
+		}
+	}
+	var route []schemas.RouteSegment
+	for _, segment := range status.ConfirmedRoute {
+		if segment.City != city {
+			route = append(route, segment)
+		}
+	}
+	status.ConfirmedRoute = route
+	status.Status = schemas.StatusPartiallyConfirmed
+	if confirmed == 0 {
+		status.Status = schemas.StatusCancelled
+	}
+	status.Message = fmt.Sprintf("O segmento em %s perdeu o posto numa redução de capacidade da cidade", city)
+	return status
+}
+
+// handleDisplaced recebe de outra empresa o aviso de que uma cidade dela tirou a vaga do segmento
+// de uma transação coordenada aqui (POST /2pc_coordinator/displaced).
+func handleDisplaced(c *gin.Context) {
+	var req schemas.DisplacementReport
+	if err := c.ShouldBindJSON(&req); err != nil || req.TransactionID == "" || req.City == "" {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: transaction_id e city são obrigatórios"})
+		return
+	}
+	if err := recordDisplacement(req.TransactionID, req.City); err != nil {
+		c.JSON(http.StatusInternalServerError, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: req.TransactionID, Reason: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": schemas.StatusReservationDisplaced, "transaction_id": req.TransactionID})
+}
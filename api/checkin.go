@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// checkInTopic é onde os carros publicam a chegada ao posto. Todas as APIs escutam o tópico e
+// cada uma trata os check-ins das cidades que serve.
+const checkInTopic = "car/checkin"
+
+// checkIn registra a chegada do veículo ao posto reservado na cidade.
+func checkIn(msg schemas.CheckInMsg) (schemas.ActiveReservation, error) {
+	sm, err := cityStateManager(msg.City)
+	if err != nil {
+		return schemas.ActiveReservation{}, fmt.Errorf("%w: a cidade %s não é servida por %s", state.ErrNoReservation, msg.City, enterpriseName)
+	}
+	return sm.CheckIn(msg.TransactionID, msg.VehicleID)
+}
+
+// handleCheckInMessage trata um check-in recebido por MQTT. Check-ins de cidades servidas por
+// outras APIs são ignorados; um check-in recusado é avisado ao veículo com CHECKIN_REJECTED.
+func handleCheckInMessage(payload string) {
+	var msg schemas.CheckInMsg
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil || msg.TransactionID == "" || msg.VehicleID == "" {
+		log.Printf("[%s] Check-in inválido: %v. Mensagem original: %s", enterpriseName, err, payload)
+		return
+	}
+	if _, err := cityStateManager(msg.City); err != nil {
+		return
+	}
+	log.Printf("[%s] CHECK-IN recebido no tópico '%s': %s", enterpriseName, checkInTopic, payload)
+	if _, err := checkIn(msg); err != nil {
+		log.Printf("[%s] TX[%s]: Check-in recusado para VehicleID %s em %s: %v", enterpriseName, msg.TransactionID, msg.VehicleID, msg.City, err)
+		event := schemas.ReservationEventMessage{VehicleID: msg.VehicleID, TransactionID: msg.TransactionID, City: msg.City, Status: schemas.StatusCheckInRejected, Message: err.Error(), TimeUTC: time.Now().UTC()}
+		payloadBytes, _ := json.Marshal(event)
+		mqtt.Publish(fmt.Sprintf("car/reservation/event/%s", msg.VehicleID), string(payloadBytes))
+	}
+}
+
+// handleCheckIn é o check-in por HTTP (POST /reservations/:id/checkin), com o VehicleID e a cidade
+// (padrão: a cidade desta API) no corpo. Responde com a reserva em CHARGING.
+func handleCheckIn(c *gin.Context) {
+	var msg schemas.CheckInMsg
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	msg.TransactionID = c.Param("id")
+	if msg.VehicleID == "" {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: msg.TransactionID, Reason: "vehicle_id é obrigatório"})
+		return
+	}
+	if msg.City == "" {
+		msg.City = ownedCity
+	}
+	res, err := checkIn(msg)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, state.ErrNoReservation):
+			code = http.StatusNotFound
+		case errors.Is(err, state.ErrCheckInRefused):
+			code = http.StatusConflict
+		}
+		c.JSON(code, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: msg.TransactionID, Reason: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/api/txlog"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// Ordem de envio dos PREPAREs, selecionada com PREPARE_ORDER.
+const (
+	prepareOrderParallel  = "parallel" // Todos os segmentos ao mesmo tempo
+	prepareOrderCanonical = "ordered"  // Um segmento por vez, em ordem global (cidade, início da janela)
+)
+
+// Políticas para conflitos com reservas PREPARED de outras transações, selecionadas com CONFLICT_POLICY.
+// A prioridade de uma transação é o instante da sua primeira tentativa: a mais antiga tem preferência.
+const (
+	conflictPolicyNone      = "none"       // Conflito é voto NÃO
+	conflictPolicyWaitDie   = "wait-die"   // A mais antiga espera; a mais nova morre e recomeça
+	conflictPolicyWoundWait = "wound-wait" // A mais antiga fere (aborta) as mais novas; a mais nova espera
+)
+
+var (
+	prepareOrder   = prepareOrderParallel
+	conflictPolicy = conflictPolicyNone
+)
+
+const (
+	// conflictRetryInterval é a espera entre novas tentativas de PREPARE de um segmento em conflito.
+	conflictRetryInterval = 250 * time.Millisecond
+	// maxConflictRestarts limita quantas vezes uma transação morta ou ferida recomeça.
+	maxConflictRestarts = 5
+	// conflictRestartDelay é multiplicado pelo número da tentativa antes de recomeçar.
+	conflictRestartDelay = 500 * time.Millisecond
+)
+
+// errTransactionRestart indica que a tentativa foi abortada pela política de conflitos e deve
+// recomeçar com um novo TransactionID e a mesma prioridade.
+var errTransactionRestart = errors.New("transação abortada pela política de conflitos")
+
+// canonicalOrder retorna os segmentos na ordem global usada por todos os coordenadores, o que
+// impede que duas transações esperem uma pela outra em ordens opostas.
+func canonicalOrder(route []schemas.RouteSegment) []schemas.RouteSegment {
+	ordered := append([]schemas.RouteSegment(nil), route...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].City != ordered[j].City {
+			return ordered[i].City < ordered[j].City
+		}
+		return ordered[i].ReservationWindow.StartTimeUTC.Before(ordered[j].ReservationWindow.StartTimeUTC)
+	})
+	return ordered
+}
+
+// olderThan indica se a transação (priority, transactionID) tem preferência sobre a reserva em
+// conflito. Reservas sem prioridade (sagas ou coordenadores sem política) nunca são preteridas.
+func olderThan(priority time.Time, transactionID string, holder schemas.PrepareConflict) bool {
+	if holder.PriorityUTC.IsZero() {
+		return false
+	}
+	if !priority.Equal(holder.PriorityUTC) {
+		return priority.Before(holder.PriorityUTC)
+	}
+	return transactionID < holder.TransactionID
+}
+
+// resolveConflict aplica a política de conflitos a um PREPARE recusado. Retorna nil quando o
+// PREPARE deve ser tentado de novo, errTransactionRestart quando a transação deve morrer, ou o
+// erro do contexto se o prazo da fase de PREPARE acabar durante a espera.
+func resolveConflict(ctx context.Context, transactionID string, priority time.Time, conflict *state.ConflictError, wounded map[string]bool) error {
+	switch conflictPolicy {
+	case conflictPolicyWaitDie:
+		for _, holder := range conflict.Conflicts {
+			if !olderThan(priority, transactionID, holder) {
+				return fmt.Errorf("%w: wait-die, transação mais nova que %s", errTransactionRestart, holder.TransactionID)
+			}
+		}
+	case conflictPolicyWoundWait:
+		for _, holder := range conflict.Conflicts {
+			if olderThan(priority, transactionID, holder) && !wounded[holder.TransactionID] {
+				wounded[holder.TransactionID] = true
+				requestWound(transactionID, holder)
+			}
+		}
+	}
+	select {
+	case <-time.After(conflictRetryInterval):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// requestWound pede ao coordenador da reserva em conflito que aborte a transação mais nova.
+func requestWound(transactionID string, holder schemas.PrepareConflict) {
+	log.Printf("[%s] TX[%s]: wound-wait - ferindo transação mais nova %s", enterpriseName, transactionID, holder.TransactionID)
+	if holder.CoordinatorURL == "" {
+		return
+	}
+	if holder.CoordinatorURL == selfAPIURL {
+		woundTransaction(holder.TransactionID)
+		return
+	}
+	payloadBytes, _ := json.Marshal(schemas.RemoteCommitAbortRequest{TransactionID: holder.TransactionID})
+	ctx, cancel := context.WithTimeout(context.Background(), decisionQueryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, holder.CoordinatorURL+"/2pc_remote/wound", bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := decisionHTTPClient.Do(req)
+	if err != nil {
+		log.Printf("[%s] TX[%s]: Falha ao ferir %s: %v", enterpriseName, transactionID, holder.TransactionID, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// woundState guarda, por transação coordenada aqui, se ela foi ferida e se já passou do ponto
+// em que ainda pode ser abortada (PRE-COMMIT ou decisão COMMIT gravados).
+var woundState = struct {
+	mux     sync.Mutex
+	wounded map[string]bool
+	sealed  map[string]bool
+	cancels map[string]context.CancelFunc
+}{wounded: make(map[string]bool), sealed: make(map[string]bool), cancels: make(map[string]context.CancelFunc)}
+
+// trackPrepare associa a fase de PREPARE da transação ao seu cancelamento, para que um
+// ferimento interrompa as esperas em andamento.
+func trackPrepare(transactionID string, cancel context.CancelFunc) {
+	woundState.mux.Lock()
+	woundState.cancels[transactionID] = cancel
+	woundState.mux.Unlock()
+}
+
+// forgetTransaction descarta o estado de ferimento de uma transação concluída.
+func forgetTransaction(transactionID string) {
+	woundState.mux.Lock()
+	delete(woundState.wounded, transactionID)
+	delete(woundState.sealed, transactionID)
+	delete(woundState.cancels, transactionID)
+	woundState.mux.Unlock()
+}
+
+func isWounded(transactionID string) bool {
+	woundState.mux.Lock()
+	defer woundState.mux.Unlock()
+	return woundState.wounded[transactionID]
+}
+
+// woundTransaction aborta uma transação coordenada aqui a pedido de uma transação mais antiga.
+// Retorna false se ela já não pode ser abortada (PRE-COMMIT ou COMMIT já gravados).
+func woundTransaction(transactionID string) bool {
+	woundState.mux.Lock()
+	defer woundState.mux.Unlock()
+
+	decision, known := txLog.Decision(transactionID)
+	if !known || decision == txlog.DecisionAbort {
+		return true
+	}
+	if decision != "" || woundState.sealed[transactionID] {
+		return false
+	}
+	woundState.wounded[transactionID] = true
+	if cancel, ok := woundState.cancels[transactionID]; ok {
+		cancel()
+	}
+	log.Printf("[%s] TX[%s]: Transação ferida por uma transação mais antiga. Será abortada.", enterpriseName, transactionID)
+	return true
+}
+
+// appendUnlessWounded grava um registro que torna a transação irrevogável (PRE-COMMIT ou decisão
+// COMMIT), a menos que ela tenha sido ferida. A verificação e a gravação são atômicas em
+// relação a woundTransaction.
+func appendUnlessWounded(record txlog.Record) (bool, error) {
+	woundState.mux.Lock()
+	defer woundState.mux.Unlock()
+
+	if woundState.wounded[record.TransactionID] {
+		return false, nil
+	}
+	if err := txLog.Append(record); err != nil {
+		return true, err
+	}
+	woundState.sealed[record.TransactionID] = true
+	return true, nil
+}
+
+// handleWound é chamado pelo coordenador de uma transação mais antiga (wound-wait).
+func handleWound(c *gin.Context) {
+	var req schemas.RemoteCommitAbortRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	if !woundTransaction(req.TransactionID) {
+		c.JSON(http.StatusConflict, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: req.TransactionID, Reason: "Transação já decidida ou em PRE-COMMIT"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "WOUNDED", "transaction_id": req.TransactionID})
+}
@@ -0,0 +1,786 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/delivery"
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/api/participant"
+	"github.com/4r7hur0/PBL-2/api/saga"
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/api/timeline"
+	"github.com/4r7hur0/PBL-2/api/txlog"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/google/uuid"
+)
+
+// recoveryRetryInterval é o intervalo entre tentativas de reenviar decisões pendentes após uma queda.
+const recoveryRetryInterval = 5 * time.Second
+
+// defaultPrepareTimeout é o prazo global padrão da fase de PREPARE de uma transação.
+const defaultPrepareTimeout = 10 * time.Second
+
+// Compactação do log de decisões: transações encerradas e RequestIDs sem uso há mais de
+// txLogRetention são descartados a cada txLogCompactInterval.
+const (
+	defaultTxLogRetention = 24 * time.Hour
+	txLogCompactInterval  = time.Hour
+)
+
+var (
+	// prepareTimeout limita a fase de PREPARE inteira, não cada participante.
+	prepareTimeout = defaultPrepareTimeout
+
+	// txLogRetention é por quanto tempo uma transação encerrada continua no log de decisões.
+	txLogRetention = defaultTxLogRetention
+
+	// Clientes HTTP compartilhados entre transações. Os prazos vêm do contexto de cada chamada:
+	// o PREPARE é limitado pela transação e os demais comandos por decisionTimeout.
+	participantHTTPClient = &http.Client{Transport: interAPITransport}
+	decisionHTTPClient    = &http.Client{Transport: interAPITransport, Timeout: decisionTimeout}
+)
+
+// decisionTimeout limita cada entrega de COMMIT/ABORT/compensação a um participante.
+const decisionTimeout = 10 * time.Second
+
+// Protocolos de reserva de rota, selecionados por empresa com RESERVATION_PROTOCOL.
+const (
+	protocol2PC  = participant.Protocol2PC
+	protocol3PC  = participant.Protocol3PC
+	protocolSaga = participant.ProtocolSaga
+)
+
+// reservationProtocol é o protocolo usado pelas transações coordenadas por esta API.
+var reservationProtocol = protocol2PC
+
+// isTwoPhaseCommit indica se uma transação do log foi coordenada com 2PC (registros antigos não têm protocolo).
+func isTwoPhaseCommit(protocol string) bool {
+	return protocol == "" || protocol == protocol2PC
+}
+
+// isAtomicCommit indica se a transação do log usa um protocolo de commit atômico (2PC ou 3PC).
+func isAtomicCommit(protocol string) bool {
+	return isTwoPhaseCommit(protocol) || protocol == protocol3PC
+}
+
+// startReservationTransaction coordena a reserva da rota escolhida com o protocolo configurado.
+func startReservationTransaction(transactionID string, chosenRoute schemas.ChosenRouteMsg) {
+	switch reservationProtocol {
+	case protocolSaga:
+		runSaga(transactionID, chosenRoute)
+	case protocol3PC:
+		runAtomicCommit(transactionID, chosenRoute, runThreePhaseCommit)
+	default:
+		runAtomicCommit(transactionID, chosenRoute, runTwoPhaseCommit)
+	}
+}
+
+// errBeginFailed indica que a transação nem começou; o veículo já foi avisado.
+var errBeginFailed = errors.New("falha ao gravar BEGIN")
+
+// commitAttempt executa uma tentativa de commit atômico com a prioridade informada e retorna a
+// decisão aplicada e os segmentos opcionais que ficaram de fora (cidade -> motivo).
+// errTransactionRestart indica que a tentativa morreu ou foi ferida.
+type commitAttempt func(transactionID string, chosenRoute schemas.ChosenRouteMsg, priority time.Time) (string, map[string]string, error)
+
+// runAtomicCommit executa a transação e informa o veículo do resultado. Uma tentativa abortada
+// pela política de conflitos recomeça com novo TransactionID, mas com a prioridade original,
+// para que a transação envelheça e acabe tendo preferência.
+func runAtomicCommit(transactionID string, chosenRoute schemas.ChosenRouteMsg, attempt commitAttempt) {
+	priority := time.Now().UTC()
+	for n := 1; ; n++ {
+		decision, skipped, err := attempt(transactionID, chosenRoute, priority)
+		if errors.Is(err, errBeginFailed) {
+			return
+		}
+		if errors.Is(err, errTransactionRestart) && n < maxConflictRestarts {
+			nextID := uuid.New().String()
+			log.Printf("[%s] TX[%s]: %v. Recomeçando como TX[%s] (tentativa %d).", enterpriseName, transactionID, err, nextID, n+1)
+			history.AddEvent(transactionID, timeline.EventRestart, "", fmt.Sprintf("recomeçando como %s: %v", nextID, err))
+			time.Sleep(time.Duration(n) * conflictRestartDelay)
+			transactionID = nextID
+			continue
+		}
+		publishRouteOutcome(transactionID, chosenRoute, decision == txlog.DecisionCommit, skipped, txLog.Allocations(transactionID))
+		return
+	}
+}
+
+// runTwoPhaseCommit coordena o 2PC de uma rota escolhida, gravando cada fase no log de decisões
+// antes de agir, para que uma queda no meio da transação possa ser recuperada no próximo início.
+func runTwoPhaseCommit(transactionID string, chosenRoute schemas.ChosenRouteMsg, priority time.Time) (string, map[string]string, error) {
+	if !beginTransaction(transactionID, chosenRoute, protocol2PC) {
+		return txlog.DecisionAbort, nil, errBeginFailed
+	}
+	prepared, contacted, skipped, err := runPreparePhase(transactionID, chosenRoute, protocol2PC, priority)
+	decision := txlog.DecisionAbort
+	if err == nil {
+		decision = txlog.DecisionCommit
+	}
+	decision, err = finishTransaction(transactionID, decision, prepared, contacted, err)
+	return decision, skipped, err
+}
+
+// runThreePhaseCommit coordena o 3PC (PREPARE / PRE-COMMIT / DO-COMMIT) de uma rota escolhida.
+// Depois do PRE-COMMIT os participantes sabem que todos votaram SIM e, se o coordenador cair,
+// decidem sozinhos por tempo esgotado em vez de ficarem bloqueados.
+func runThreePhaseCommit(transactionID string, chosenRoute schemas.ChosenRouteMsg, priority time.Time) (string, map[string]string, error) {
+	if !beginTransaction(transactionID, chosenRoute, protocol3PC) {
+		return txlog.DecisionAbort, nil, errBeginFailed
+	}
+	prepared, contacted, skipped, err := runPreparePhase(transactionID, chosenRoute, protocol3PC, priority)
+	if err == nil {
+		appended, appendErr := appendUnlessWounded(txlog.Record{Type: txlog.RecordPreCommit, TransactionID: transactionID})
+		switch {
+		case !appended:
+			err = fmt.Errorf("%w: ferida antes do PRE-COMMIT", errTransactionRestart)
+		case appendErr != nil:
+			log.Printf("[%s] TX[%s]: Falha ao gravar PRE-COMMIT no log: %v. Abortando.", enterpriseName, transactionID, appendErr)
+			err = appendErr
+		case !runPreCommitPhase(transactionID, prepared):
+			err = fmt.Errorf("PRE-COMMIT não confirmado por todos os participantes")
+		}
+	}
+	decision := txlog.DecisionAbort
+	if err == nil {
+		decision = txlog.DecisionCommit
+	}
+	decision, err = finishTransaction(transactionID, decision, prepared, contacted, err)
+	return decision, skipped, err
+}
+
+// publishRouteOutcome informa o veículo do resultado da rota, com o resultado de cada segmento.
+// Uma rota confirmada sem algum segmento opcional é publicada como PARTIALLY_CONFIRMED.
+// allocs traz o posto e a janela reservados em cada cidade confirmada.
+func publishRouteOutcome(transactionID string, chosenRoute schemas.ChosenRouteMsg, committed bool, skipped map[string]string, allocs map[string]txlog.Allocation) {
+	if chosenRoute.Replaces != "" && !committed {
+		publishRescheduleRejected(transactionID, chosenRoute, "Falha ao alocar as novas janelas")
+		return
+	}
+	statusPayload := schemas.ReservationStatus{
+		TransactionID: transactionID,
+		VehicleID:     chosenRoute.VehicleID,
+		RequestID:     chosenRoute.RequestID,
+		Status:        schemas.StatusRejected,
+		Message:       "Falha ao alocar postos necessários ou conflito de reserva",
+	}
+	for _, segment := range chosenRoute.Route {
+		outcome := schemas.SegmentOutcome{City: segment.City, ReservationWindow: segment.ReservationWindow, Optional: segment.Optional, Status: schemas.StatusRejected}
+		if reason, failed := skipped[segment.City]; failed {
+			outcome.Reason = reason
+		} else if committed {
+			outcome.Status = schemas.StatusConfirmed
+			segment = allocatedSegment(segment, allocs[segment.City])
+			outcome.ChargingPointID, outcome.ReservationWindow = segment.ChargingPointID, segment.ReservationWindow
+			statusPayload.ConfirmedRoute = append(statusPayload.ConfirmedRoute, segment)
+		}
+		statusPayload.Segments = append(statusPayload.Segments, outcome)
+	}
+	if committed {
+		statusPayload.Status = schemas.StatusConfirmed
+		statusPayload.Message = "Reserva confirmada com sucesso"
+		if chosenRoute.Replaces != "" {
+			statusPayload.Message = "Reserva remarcada com sucesso"
+		}
+		if len(skipped) > 0 {
+			statusPayload.Status = schemas.StatusPartiallyConfirmed
+			statusPayload.Message = fmt.Sprintf("Reserva confirmada sem %d segmento(s) opcional(is)", len(skipped))
+		}
+	}
+	sendReservationStatus(statusPayload, enterpriseName)
+}
+
+// allocatedSegment retorna o segmento com o posto e a janela que o participante reservou.
+func allocatedSegment(segment schemas.RouteSegment, alloc txlog.Allocation) schemas.RouteSegment {
+	segment.ChargingPointID = alloc.ChargingPointID
+	if alloc.ReservationWindow != nil {
+		segment.ReservationWindow = *alloc.ReservationWindow
+	}
+	return segment
+}
+
+// beginTransaction grava o BEGIN da transação. Se a gravação falhar o veículo é avisado e a
+// transação não começa.
+func beginTransaction(transactionID string, chosenRoute schemas.ChosenRouteMsg, protocol string) bool {
+	err := txLog.Append(txlog.Record{
+		Type:          txlog.RecordBegin,
+		TransactionID: transactionID,
+		VehicleID:     chosenRoute.VehicleID,
+		RequestID:     chosenRoute.RequestID,
+		Route:         chosenRoute.Route,
+		Protocol:      protocol,
+		Replaces:      chosenRoute.Replaces,
+	})
+	if err != nil {
+		log.Printf("[%s] TX[%s]: Falha ao gravar BEGIN no log de transações: %v. Transação não iniciada.", enterpriseName, transactionID, err)
+		if chosenRoute.Replaces != "" {
+			publishRescheduleRejected(transactionID, chosenRoute, "Falha interna ao iniciar a remarcação")
+			return false
+		}
+		publishReservationStatus(chosenRoute.VehicleID, transactionID, "REJECTED", "Falha interna ao iniciar a transação", &chosenRoute, enterpriseName)
+		return false
+	}
+	return true
+}
+
+// runPreparePhase envia o PREPARE de todos os segmentos sob um único prazo global: em paralelo ou,
+// com PREPARE_ORDER=ordered, um por vez na ordem canônica. Retorna os participantes que votaram
+// SIM, todos os que foram contatados, os segmentos opcionais que falharam (cidade -> motivo) e o
+// motivo da falha da transação (nil se todos os segmentos obrigatórios votaram SIM).
+func runPreparePhase(transactionID string, chosenRoute schemas.ChosenRouteMsg, protocol string, priority time.Time) (map[string]string, map[string]string, map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), prepareTimeout)
+	defer cancel()
+	trackPrepare(transactionID, cancel)
+
+	results := make(chan prepareResult, len(chosenRoute.Route))
+	if prepareOrder == prepareOrderCanonical {
+		go func() {
+			// O próximo PREPARE só sai depois do voto SIM do anterior (ou da falha de um opcional);
+			// os segmentos seguintes a uma falha não são contatados e não recebem ABORT.
+			var stop error
+			for _, segment := range canonicalOrder(chosenRoute.Route) {
+				if stop == nil && ctx.Err() != nil {
+					stop = fmt.Errorf("PREPARE não enviado: %w", ctx.Err())
+				}
+				if stop != nil {
+					results <- prepareResult{city: segment.City, optional: segment.Optional, err: stop}
+					continue
+				}
+				result := prepareSegment(ctx, transactionID, chosenRoute, segment, protocol, priority)
+				if result.err != nil && !skippableFailure(ctx, result) {
+					stop = fmt.Errorf("PREPARE não enviado: %s votou NÃO", result.city)
+				}
+				results <- result
+			}
+		}()
+	} else {
+		for _, segment := range chosenRoute.Route {
+			go func(segment schemas.RouteSegment) {
+				results <- prepareSegment(ctx, transactionID, chosenRoute, segment, protocol, priority)
+			}(segment)
+		}
+	}
+
+	preparedParticipants := make(map[string]string)  // cidade -> endpoint do participante
+	contactedParticipants := make(map[string]string) // inclui PREPAREs que falharam, mas podem ter sido aplicados
+	skippedOptional := make(map[string]string)
+	var prepareErr error
+	received := 0
+	for received < len(chosenRoute.Route) {
+		result := <-results
+		received++
+		if result.endpoint != "" {
+			contactedParticipants[result.city] = result.endpoint
+		}
+		if skippableFailure(ctx, result) {
+			log.Printf("[%s] TX[%s]: FALHA PREPARE para segmento opcional %s: %v. Seguindo sem ele.", enterpriseName, transactionID, result.city, result.err)
+			if result.endpoint != "" {
+				logVote(transactionID, result, txlog.VoteNo)
+			}
+			skippedOptional[result.city] = result.err.Error()
+			continue
+		}
+		if result.err != nil {
+			log.Printf("[%s] TX[%s]: FALHA PREPARE para %s: %v. Cancelando PREPAREs pendentes.", enterpriseName, transactionID, result.city, result.err)
+			if result.endpoint != "" {
+				logVote(transactionID, result, txlog.VoteNo)
+			}
+			prepareErr = result.err
+			break
+		}
+		preparedParticipants[result.city] = result.endpoint
+		if !logVote(transactionID, result, txlog.VoteYes) {
+			prepareErr = fmt.Errorf("falha ao gravar voto de %s", result.city)
+			break
+		}
+	}
+	if prepareErr != nil {
+		// Aborto antecipado: não espera os PREPAREs restantes, que são cancelados e recebem ABORT ao terminar
+		cancel()
+		go abortLatePrepares(transactionID, results, len(chosenRoute.Route)-received)
+	}
+	if isWounded(transactionID) && !errors.Is(prepareErr, errTransactionRestart) {
+		prepareErr = fmt.Errorf("%w: ferida durante o PREPARE", errTransactionRestart)
+	}
+	if prepareErr == nil && len(preparedParticipants) == 0 {
+		prepareErr = fmt.Errorf("nenhum segmento da rota pôde ser reservado")
+	}
+	return preparedParticipants, contactedParticipants, skippedOptional, prepareErr
+}
+
+// skippableFailure indica se a falha do PREPARE é de um segmento opcional e a transação pode seguir
+// sem ele: não se o prazo global acabou ou a transação precisa recomeçar.
+func skippableFailure(ctx context.Context, result prepareResult) bool {
+	return result.err != nil && result.optional && !errors.Is(result.err, errTransactionRestart) && ctx.Err() == nil
+}
+
+// runPreCommitPhase envia PRE-COMMIT (3PC) a todos os participantes preparados, em paralelo e sob
+// o mesmo prazo global do PREPARE. Retorna true somente se todos confirmaram.
+func runPreCommitPhase(transactionID string, preparedParticipants map[string]string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), prepareTimeout)
+	defer cancel()
+
+	type preCommitResult struct {
+		city string
+		err  error
+	}
+	results := make(chan preCommitResult, len(preparedParticipants))
+	for city, endpoint := range preparedParticipants {
+		go func(city, endpoint string) {
+			p, err := participantAt(city, endpoint, protocol3PC)
+			if err == nil {
+				err = p.PreCommit(ctx, transactionID)
+			}
+			results <- preCommitResult{city: city, err: err}
+		}(city, endpoint)
+	}
+
+	allAcked := true
+	for range preparedParticipants {
+		result := <-results
+		if result.err != nil {
+			log.Printf("[%s] TX[%s]: FALHA PRE-COMMIT para %s: %v", enterpriseName, transactionID, result.city, result.err)
+			allAcked = false
+			continue
+		}
+		log.Printf("[%s] TX[%s]: SUCESSO PRE-COMMIT para %s", enterpriseName, transactionID, result.city)
+	}
+	return allAcked
+}
+
+// finishTransaction grava a decisão global e a entrega aos participantes, retornando a decisão
+// aplicada e o motivo do aborto. A decisão só é válida depois de gravada no log: se a gravação
+// do COMMIT falhar, ou a transação tiver sido ferida, ela é abortada.
+func finishTransaction(transactionID, decision string, preparedParticipants, contactedParticipants map[string]string, cause error) (string, error) {
+	defer forgetTransaction(transactionID)
+
+	record := txlog.Record{Type: txlog.RecordDecision, TransactionID: transactionID, Decision: decision}
+	if decision == txlog.DecisionCommit {
+		appended, err := appendUnlessWounded(record)
+		if !appended {
+			log.Printf("[%s] TX[%s]: Transação ferida antes da decisão. Forçando ABORT.", enterpriseName, transactionID)
+			decision, cause = txlog.DecisionAbort, fmt.Errorf("%w: ferida antes da decisão", errTransactionRestart)
+		} else if err != nil {
+			log.Printf("[%s] TX[%s]: Falha ao gravar decisão %s no log: %v. Forçando ABORT.", enterpriseName, transactionID, decision, err)
+			decision, cause = txlog.DecisionAbort, err
+		}
+	}
+	if decision == txlog.DecisionAbort {
+		record = txlog.Record{Type: txlog.RecordDecision, TransactionID: transactionID, Decision: decision}
+		if cause != nil {
+			record.Reason = cause.Error()
+		}
+		if err := txLog.Append(record); err != nil {
+			log.Printf("[%s] TX[%s]: Falha ao gravar decisão %s no log: %v. A recuperação assumirá ABORT.", enterpriseName, transactionID, decision, err)
+		}
+	}
+
+	// Fase de COMMIT ou ABORT
+	if decision == txlog.DecisionCommit {
+		log.Printf("[%s] TX[%s]: FASE DE PREPARAÇÃO GLOBAL SUCESSO. Iniciando COMMIT.", enterpriseName, transactionID)
+		for city, participantTypeOrURL := range preparedParticipants {
+			if err := deliverDecision(transactionID, city, participantTypeOrURL, decision); err != nil {
+				log.Printf("[%s] TX[%s]: ERRO ao agendar COMMIT para %s: %v. A decisão será reenviada na recuperação.", enterpriseName, transactionID, city, err)
+			}
+		}
+		// Segmentos opcionais que falharam, mas podem ter aplicado o PREPARE, recebem ABORT
+		for city, participantTypeOrURL := range contactedParticipants {
+			if _, prepared := preparedParticipants[city]; prepared {
+				continue
+			}
+			if err := deliverDecision(transactionID, city, participantTypeOrURL, txlog.DecisionAbort); err != nil {
+				log.Printf("[%s] TX[%s]: ERRO ao agendar ABORT para %s: %v.", enterpriseName, transactionID, city, err)
+			}
+		}
+		return decision, nil
+	}
+	log.Printf("[%s] TX[%s]: FASE DE PREPARAÇÃO GLOBAL FALHOU. Iniciando ABORT.", enterpriseName, transactionID)
+	for city, participantTypeOrURL := range contactedParticipants { // Abortar todos os que receberam PREPARE
+		if err := deliverDecision(transactionID, city, participantTypeOrURL, decision); err != nil {
+			log.Printf("[%s] TX[%s]: ERRO ao agendar ABORT para %s: %v.", enterpriseName, transactionID, city, err)
+		}
+	}
+	return decision, cause
+}
+
+// prepareResult é o voto de um participante na fase de PREPARE.
+type prepareResult struct {
+	city     string
+	endpoint string                 // "local" ou URL da API remota; vazio se o participante nem chegou a ser contatado
+	optional bool                   // Segmento opcional: um voto NÃO não aborta a transação
+	alloc    participant.Allocation // Posto e janela pré-alocados, no voto SIM
+	err      error                  // nil significa voto SIM
+}
+
+// prepareSegment prepara um segmento da rota no participante responsável pela cidade,
+// respeitando o prazo e o cancelamento do contexto da transação.
+func prepareSegment(ctx context.Context, transactionID string, chosenRoute schemas.ChosenRouteMsg, segment schemas.RouteSegment, protocol string, priority time.Time) prepareResult {
+	result := prepareSegmentVote(ctx, transactionID, chosenRoute, segment, protocol, priority)
+	result.optional = segment.Optional
+	return result
+}
+
+func prepareSegmentVote(ctx context.Context, transactionID string, chosenRoute schemas.ChosenRouteMsg, segment schemas.RouteSegment, protocol string, priority time.Time) prepareResult {
+	cityToReserve := segment.City
+	prepareReq := schemas.RemotePrepareRequest{
+		TransactionID:         transactionID,
+		VehicleID:             chosenRoute.VehicleID,
+		RequestID:             chosenRoute.RequestID,
+		City:                  cityToReserve, // Importante: enviar a cidade correta
+		ReservationWindow:     segment.ReservationWindow,
+		CoordinatorURL:        selfAPIURL,
+		ParticipantCities:     requiredCities(chosenRoute.Route),
+		Protocol:              protocol,
+		PriorityUTC:           priority,
+		Optional:              segment.Optional,
+		ChargingPointID:       segment.ChargingPointID,
+		Charge:                segment.Charge,
+		ReplacesTransactionID: chosenRoute.Replaces,
+	}
+
+	p, err := participantFor(cityToReserve, protocol)
+	if err != nil {
+		return prepareResult{city: cityToReserve, err: err}
+	}
+	if err := ctx.Err(); err != nil {
+		return prepareResult{city: cityToReserve, err: err}
+	}
+	log.Printf("[%s] TX[%s]: Iniciando PREPARE para %s em %s (participante: %s)", enterpriseName, transactionID, chosenRoute.VehicleID, cityToReserve, p.Endpoint())
+	wounded := make(map[string]bool)
+	for {
+		started := time.Now()
+		prepared, err := p.Prepare(ctx, prepareReq)
+		if err == nil {
+			log.Printf("[%s] TX[%s]: SUCESSO PREPARE para %s em %s (posto %s, concessão até %s)", enterpriseName, transactionID, cityToReserve, time.Since(started), prepared.ChargingPointID, prepared.Until.Format(schemas.ISOFormat))
+			return prepareResult{city: cityToReserve, endpoint: p.Endpoint(), alloc: prepared.Allocation}
+		}
+		var conflict *state.ConflictError
+		if conflictPolicy == conflictPolicyNone || !errors.As(err, &conflict) {
+			return prepareResult{city: cityToReserve, endpoint: p.Endpoint(), err: err}
+		}
+		// Posto ocupado apenas por reservas ainda não decididas: esperar, morrer ou ferir
+		if err := resolveConflict(ctx, transactionID, priority, conflict, wounded); err != nil {
+			return prepareResult{city: cityToReserve, endpoint: p.Endpoint(), err: err}
+		}
+	}
+}
+
+// requiredCities retorna as cidades dos segmentos obrigatórios da rota. Só elas servem de referência
+// na terminação cooperativa: o resultado de um segmento opcional não diz nada sobre os demais.
+func requiredCities(route []schemas.RouteSegment) []string {
+	var required []schemas.RouteSegment
+	for _, segment := range route {
+		if !segment.Optional {
+			required = append(required, segment)
+		}
+	}
+	return txlog.RouteCities(required)
+}
+
+// abortLatePrepares aguarda os PREPAREs que ainda estavam em andamento quando a transação foi
+// abortada e envia ABORT aos participantes que chegaram a ser contatados.
+func abortLatePrepares(transactionID string, results <-chan prepareResult, pending int) {
+	for i := 0; i < pending; i++ {
+		result := <-results
+		if result.endpoint == "" {
+			continue
+		}
+		if err := deliverDecision(transactionID, result.city, result.endpoint, txlog.DecisionAbort); err != nil {
+			log.Printf("[%s] TX[%s]: ERRO ao agendar ABORT tardio para %s: %v.", enterpriseName, transactionID, result.city, err)
+		}
+	}
+}
+
+// logVote grava o voto de um participante. Retorna false se o registro não pôde ser gravado.
+func logVote(transactionID string, result prepareResult, vote string) bool {
+	record := txlog.Record{Type: txlog.RecordVote, TransactionID: transactionID, City: result.city, Endpoint: result.endpoint, Vote: vote, ChargingPointID: result.alloc.ChargingPointID, ReservationWindow: result.alloc.Window}
+	if result.err != nil {
+		record.Reason = result.err.Error()
+	}
+	if err := txLog.Append(record); err != nil {
+		log.Printf("[%s] TX[%s]: Falha ao gravar voto %s de %s no log: %v", enterpriseName, transactionID, vote, result.city, err)
+		return false
+	}
+	return true
+}
+
+// deliverDecision aplica a decisão global em um participante. A decisão local é aplicada na hora;
+// a remota é enfileirada na fila de entregas, que a reenvia até o participante confirmar.
+// O ACK é gravado no log de decisões quando a confirmação chega.
+func deliverDecision(transactionID, city, endpoint, decision string) error {
+	if endpoint != txlog.EndpointLocal {
+		log.Printf("[%s] TX[%s]: Enfileirando %s REMOTO para %s (API: %s)", enterpriseName, transactionID, decision, city, endpoint)
+		return deliveryQueue.Enqueue(transactionID, city, endpoint, decision)
+	}
+	var outcome string
+	if decision == txlog.DecisionCommit {
+		outcome = stateMgr.CommitReservation(transactionID)
+		if outcome != schemas.StatusReservationCommitted && outcome != schemas.StatusHeuristicMixed {
+			log.Printf("[%s] TX[%s]: ERRO - COMMIT LOCAL não aplicado em %s; transação %s nesta cidade. ACK não registrado.", enterpriseName, transactionID, city, outcome)
+			return fmt.Errorf("COMMIT local não aplicado: transação %s", outcome)
+		}
+	} else {
+		outcome = stateMgr.AbortReservation(transactionID)
+		if outcome != schemas.StatusAborted && outcome != schemas.StatusHeuristicMixed {
+			log.Printf("[%s] TX[%s]: CONFLITO - ABORT LOCAL em %s, mas a transação já está %s nesta cidade.", enterpriseName, transactionID, city, outcome)
+		}
+	}
+	if outcome == schemas.StatusHeuristicMixed {
+		if err := logHeuristicMixed(transactionID, city, decision); err != nil {
+			log.Printf("[%s] TX[%s]: Falha ao gravar HEURISTIC_MIXED de %s no log: %v", enterpriseName, transactionID, city, err)
+		}
+	}
+	log.Printf("[%s] TX[%s]: %s LOCAL para %s", enterpriseName, transactionID, decision, city)
+	logAck(transactionID, city, endpoint)
+	return nil
+}
+
+// logAck grava no log de decisões que o participante confirmou a decisão global.
+func logAck(transactionID, city, endpoint string) {
+	if err := txLog.Append(txlog.Record{Type: txlog.RecordAck, TransactionID: transactionID, City: city, Endpoint: endpoint}); err != nil {
+		log.Printf("[%s] TX[%s]: Falha ao gravar ACK de %s no log: %v", enterpriseName, transactionID, city, err)
+	}
+}
+
+// logHeuristicMixed grava no log de decisões que a cidade confirmou a decisão global, mas já tinha
+// aplicado a decisão heurística contrária.
+func logHeuristicMixed(transactionID, city, decision string) error {
+	log.Printf("[%s] TX[%s]: HEURISTIC MIXED - %s confirmou %s, mas um operador tinha forçado a decisão contrária.", enterpriseName, transactionID, city, decision)
+	return txLog.Append(txlog.Record{Type: txlog.RecordMixed, TransactionID: transactionID, City: city, Decision: decision})
+}
+
+// sendDeliveryItem é usado pela fila de entregas para enviar um comando a um participante.
+// Uma confirmação HEURISTIC_MIXED é gravada no log e conta como entregue.
+func sendDeliveryItem(item delivery.Item) error {
+	if item.Action == actionDisplaced {
+		return reportDisplacement(item.Endpoint, item.TransactionID, item.City)
+	}
+	p, err := participantAt(item.City, item.Endpoint, txLog.Protocol(item.TransactionID))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), decisionTimeout)
+	defer cancel()
+	switch item.Action {
+	case actionCompensate, actionCancel:
+		return p.Cancel(ctx, item.TransactionID)
+	case txlog.DecisionCommit:
+		err = p.Commit(ctx, item.TransactionID)
+	default:
+		err = p.Abort(ctx, item.TransactionID)
+	}
+	switch {
+	case errors.Is(err, participant.ErrHeuristicMixed):
+		return logHeuristicMixed(item.TransactionID, item.City, item.Action)
+	case errors.Is(err, participant.ErrAbortConflict):
+		// Reenviar não muda o resultado da cidade: a entrega é confirmada e o conflito fica no log
+		log.Printf("[%s] TX[%s]: CONFLITO - %s: %v", enterpriseName, item.TransactionID, item.City, err)
+		return nil
+	}
+	return err
+}
+
+// onDeliveryAck registra a confirmação de um item da fila de entregas: no log de decisões,
+// para COMMIT/ABORT e cancelamentos, ou na saga, para compensações. O aviso de vaga perdida fica
+// registrado na coordenadora.
+func onDeliveryAck(item delivery.Item) {
+	switch item.Action {
+	case actionDisplaced:
+		log.Printf("[%s] TX[%s]: Coordenadora avisada da vaga perdida em %s.", enterpriseName, item.TransactionID, item.City)
+	case actionCompensate:
+		markStepCompensated(item.TransactionID, item.City)
+	case actionCancel:
+		logCancelAck(item.TransactionID, item.City, item.Endpoint)
+	default:
+		logAck(item.TransactionID, item.City, item.Endpoint)
+	}
+}
+
+// recoverTransactions relê o log de decisões e leva cada transação interrompida até o fim:
+// sem decisão gravada, a transação é abortada (abort presumido); com decisão, ela é reenviada
+// pela fila de entregas aos participantes que ainda não confirmaram.
+func recoverTransactions() {
+	transactions, err := txLog.Replay()
+	if err != nil {
+		log.Printf("[%s] Falha no replay do log de transações: %v", enterpriseName, err)
+		return
+	}
+	recoverCancellations(transactions)
+	for _, tx := range transactions {
+		if tx.Completed() || len(tx.Route) == 0 || !isAtomicCommit(tx.Protocol) {
+			continue
+		}
+		decided := tx.Decision != ""
+		if !decided {
+			// No 3PC, se o PRE-COMMIT começou todos votaram SIM e os participantes efetivam
+			// sozinhos por tempo esgotado; a recuperação segue a mesma decisão.
+			decision := txlog.DecisionAbort
+			if tx.Protocol == protocol3PC && tx.PreCommitted {
+				decision = txlog.DecisionCommit
+			}
+			log.Printf("[%s] TX[%s]: Transação interrompida sem decisão. Decidindo %s na recuperação.", enterpriseName, tx.ID, decision)
+			if err := txLog.Append(txlog.Record{Type: txlog.RecordDecision, TransactionID: tx.ID, Decision: decision, Reason: "decidida na recuperação do coordenador"}); err != nil {
+				log.Printf("[%s] TX[%s]: Falha ao gravar decisão de recuperação: %v", enterpriseName, tx.ID, err)
+				continue
+			}
+			tx.Decision = decision
+		} else {
+			log.Printf("[%s] TX[%s]: Transação interrompida com decisão %s. Reenviando aos participantes pendentes.", enterpriseName, tx.ID, tx.Decision)
+		}
+		go completeRecoveredTransaction(tx, !decided)
+	}
+}
+
+// completeRecoveredTransaction localiza os participantes pendentes de uma transação recuperada
+// e entrega a decisão a eles. O veículo é avisado quando a decisão foi tomada na recuperação,
+// já que o resultado anterior nunca chegou a ser publicado.
+func completeRecoveredTransaction(tx *txlog.Transaction, decidedOnRecovery bool) {
+	pending := tx.PendingCities()
+	for len(pending) > 0 {
+		var unresolved []string
+		for _, city := range pending {
+			endpoint, err := resolveParticipantEndpoint(tx, city)
+			if err != nil {
+				log.Printf("[%s] TX[%s]: Recuperação - não foi possível localizar %s: %v", enterpriseName, tx.ID, city, err)
+				unresolved = append(unresolved, city)
+				continue
+			}
+			if err := deliverDecision(tx.ID, city, endpoint, tx.Decision); err != nil {
+				log.Printf("[%s] TX[%s]: Recuperação - falha ao agendar %s para %s: %v", enterpriseName, tx.ID, tx.Decision, city, err)
+				unresolved = append(unresolved, city)
+			}
+		}
+		pending = unresolved
+		if len(pending) > 0 {
+			time.Sleep(recoveryRetryInterval)
+		}
+	}
+
+	if decidedOnRecovery {
+		chosenRoute := schemas.ChosenRouteMsg{RequestID: tx.RequestID, VehicleID: tx.VehicleID}
+		for _, segment := range tx.Route {
+			if p, ok := tx.Participants[segment.City]; ok {
+				segment = allocatedSegment(segment, p.Allocation)
+			}
+			chosenRoute.Route = append(chosenRoute.Route, segment)
+		}
+		switch {
+		case tx.Replaces != "" && tx.Decision == txlog.DecisionCommit:
+			publishReservationStatus(tx.VehicleID, tx.ID, "CONFIRMED", "Reserva remarcada após recuperação do coordenador", &chosenRoute, enterpriseName)
+		case tx.Replaces != "":
+			publishRescheduleRejected(tx.ID, chosenRoute, "Remarcação interrompida por falha do coordenador e abortada")
+		case tx.Decision == txlog.DecisionCommit:
+			publishReservationStatus(tx.VehicleID, tx.ID, "CONFIRMED", "Reserva confirmada após recuperação do coordenador", &chosenRoute, enterpriseName)
+		default:
+			publishReservationStatus(tx.VehicleID, tx.ID, "REJECTED", "Transação interrompida por falha do coordenador e abortada", &chosenRoute, enterpriseName)
+		}
+	}
+	log.Printf("[%s] TX[%s]: Recuperação agendada com decisão %s.", enterpriseName, tx.ID, tx.Decision)
+}
+
+// compactTransactionLog descarta do log de decisões as transações encerradas há mais de
+// txLogRetention, com os RequestIDs que só levavam a elas.
+func compactTransactionLog() {
+	if _, err := txLog.Compact(time.Now().UTC().Add(-txLogRetention), transactionFinished); err != nil {
+		log.Printf("[%s] Falha ao compactar o log de transações: %v", enterpriseName, err)
+	}
+}
+
+// transactionFinished indica se o log não precisa mais da transação: todos os participantes
+// confirmaram a decisão e os cancelamentos (2PC/3PC), ou a saga terminou, e uma rota efetivada e não
+// cancelada já acabou (até lá o veículo pode cancelá-la ou remarcá-la). Registros avulsos, sem
+// BEGIN, não são usados por ninguém.
+func transactionFinished(tx *txlog.Transaction) bool {
+	if len(tx.Route) == 0 {
+		return true
+	}
+	reserved := make(map[string]txlog.Allocation)
+	if !isAtomicCommit(tx.Protocol) {
+		sg, ok := sagaStore.Get(tx.ID)
+		if !ok {
+			return true
+		}
+		if sg.Status != saga.StatusCompleted {
+			return sg.Status == saga.StatusCompensated
+		}
+		for _, step := range sg.Steps {
+			if step.Status == saga.StepReserved {
+				reserved[step.City] = txlog.Allocation{}
+			}
+		}
+		return routeFinished(tx.Route, reserved)
+	}
+	if !tx.Completed() || len(tx.PendingCancellations()) > 0 {
+		return false
+	}
+	if tx.Decision == txlog.DecisionCommit && !tx.Cancelled {
+		for city, p := range tx.Participants {
+			if p.Vote == txlog.VoteYes {
+				reserved[city] = p.Allocation
+			}
+		}
+	}
+	return routeFinished(tx.Route, reserved)
+}
+
+// resolveParticipantEndpoint retorna o endpoint conhecido do participante ou o localiza de novo.
+func resolveParticipantEndpoint(tx *txlog.Transaction, city string) (string, error) {
+	if p, ok := tx.Participants[city]; ok && p.Endpoint != "" {
+		return p.Endpoint, nil
+	}
+	p, err := participantFor(city, tx.Protocol)
+	if err != nil {
+		return "", err
+	}
+	return p.Endpoint(), nil
+}
+
+// coordinatorDecision responde, a partir do log de decisões, o que aconteceu com uma transação
+// coordenada por esta API, do ponto de vista da cidade informada (um COMMIT não vale para um
+// segmento opcional que falhou). Transações desconhecidas seguem a regra do abort presumido.
+func coordinatorDecision(transactionID, city string) string {
+	decision, known := txLog.DecisionFor(transactionID, city)
+	switch {
+	case !known:
+		return schemas.StatusUnknown
+	case decision == "":
+		return schemas.StatusPending
+	default:
+		return decision
+	}
+}
+
+// acceptChosenRoute decide se uma rota escolhida deve iniciar uma nova transação. Rotas para um
+// RequestID não emitido por esta empresa (ou emitido para outro veículo) são rejeitadas; entregas
+// repetidas de um RequestID já processado recebem de novo o status original.
+func acceptChosenRoute(chosenRoute schemas.ChosenRouteMsg) bool {
+	info, issued := txLog.Request(chosenRoute.RequestID)
+	if !issued || info.VehicleID != chosenRoute.VehicleID {
+		log.Printf("[%s] RequestID %s não foi emitido por esta empresa para VehicleID %s. Rota escolhida rejeitada.", enterpriseName, chosenRoute.RequestID, chosenRoute.VehicleID)
+		publishReservationStatus(chosenRoute.VehicleID, "", "REJECTED", "RequestID desconhecido: solicite as opções de rota a esta empresa", nil, enterpriseName)
+		return false
+	}
+	if info.TransactionID == "" {
+		return true
+	}
+	if info.Status == nil {
+		log.Printf("[%s] TX[%s]: Rota escolhida duplicada para RequestID %s com transação em andamento. Ignorada.", enterpriseName, info.TransactionID, chosenRoute.RequestID)
+		return false
+	}
+	log.Printf("[%s] TX[%s]: Rota escolhida duplicada para RequestID %s. Reenviando status original '%s'.", enterpriseName, info.TransactionID, chosenRoute.RequestID, info.Status.Status)
+	republishReservationStatus(*info.Status)
+	return false
+}
+
+// republishReservationStatus publica novamente, sem alterações, um status já enviado ao veículo.
+func republishReservationStatus(status schemas.ReservationStatus) {
+	topic := fmt.Sprintf("car/reservation/status/%s", status.VehicleID)
+	payloadBytes, _ := json.Marshal(status)
+	mqtt.Publish(topic, string(payloadBytes))
+}
@@ -0,0 +1,270 @@
+// PBL-2/api/delivery/queue.go
+package delivery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/durable"
+)
+
+// Limites do backoff exponencial entre tentativas de entrega.
+const (
+	DefaultBaseBackoff = 1 * time.Second
+	DefaultMaxBackoff  = 2 * time.Minute
+)
+
+// Item é um comando (ex: COMMIT ou ABORT) que precisa ser confirmado por um participante.
+type Item struct {
+	ID             string    `json:"id"`
+	TransactionID  string    `json:"transaction_id"`
+	City           string    `json:"city"`
+	Endpoint       string    `json:"endpoint"` // URL base da API do participante
+	Action         string    `json:"action"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAtUTC   time.Time `json:"created_at_utc"`
+	NextAttemptUTC time.Time `json:"next_attempt_utc"`
+}
+
+// SendFunc entrega um item ao participante; nil significa que o participante confirmou.
+type SendFunc func(item Item) error
+
+// AckFunc é chamada depois que um item é confirmado e removido da fila.
+type AckFunc func(item Item)
+
+// Queue é uma fila de entregas persistida em disco, reenviando cada item com backoff
+// exponencial até que o participante confirme. Cada endpoint tem seu próprio worker, para que um
+// participante fora do ar não atrase as entregas aos demais.
+type Queue struct {
+	path        string
+	items       map[string]*Item
+	busy        map[string]bool // Endpoints com um worker enviando itens
+	mux         sync.Mutex
+	send        SendFunc
+	onAck       AckFunc
+	wake        chan struct{}
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+}
+
+// Open carrega a fila persistida no caminho informado (ou cria uma vazia).
+func Open(path string, send SendFunc, onAck AckFunc) (*Queue, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("falha ao criar diretório da fila de entregas: %w", err)
+	}
+	q := &Queue{
+		path:        path,
+		items:       make(map[string]*Item),
+		busy:        make(map[string]bool),
+		send:        send,
+		onAck:       onAck,
+		wake:        make(chan struct{}, 1),
+		baseBackoff: DefaultBaseBackoff,
+		maxBackoff:  DefaultMaxBackoff,
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("falha ao ler fila de entregas %s: %w", path, err)
+	}
+	if len(data) > 0 {
+		var items []*Item
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, fmt.Errorf("fila de entregas %s corrompida: %w", path, err)
+		}
+		for _, item := range items {
+			q.items[item.ID] = item
+		}
+	}
+	log.Printf("[DeliveryQueue] Fila de entregas aberta em %s (%d itens pendentes)", path, len(q.items))
+	return q, nil
+}
+
+// Enqueue agenda a entrega de uma ação para o participante, com primeira tentativa imediata.
+// Enfileirar de novo a mesma ação para a mesma transação e cidade não cria um item duplicado.
+func (q *Queue) Enqueue(transactionID, city, endpoint, action string) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	id := fmt.Sprintf("%s/%s/%s", transactionID, city, action)
+	if _, exists := q.items[id]; exists {
+		return nil
+	}
+	now := time.Now().UTC()
+	q.items[id] = &Item{
+		ID:             id,
+		TransactionID:  transactionID,
+		City:           city,
+		Endpoint:       endpoint,
+		Action:         action,
+		CreatedAtUTC:   now,
+		NextAttemptUTC: now,
+	}
+	if err := q.persistLocked(); err != nil {
+		delete(q.items, id)
+		return err
+	}
+	q.signal()
+	return nil
+}
+
+// Pending retorna uma cópia dos itens ainda não confirmados, do mais antigo para o mais novo.
+func (q *Queue) Pending() []Item {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	pending := make([]Item, 0, len(q.items))
+	for _, item := range q.items {
+		pending = append(pending, *item)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].CreatedAtUTC.Before(pending[j].CreatedAtUTC) })
+	return pending
+}
+
+// Run processa a fila até o canal stop ser fechado. Deve ser executada em uma goroutine.
+func (q *Queue) Run(stop <-chan struct{}) {
+	for {
+		for endpoint, items := range q.claimDue() {
+			go q.work(endpoint, items)
+		}
+
+		wait := q.nextWait()
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-q.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// work envia, em ordem, os itens vencidos de um endpoint e depois libera o endpoint.
+func (q *Queue) work(endpoint string, items []Item) {
+	for _, item := range items {
+		q.attempt(item)
+	}
+	q.mux.Lock()
+	delete(q.busy, endpoint)
+	q.mux.Unlock()
+	q.signal() // Itens do endpoint que venceram durante o envio
+}
+
+func (q *Queue) attempt(item Item) {
+	err := q.send(item)
+
+	q.mux.Lock()
+	current, ok := q.items[item.ID]
+	if !ok {
+		q.mux.Unlock()
+		return
+	}
+	if err == nil {
+		delete(q.items, item.ID)
+		if perr := q.persistLocked(); perr != nil {
+			log.Printf("[DeliveryQueue] AVISO: falha ao persistir fila após confirmação de %s: %v", item.ID, perr)
+		}
+		q.mux.Unlock()
+		log.Printf("[DeliveryQueue] TX[%s]: %s confirmado por %s após %d tentativa(s).", item.TransactionID, item.Action, item.City, item.Attempts+1)
+		if q.onAck != nil {
+			q.onAck(item)
+		}
+		return
+	}
+
+	current.Attempts++
+	current.LastError = err.Error()
+	current.NextAttemptUTC = time.Now().UTC().Add(q.backoff(current.Attempts))
+	if perr := q.persistLocked(); perr != nil {
+		log.Printf("[DeliveryQueue] AVISO: falha ao persistir fila após erro de %s: %v", item.ID, perr)
+	}
+	next := current.NextAttemptUTC
+	attempts := current.Attempts
+	q.mux.Unlock()
+	log.Printf("[DeliveryQueue] TX[%s]: Falha ao entregar %s para %s (tentativa %d): %v. Nova tentativa às %s.", item.TransactionID, item.Action, item.City, attempts, err, next.Format(time.RFC3339))
+}
+
+// backoff retorna o intervalo até a próxima tentativa: base * 2^(tentativas-1), limitado ao máximo.
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.baseBackoff
+	for i := 1; i < attempts && delay < q.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.maxBackoff {
+		delay = q.maxBackoff
+	}
+	return delay
+}
+
+// claimDue agrupa por endpoint os itens vencidos, do mais antigo para o mais novo, e marca esses
+// endpoints como ocupados. Endpoints que já têm um worker ficam para quando ele terminar.
+func (q *Queue) claimDue() map[string][]Item {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	now := time.Now().UTC()
+	due := make(map[string][]Item)
+	for _, item := range q.items {
+		if !q.busy[item.Endpoint] && !item.NextAttemptUTC.After(now) {
+			due[item.Endpoint] = append(due[item.Endpoint], *item)
+		}
+	}
+	for endpoint, items := range due {
+		sort.Slice(items, func(i, j int) bool { return items[i].CreatedAtUTC.Before(items[j].CreatedAtUTC) })
+		q.busy[endpoint] = true
+	}
+	return due
+}
+
+func (q *Queue) nextWait() time.Duration {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	wait := q.maxBackoff
+	now := time.Now().UTC()
+	for _, item := range q.items {
+		if q.busy[item.Endpoint] {
+			continue // O worker do endpoint acorda a fila ao terminar
+		}
+		if d := item.NextAttemptUTC.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// persistLocked grava a fila inteira no arquivo, de forma atômica e sincronizada em disco, para que
+// uma queda nunca deixe a fila pela metade nem desfaça uma confirmação. Requer q.mux travado.
+func (q *Queue) persistLocked() error {
+	items := make([]*Item, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, item)
+	}
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return fmt.Errorf("falha ao serializar fila de entregas: %w", err)
+	}
+	if err := durable.WriteFile(q.path, data); err != nil {
+		return fmt.Errorf("falha ao persistir fila de entregas: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// PBL-2/api/durable/durable.go
+package durable
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile substitui o arquivo em path por data de forma atômica (ver Replace).
+func WriteFile(path string, data []byte) error {
+	return Replace(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Replace grava o conteúdo produzido por write em um arquivo temporário, força a escrita em disco,
+// o renomeia sobre path e sincroniza o diretório, para que uma queda deixe no caminho o arquivo
+// antigo ou o novo inteiro, e nunca desfaça a troca depois de Replace retornar.
+func Replace(path string, write func(w io.Writer) error) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("falha ao criar %s: %w", tmpPath, err)
+	}
+	writer := bufio.NewWriter(file)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("falha ao gravar %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("falha ao substituir %s: %w", path, err)
+	}
+	return SyncDir(filepath.Dir(path))
+}
+
+// SyncDir força a escrita em disco das entradas do diretório, como a de um arquivo recém-renomeado.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("falha ao abrir diretório %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("falha ao sincronizar diretório %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// Escolha do coordenador de uma rota escolhida, selecionada com COORDINATOR_SELECTION.
+const (
+	coordinatorSelf         = "self"          // A empresa que recebeu a rota do carro coordena
+	coordinatorFirstSegment = "first-segment" // Coordena a empresa dona da cidade do primeiro segmento
+)
+
+var coordinatorSelection = coordinatorSelf
+
+// forwardedRouteEnqueueTimeout limita a espera por espaço na fila de rotas escolhidas.
+const forwardedRouteEnqueueTimeout = 2 * time.Second
+
+var (
+	// chosenRoutes é a fila de rotas escolhidas processada em sequência pela goroutine principal.
+	// As rotas delegadas entram nela como as recebidas por MQTT, para que o BEGIN de uma seja
+	// gravado antes de uma entrega repetida ser avaliada.
+	chosenRoutes chan string
+
+	// forwardedRequestsMux torna atômico o registro do RequestID de uma rota delegada.
+	forwardedRequestsMux sync.Mutex
+)
+
+// forwardChosenRoute delega a coordenação da rota à empresa dona da cidade do primeiro segmento.
+// Retorna false quando esta API deve coordenar: modo self, primeiro segmento nesta cidade ou
+// falha ao delegar (a rota não fica sem coordenador).
+func forwardChosenRoute(chosenRoute schemas.ChosenRouteMsg) bool {
+	if coordinatorSelection != coordinatorFirstSegment {
+		return false
+	}
+	firstCity := chosenRoute.Route[0].City
+	if firstCity == ownedCity {
+		return false
+	}
+	if _, ok := inProcessCities[firstCity]; ok {
+		return false // Cidade hospedada aqui: a decisão já está junto dos dados
+	}
+	discovered, err := registryClient.DiscoverService(firstCity)
+	if err != nil || !discovered.Found || discovered.ApiURL == selfAPIURL {
+		log.Printf("[%s] Não foi possível delegar a rota de %s à dona de %s (%v). Coordenando aqui.", enterpriseName, chosenRoute.VehicleID, firstCity, err)
+		return false
+	}
+
+	chosenRoute.ForwardedBy = enterpriseName
+	chosenRoute.ForwarderCity = ownedCity
+	payloadBytes, _ := json.Marshal(chosenRoute)
+	resp, err := decisionHTTPClient.Post(discovered.ApiURL+"/2pc_coordinator/routes", "application/json", bytes.NewBuffer(payloadBytes))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Printf("[%s] Falha ao delegar a rota de %s a %s (%s): %v. Coordenando aqui.", enterpriseName, chosenRoute.VehicleID, discovered.EnterpriseName, discovered.ApiURL, err)
+		return false
+	}
+	log.Printf("[%s] Rota do RequestID %s (VehicleID %s) delegada a %s, dona de %s.", enterpriseName, chosenRoute.RequestID, chosenRoute.VehicleID, discovered.EnterpriseName, firstCity)
+	return true
+}
+
+// handleForwardedRoute recebe uma rota escolhida delegada por outra empresa. O RequestID é confirmado
+// com a empresa que o emitiu, descoberta pelo Registry a partir da cidade dela, e registrado aqui
+// para que entregas repetidas recebam o status original. A rota entra na fila de rotas escolhidas,
+// processada em sequência; o status final é publicado direto para o veículo.
+func handleForwardedRoute(c *gin.Context) {
+	var chosenRoute schemas.ChosenRouteMsg
+	if err := c.ShouldBindJSON(&chosenRoute); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	if chosenRoute.VehicleID == "" || chosenRoute.RequestID == "" || len(chosenRoute.Route) == 0 {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "VehicleID, RequestID e rota são obrigatórios"})
+		return
+	}
+	if err := verifyForwardedRequest(chosenRoute); err != nil {
+		log.Printf("[%s] Rota do RequestID %s (VehicleID %s) delegada por %s recusada: %v", enterpriseName, chosenRoute.RequestID, chosenRoute.VehicleID, chosenRoute.ForwardedBy, err)
+		c.JSON(http.StatusForbidden, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "RequestID não confirmado pela empresa que delegou: " + err.Error()})
+		return
+	}
+
+	forwardedRequestsMux.Lock()
+	_, issued := txLog.Request(chosenRoute.RequestID)
+	var err error
+	if !issued {
+		err = txLog.IssueRequest(chosenRoute.RequestID, chosenRoute.VehicleID)
+	}
+	forwardedRequestsMux.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Falha ao registrar RequestID: " + err.Error()})
+		return
+	}
+
+	payloadBytes, _ := json.Marshal(chosenRoute)
+	select {
+	case chosenRoutes <- string(payloadBytes):
+	case <-time.After(forwardedRouteEnqueueTimeout):
+		c.JSON(http.StatusServiceUnavailable, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Fila de rotas escolhidas cheia"})
+		return
+	}
+	log.Printf("[%s] Rota do RequestID %s (VehicleID %s) delegada por %s enfileirada.", enterpriseName, chosenRoute.RequestID, chosenRoute.VehicleID, chosenRoute.ForwardedBy)
+	c.JSON(http.StatusAccepted, gin.H{"status": schemas.StatusAccepted, "request_id": chosenRoute.RequestID})
+}
+
+// verifyForwardedRequest pergunta à empresa que delegou a rota se ela emitiu o RequestID para o
+// veículo. A URL dela vem do Registry, e não da requisição, e o nome precisa ser o informado.
+func verifyForwardedRequest(chosenRoute schemas.ChosenRouteMsg) error {
+	if chosenRoute.ForwardedBy == "" || chosenRoute.ForwarderCity == "" {
+		return errors.New("empresa e cidade de origem ausentes")
+	}
+	discovered, err := registryClient.DiscoverService(chosenRoute.ForwarderCity)
+	if err != nil {
+		return fmt.Errorf("falha ao localizar a dona de %s: %w", chosenRoute.ForwarderCity, err)
+	}
+	if !discovered.Found || discovered.EnterpriseName != chosenRoute.ForwardedBy {
+		return fmt.Errorf("%s não é a empresa registrada para %s", chosenRoute.ForwardedBy, chosenRoute.ForwarderCity)
+	}
+	requestURL := fmt.Sprintf("%s/2pc_coordinator/requests/%s?vehicle_id=%s", discovered.ApiURL, url.PathEscape(chosenRoute.RequestID), url.QueryEscape(chosenRoute.VehicleID))
+	resp, err := decisionQueryClient.Get(requestURL)
+	if err != nil {
+		return fmt.Errorf("falha ao consultar %s: %w", chosenRoute.ForwardedBy, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s não emitiu o RequestID para o veículo (status %s)", chosenRoute.ForwardedBy, resp.Status)
+	}
+	return nil
+}
+
+// handleIssuedRequest confirma a outra empresa que esta API emitiu o RequestID para o veículo
+// (query "vehicle_id"). Responde 404 se não emitiu.
+func handleIssuedRequest(c *gin.Context) {
+	requestID := c.Param("id")
+	info, issued := txLog.Request(requestID)
+	if !issued || info.VehicleID != c.Query("vehicle_id") {
+		c.JSON(http.StatusNotFound, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "RequestID não emitido para este veículo: " + requestID})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ISSUED", "request_id": requestID})
+}
@@ -0,0 +1,176 @@
+// PBL-2/api/heuristic/store.go
+package heuristic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/durable"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Estados de uma decisão heurística.
+const (
+	StatusHeuristic = "HEURISTIC"                  // Decisão aplicada pelo operador; o coordenador ainda não se manifestou
+	StatusConfirmed = "HEURISTIC_CONFIRMED"        // O coordenador decidiu o mesmo que a decisão heurística
+	StatusMixed     = schemas.StatusHeuristicMixed // O coordenador decidiu o contrário da decisão heurística
+)
+
+// MaxDecisions limita as decisões guardadas. Acima dele, as confirmadas pelo coordenador mais
+// antigas são descartadas. As que aguardam o coordenador e as HEURISTIC_MIXED, que o operador
+// precisa corrigir, nunca são descartadas, mesmo que o limite seja ultrapassado.
+const MaxDecisions = 500
+
+// Decision é uma decisão heurística tomada por um operador para uma transação em uma cidade.
+type Decision struct {
+	TransactionID       string     `json:"transaction_id"`
+	City                string     `json:"city"`
+	Decision            string     `json:"decision"` // COMMIT ou ABORT
+	Reason              string     `json:"reason,omitempty"`
+	Status              string     `json:"status"`
+	CoordinatorDecision string     `json:"coordinator_decision,omitempty"`
+	DecidedAtUTC        time.Time  `json:"decided_at_utc"`
+	ConfirmedAtUTC      *time.Time `json:"confirmed_at_utc,omitempty"`
+	MixedAtUTC          *time.Time `json:"mixed_at_utc,omitempty"`
+}
+
+// Store guarda as decisões heurísticas desta API em um arquivo JSON.
+type Store struct {
+	path      string
+	decisions map[string]*Decision // Chave: TransactionID/cidade
+	mux       sync.Mutex
+}
+
+func key(transactionID, city string) string {
+	return transactionID + "/" + city
+}
+
+// Open carrega as decisões persistidas no caminho informado (ou cria um armazenamento vazio).
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("falha ao criar diretório das decisões heurísticas: %w", err)
+	}
+	st := &Store{path: path, decisions: make(map[string]*Decision)}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("falha ao ler decisões heurísticas de %s: %w", path, err)
+	}
+	if len(data) > 0 {
+		var decisions []*Decision
+		if err := json.Unmarshal(data, &decisions); err != nil {
+			return nil, fmt.Errorf("arquivo de decisões heurísticas %s corrompido: %w", path, err)
+		}
+		for _, d := range decisions {
+			st.decisions[key(d.TransactionID, d.City)] = d
+		}
+	}
+	log.Printf("[HeuristicStore] Decisões heurísticas carregadas de %s (%d decisões)", path, len(st.decisions))
+	return st, nil
+}
+
+// Add registra uma nova decisão heurística.
+func (st *Store) Add(transactionID, city, decision, reason string) (Decision, error) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	d := &Decision{
+		TransactionID: transactionID,
+		City:          city,
+		Decision:      decision,
+		Reason:        reason,
+		Status:        StatusHeuristic,
+		DecidedAtUTC:  time.Now().UTC(),
+	}
+	st.decisions[key(transactionID, city)] = d
+	st.evictLocked()
+	return *d, st.persistLocked()
+}
+
+// evictLocked descarta as decisões confirmadas pelo coordenador mais antigas além de MaxDecisions.
+// Requer st.mux travado.
+func (st *Store) evictLocked() {
+	excess := len(st.decisions) - MaxDecisions
+	if excess <= 0 {
+		return
+	}
+	var confirmed []*Decision
+	for _, d := range st.decisions {
+		if d.Status == StatusConfirmed {
+			confirmed = append(confirmed, d)
+		}
+	}
+	sort.Slice(confirmed, func(i, j int) bool { return confirmed[i].DecidedAtUTC.Before(confirmed[j].DecidedAtUTC) })
+	if len(confirmed) < excess {
+		log.Printf("[HeuristicStore] AVISO: %d decisões guardadas, acima do limite de %d, aguardando o coordenador ou marcadas HEURISTIC_MIXED", len(st.decisions)-len(confirmed), MaxDecisions)
+		excess = len(confirmed)
+	}
+	for _, d := range confirmed[:excess] {
+		delete(st.decisions, key(d.TransactionID, d.City))
+	}
+	if excess > 0 {
+		log.Printf("[HeuristicStore] %d decisões heurísticas confirmadas descartadas (limite %d)", excess, MaxDecisions)
+	}
+}
+
+// Resolve registra a decisão do coordenador para uma decisão heurística: HEURISTIC_CONFIRMED se
+// for a mesma, HEURISTIC_MIXED se for a contrária.
+func (st *Store) Resolve(transactionID, city, coordinatorDecision string) error {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	d, ok := st.decisions[key(transactionID, city)]
+	if !ok {
+		return fmt.Errorf("decisão heurística de %s em %s não encontrada", transactionID, city)
+	}
+	if d.Status != StatusHeuristic {
+		return nil // Entrega repetida da mesma decisão
+	}
+	now := time.Now().UTC()
+	d.CoordinatorDecision = coordinatorDecision
+	if coordinatorDecision == d.Decision {
+		d.Status = StatusConfirmed
+		d.ConfirmedAtUTC = &now
+	} else {
+		d.Status = StatusMixed
+		d.MixedAtUTC = &now
+	}
+	st.evictLocked()
+	return st.persistLocked()
+}
+
+// List retorna cópias de todas as decisões, da mais recente para a mais antiga.
+func (st *Store) List() []Decision {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	list := make([]Decision, 0, len(st.decisions))
+	for _, d := range st.decisions {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DecidedAtUTC.After(list[j].DecidedAtUTC) })
+	return list
+}
+
+// persistLocked grava todas as decisões no arquivo, de forma atômica e sincronizada em disco.
+// Requer st.mux travado.
+func (st *Store) persistLocked() error {
+	decisions := make([]*Decision, 0, len(st.decisions))
+	for _, d := range st.decisions {
+		decisions = append(decisions, d)
+	}
+	data, err := json.MarshalIndent(decisions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("falha ao serializar decisões heurísticas: %w", err)
+	}
+	if err := durable.WriteFile(st.path, data); err != nil {
+		return fmt.Errorf("falha ao persistir decisões heurísticas: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	"github.com/4r7hur0/PBL-2/api/heuristic"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// heuristicStore guarda as decisões heurísticas tomadas pelo operador nas cidades desta API.
+	heuristicStore *heuristic.Store
+	// adminToken protege os endpoints heurísticos e de capacidade (ADMIN_TOKEN); vazio os desabilita.
+	adminToken string
+)
+
+// restoreHeuristics recarrega as decisões heurísticas nos StateManagers e passa a registrar a
+// decisão do coordenador em cada uma: HEURISTIC_CONFIRMED ou HEURISTIC_MIXED.
+func restoreHeuristics() {
+	for _, d := range heuristicStore.List() {
+		if sm, err := cityStateManager(d.City); err == nil {
+			sm.RestoreHeuristic(d.TransactionID, d.Decision)
+		}
+	}
+	for _, city := range localCities() {
+		sm, _ := cityStateManager(city)
+		sm.SetHeuristicResolvedHook(func(transactionID, heuristicDecision, decision string) {
+			if err := heuristicStore.Resolve(transactionID, city, decision); err != nil {
+				log.Printf("[%s] TX[%s]: Falha ao registrar a decisão do coordenador para a decisão heurística em %s: %v", enterpriseName, transactionID, city, err)
+			}
+		})
+	}
+}
+
+// requireAdminToken exige "Authorization: Bearer <ADMIN_TOKEN>".
+func requireAdminToken(c *gin.Context) {
+	if adminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Endpoints administrativos desabilitados: defina ADMIN_TOKEN"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+adminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Token de administrador inválido"})
+		return
+	}
+	c.Next()
+}
+
+// heuristicRequest é o corpo opcional das decisões heurísticas.
+type heuristicRequest struct {
+	Reason string `json:"reason"`
+}
+
+// handleHeuristicDecision força COMMIT ou ABORT de uma reserva PREPARED presa nesta API
+// (?city= escolhe uma cidade hospedada no processo). A decisão é registrada e, se o coordenador
+// decidir o contrário depois, marcada como HEURISTIC_MIXED.
+func handleHeuristicDecision(decision string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		transactionID := c.Param("id")
+		city := c.DefaultQuery("city", ownedCity)
+		var req heuristicRequest
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+				return
+			}
+		}
+		sm, err := cityStateManager(city)
+		if err != nil {
+			c.JSON(http.StatusNotFound, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: transactionID, Reason: err.Error()})
+			return
+		}
+		if err := sm.ForceDecision(transactionID, decision); err != nil {
+			c.JSON(http.StatusConflict, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: transactionID, Reason: err.Error()})
+			return
+		}
+		log.Printf("[%s] TX[%s]: Operador forçou %s em %s. Motivo: %s", enterpriseName, transactionID, decision, city, req.Reason)
+		recorded, err := heuristicStore.Add(transactionID, city, decision, req.Reason)
+		if err != nil {
+			log.Printf("[%s] TX[%s]: Falha ao registrar decisão heurística: %v", enterpriseName, transactionID, err)
+			c.JSON(http.StatusInternalServerError, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: transactionID, Reason: "Decisão aplicada, mas não registrada: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, recorded)
+	}
+}
+
+func handleListHeuristics(c *gin.Context) {
+	c.JSON(http.StatusOK, heuristicStore.List())
+}
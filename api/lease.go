@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/participant"
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// decisionQueryTimeout limita cada consulta a coordenadores e participantes sobre transações incertas.
+const decisionQueryTimeout = 5 * time.Second
+
+// decisionQueryClient é usado para consultar coordenadores sobre transações incertas.
+var decisionQueryClient = &http.Client{Transport: interAPITransport, Timeout: decisionQueryTimeout}
+
+// resolveExpiredPrepares resolve as reservas PREPARED desta cidade cuja concessão expirou.
+// Primeiro o coordenador é consultado; se ele não responder, os demais participantes da rota
+// são consultados (terminação cooperativa). Se ninguém souber o resultado, a concessão é renovada e a
+// consulta repetida no próximo vencimento: abortar sozinho poderia contrariar um COMMIT já decidido.
+// Reservas do 3PC decidem sozinhas pelo estado dos participantes alcançáveis (threePhaseTimeoutDecision).
+func resolveExpiredPrepares() {
+	for _, sm := range localStateManagers() {
+		resolveExpiredPreparesIn(sm)
+	}
+}
+
+func resolveExpiredPreparesIn(sm *state.StateManager) {
+	for _, res := range sm.ExpiredPreparedReservations() {
+		decision, err := queryCoordinatorDecision(res.CoordinatorURL, res.TransactionID, res.City)
+		if err != nil && res.Protocol == protocol3PC {
+			log.Printf("[%s] TX[%s]: Concessão %s expirada e coordenador inacessível (%v). Decidindo pelo 3PC.", enterpriseName, res.TransactionID, res.Status, err)
+			decision = threePhaseTimeoutDecision(res)
+		} else if err != nil {
+			log.Printf("[%s] TX[%s]: Concessão PREPARED expirada e coordenador inacessível (%v). Consultando os demais participantes.", enterpriseName, res.TransactionID, err)
+			decision = queryPeerOutcome(res)
+		}
+		switch decision {
+		case schemas.DecisionCommit:
+			log.Printf("[%s] TX[%s]: Concessão expirada; decisão COMMIT. Efetivando reserva local.", enterpriseName, res.TransactionID)
+			if outcome := sm.CommitReservation(res.TransactionID); outcome != schemas.StatusReservationCommitted {
+				log.Printf("[%s] TX[%s]: COMMIT não aplicado; transação %s nesta cidade.", enterpriseName, res.TransactionID, outcome)
+			}
+		case schemas.DecisionAbort:
+			log.Printf("[%s] TX[%s]: Concessão expirada; decisão ABORT. Abortando reserva local.", enterpriseName, res.TransactionID)
+			sm.AbortReservation(res.TransactionID)
+		case schemas.StatusPending:
+			log.Printf("[%s] TX[%s]: Concessão expirada; transação ainda em andamento no coordenador.", enterpriseName, res.TransactionID)
+			sm.ExtendPreparedLease(res.TransactionID)
+		default:
+			until := sm.ExtendPreparedLease(res.TransactionID)
+			log.Printf("[%s] TX[%s]: Concessão expirada e resultado desconhecido (%s). Reserva continua bloqueada; nova consulta às %s.", enterpriseName, res.TransactionID, decision, until.Format(time.RFC3339))
+		}
+	}
+}
+
+// queryCoordinatorDecision pergunta ao coordenador qual foi a decisão global da transação.
+// Uma transação desconhecida pelo coordenador é tratada como ABORT (abort presumido).
+func queryCoordinatorDecision(coordinatorURL, transactionID, city string) (string, error) {
+	if coordinatorURL == "" {
+		return "", fmt.Errorf("reserva sem coordenador conhecido")
+	}
+	if coordinatorURL == selfAPIURL {
+		return presumedDecision(coordinatorDecision(transactionID, city)), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), decisionQueryTimeout)
+	defer cancel()
+	status, err := participant.FetchStatus(ctx, decisionQueryClient, coordinatorURL, transactionID, city, false)
+	if err != nil {
+		return "", err
+	}
+	return presumedDecision(status.Decision), nil
+}
+
+func presumedDecision(decision string) string {
+	if decision == "" || decision == schemas.StatusUnknown {
+		return schemas.DecisionAbort
+	}
+	return decision
+}
+
+// queryPeerOutcome aplica a terminação cooperativa: se algum outro participante já efetivou a
+// transação, ela foi decidida COMMIT; se algum a abortou ou nunca a preparou, o coordenador não
+// pode ter decidido COMMIT. Quem nunca a preparou passa a recusar o PREPARE dela ao ser consultado
+// (ver Participant.Status), para que não vote SIM depois. Se todos também estão PREPARED (ou
+// inacessíveis), o resultado é incerto.
+func queryPeerOutcome(res schemas.ActiveReservation) string {
+	outcome := schemas.StatusUnknown
+	for _, state := range queryPeerStates(res) {
+		switch state {
+		case schemas.StatusReservationCommitted:
+			if !res.Optional { // Um segmento opcional pode ter ficado de fora de uma rota efetivada
+				return schemas.DecisionCommit
+			}
+		case schemas.StatusAborted, schemas.StatusUnknown:
+			outcome = schemas.DecisionAbort
+		}
+	}
+	return outcome
+}
+
+// threePhaseTimeoutDecision é a decisão unilateral do participante 3PC quando o coordenador falha.
+// Uma reserva PRECOMMITTED sabe que todos votaram SIM e efetiva, a menos que algum participante já
+// tenha abortado. Uma reserva PREPARED aborta, a menos que algum participante já esteja PRECOMMITTED
+// ou COMMITTED (o coordenador chegou à fase de PRE-COMMIT). Participantes inacessíveis não bloqueiam.
+func threePhaseTimeoutDecision(res schemas.ActiveReservation) string {
+	sawPreCommit := res.Status == schemas.StatusReservationPreCommitted
+	for _, state := range queryPeerStates(res) {
+		switch state {
+		case schemas.StatusReservationCommitted:
+			if !res.Optional {
+				return schemas.DecisionCommit
+			}
+		case schemas.StatusAborted, schemas.StatusUnknown:
+			return schemas.DecisionAbort
+		case schemas.StatusReservationPreCommitted:
+			sawPreCommit = sawPreCommit || !res.Optional
+		}
+	}
+	if sawPreCommit {
+		return schemas.DecisionCommit
+	}
+	return schemas.DecisionAbort
+}
+
+// queryPeerStates retorna o estado da transação em cada outro participante alcançável da rota.
+func queryPeerStates(res schemas.ActiveReservation) map[string]string {
+	states := make(map[string]string)
+	for _, city := range res.ParticipantCities {
+		if city == res.City {
+			continue
+		}
+		p, err := participantFor(city, res.Protocol)
+		if err != nil {
+			log.Printf("[%s] TX[%s]: Terminação - participante %s não localizado: %v", enterpriseName, res.TransactionID, city, err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), decisionQueryTimeout)
+		status, err := p.Status(ctx, res.TransactionID)
+		cancel()
+		if err != nil {
+			log.Printf("[%s] TX[%s]: Terminação - participante %s inacessível: %v", enterpriseName, res.TransactionID, city, err)
+			continue
+		}
+		log.Printf("[%s] TX[%s]: Terminação - %s está %s", enterpriseName, res.TransactionID, city, status.State)
+		states[city] = status.State
+	}
+	return states
+}
@@ -2,15 +2,29 @@ package mqtt
 
 import (
 	"fmt"
+	"sync"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 var client mqtt.Client
 
+// subscription é uma assinatura ativa. A sessão é limpa, então o broker esquece as assinaturas
+// quando a conexão cai; elas são refeitas a cada reconexão (ver resubscribe).
+type subscription struct {
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+var (
+	subscriptionsMux sync.Mutex
+	subscriptions    = make(map[string]subscription)
+)
+
 func InitializeMQTT(broker string) {
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(broker)
+	opts.SetOnConnectHandler(resubscribe)
 
 	client = mqtt.NewClient(opts)
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
@@ -41,11 +55,32 @@ func Subscribe(topic string, handler mqtt.MessageHandler) {
 		return
 	}
 
-	token := client.Subscribe(topic, 0, handler)
-	token.Wait()
-	if token.Error() != nil {
+	if err := subscribe(topic, 0, handler); err != nil {
 		fmt.Printf("Error subscribing to topic: %v\n", topic)
 	} else {
 		fmt.Printf("Subscribed to topic: %s\n", topic)
 	}
 }
+
+// subscribe assina o tópico e o guarda para ser assinado de novo a cada reconexão.
+func subscribe(topic string, qos byte, handler mqtt.MessageHandler) error {
+	subscriptionsMux.Lock()
+	subscriptions[topic] = subscription{qos: qos, handler: handler}
+	subscriptionsMux.Unlock()
+
+	token := client.Subscribe(topic, qos, handler)
+	token.Wait()
+	return token.Error()
+}
+
+// resubscribe refaz as assinaturas depois de uma reconexão ao broker. Na primeira conexão ainda
+// não há nenhuma.
+func resubscribe(c mqtt.Client) {
+	subscriptionsMux.Lock()
+	defer subscriptionsMux.Unlock()
+	for topic, sub := range subscriptions {
+		if token := c.Subscribe(topic, sub.qos, sub.handler); token.Wait() && token.Error() != nil {
+			fmt.Printf("Error resubscribing to topic %s: %v\n", topic, token.Error())
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+)
+
+// Requisição/resposta HTTP sobre MQTT, usada entre as APIs das empresas quando uma delas não
+// pode expor HTTP (por exemplo, atrás de NAT). A empresa é endereçada por "mqtt://<empresa>" e
+// escuta em "enterprise/<empresa>/rpc/<grupo>/<operação>" (ex.: .../rpc/2pc_remote/prepare);
+// as respostas chegam em "enterprise/<empresa>/rpc_reply", correlacionadas pelo correlation_id.
+
+// URLScheme é o esquema das URLs de APIs alcançadas por MQTT.
+const URLScheme = "mqtt"
+
+// rpcQoS garante entrega ao menos uma vez; os endpoints entre APIs já são idempotentes.
+const rpcQoS = 1
+
+type rpcRequest struct {
+	CorrelationID string `json:"correlation_id"`
+	ReplyTo       string `json:"reply_to"`
+	Method        string `json:"method"`
+	Path          string `json:"path"` // Caminho com query, como na requisição HTTP
+	Body          []byte `json:"body,omitempty"`
+}
+
+type rpcReply struct {
+	CorrelationID string `json:"correlation_id"`
+	StatusCode    int    `json:"status_code"`
+	Body          []byte `json:"body,omitempty"`
+}
+
+// RPCURL retorna a URL pela qual as outras APIs alcançam a empresa via MQTT.
+func RPCURL(enterprise string) string {
+	return URLScheme + "://" + enterprise
+}
+
+// requestTopic usa só os dois primeiros segmentos do caminho, que identificam a operação.
+func requestTopic(enterprise, path string) string {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	return fmt.Sprintf("enterprise/%s/rpc/%s", enterprise, strings.Join(segments[:min(len(segments), 2)], "/"))
+}
+
+func replyTopic(enterprise string) string {
+	return fmt.Sprintf("enterprise/%s/rpc_reply", enterprise)
+}
+
+// RoundTripper envia requisições HTTP para URLs mqtt:// e aguarda a resposta correlacionada.
+// Deve ser registrado em um http.Transport com RegisterProtocol.
+type RoundTripper struct {
+	mux        sync.Mutex
+	replyTopic string
+	pending    map[string]chan rpcReply
+}
+
+// RPCTransport é o RoundTripper desta API, ativo depois de StartRPCClient.
+var RPCTransport = &RoundTripper{pending: make(map[string]chan rpcReply)}
+
+// StartRPCClient assina o tópico de respostas da empresa. Deve ser chamada depois de InitializeMQTT.
+func StartRPCClient(enterprise string) error {
+	topic := replyTopic(enterprise)
+	err := subscribe(topic, rpcQoS, func(_ mqtt.Client, msg mqtt.Message) {
+		var reply rpcReply
+		if err := json.Unmarshal(msg.Payload(), &reply); err != nil {
+			fmt.Printf("Resposta MQTT inválida em %s: %v\n", msg.Topic(), err)
+			return
+		}
+		RPCTransport.deliver(reply)
+	})
+	if err != nil {
+		return err
+	}
+	RPCTransport.mux.Lock()
+	RPCTransport.replyTopic = topic
+	RPCTransport.mux.Unlock()
+	return nil
+}
+
+// deliver entrega a resposta à requisição que a aguarda; respostas repetidas ou tardias são descartadas.
+func (t *RoundTripper) deliver(reply rpcReply) {
+	t.mux.Lock()
+	ch, ok := t.pending[reply.CorrelationID]
+	delete(t.pending, reply.CorrelationID)
+	t.mux.Unlock()
+	if ok {
+		ch <- reply
+	}
+}
+
+func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.mux.Lock()
+	if t.replyTopic == "" {
+		t.mux.Unlock()
+		return nil, errors.New("cliente MQTT de requisição/resposta não iniciado")
+	}
+	request := rpcRequest{CorrelationID: uuid.New().String(), ReplyTo: t.replyTopic, Method: req.Method, Path: req.URL.RequestURI(), Body: body}
+	replies := make(chan rpcReply, 1)
+	t.pending[request.CorrelationID] = replies
+	t.mux.Unlock()
+	defer func() {
+		t.mux.Lock()
+		delete(t.pending, request.CorrelationID)
+		t.mux.Unlock()
+	}()
+
+	payload, _ := json.Marshal(request)
+	token := client.Publish(requestTopic(req.URL.Host, req.URL.Path), rpcQoS, false, payload)
+	if err := waitToken(req.Context(), token); err != nil {
+		return nil, fmt.Errorf("falha ao publicar requisição MQTT: %w", err)
+	}
+
+	select {
+	case reply := <-replies:
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", reply.StatusCode, http.StatusText(reply.StatusCode)),
+			StatusCode:    reply.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+			Body:          io.NopCloser(bytes.NewReader(reply.Body)),
+			ContentLength: int64(len(reply.Body)),
+			Request:       req,
+		}, nil
+	case <-req.Context().Done():
+		return nil, fmt.Errorf("resposta MQTT não recebida: %w", req.Context().Err())
+	}
+}
+
+func waitToken(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ServeRPC atende as requisições MQTT endereçadas à empresa com o handler HTTP informado
+// (o mesmo roteador da API REST) e publica as respostas no tópico pedido pelo cliente. Só os
+// caminhos dos grupos informados (ex.: "2pc_remote") são atendidos; os demais recebem 404.
+func ServeRPC(enterprise string, handler http.Handler, groups ...string) error {
+	allowed := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		allowed[group] = true
+		topic := fmt.Sprintf("enterprise/%s/rpc/%s/#", enterprise, group)
+		err := subscribe(topic, rpcQoS, func(_ mqtt.Client, msg mqtt.Message) {
+			var request rpcRequest
+			if err := json.Unmarshal(msg.Payload(), &request); err != nil || request.ReplyTo == "" {
+				fmt.Printf("Requisição MQTT inválida em %s: %v\n", msg.Topic(), err)
+				return
+			}
+			// Cada requisição em sua goroutine: um handler pode fazer suas próprias chamadas MQTT
+			go serveRequest(handler, allowed, request)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Servindo requisições entre APIs no tópico: %s\n", topic)
+	}
+	return nil
+}
+
+// routeGroup retorna o primeiro segmento do caminho, que identifica o grupo de rotas.
+func routeGroup(path string) string {
+	return strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+}
+
+func serveRequest(handler http.Handler, allowed map[string]bool, request rpcRequest) {
+	reply := rpcReply{CorrelationID: request.CorrelationID}
+	req, err := http.NewRequest(request.Method, request.Path, bytes.NewReader(request.Body))
+	if err != nil {
+		reply.StatusCode = http.StatusBadRequest
+	} else if !allowed[routeGroup(req.URL.Path)] {
+		// O caminho vem no corpo: o tópico assinado não basta para restringir as rotas
+		reply.StatusCode = http.StatusNotFound
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+		w := &responseBuffer{header: make(http.Header)}
+		handler.ServeHTTP(w, req)
+		reply.StatusCode = w.status
+		if reply.StatusCode == 0 {
+			reply.StatusCode = http.StatusOK
+		}
+		reply.Body = w.body.Bytes()
+	}
+	payload, _ := json.Marshal(reply)
+	token := client.Publish(request.ReplyTo, rpcQoS, false, payload)
+	if token.Wait() && token.Error() != nil {
+		fmt.Printf("Erro ao publicar resposta MQTT em %s: %v\n", request.ReplyTo, token.Error())
+	}
+}
+
+// responseBuffer guarda a resposta do handler HTTP para enviá-la pelo MQTT.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseBuffer) Header() http.Header { return w.header }
+
+func (w *responseBuffer) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *responseBuffer) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
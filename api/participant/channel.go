@@ -0,0 +1,130 @@
+// PBL-2/api/participant/channel.go
+package participant
+
+import (
+	"context"
+
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// EndpointChannelPrefix identifica participantes hospedados no mesmo processo.
+const EndpointChannelPrefix = "inproc://"
+
+// Tipos de comando enviados pelo canal.
+const (
+	cmdPrepare   = "PREPARE"
+	cmdPreCommit = "PRECOMMIT"
+	cmdCommit    = "COMMIT"
+	cmdAbort     = "ABORT"
+	cmdReserve   = "RESERVE"
+	cmdCancel    = "CANCEL"
+	cmdStatus    = "STATUS"
+)
+
+type command struct {
+	kind          string
+	req           schemas.RemotePrepareRequest
+	transactionID string
+	reply         chan reply
+}
+
+type reply struct {
+	reservation schemas.ActiveReservation
+	status      schemas.TransactionStatusResponse
+	err         error
+}
+
+// Channel é um participante em memória: os comandos trafegam por um canal até a goroutine que
+// serve o StateManager da cidade, como se fosse outra API. Permite montar uma implantação com
+// várias cidades em um único processo (demonstrações e testes).
+type Channel struct {
+	city     string
+	commands chan command
+}
+
+// NewChannel cria o participante da cidade e inicia a goroutine que atende seus comandos.
+func NewChannel(city string, sm *state.StateManager) *Channel {
+	p := &Channel{city: city, commands: make(chan command)}
+	go p.serve(sm)
+	return p
+}
+
+func (p *Channel) serve(sm *state.StateManager) {
+	for cmd := range p.commands {
+		var r reply
+		switch cmd.kind {
+		case cmdPrepare:
+			r.reservation, r.err = sm.PrepareReservation(cmd.req)
+		case cmdPreCommit:
+			r.err = preCommit(sm, cmd.transactionID)
+		case cmdCommit:
+			r.err = commit(sm, cmd.transactionID)
+		case cmdAbort:
+			r.err = abort(sm, cmd.transactionID)
+		case cmdReserve:
+			r.reservation, r.err = sm.ReserveDirect(cmd.req)
+		case cmdCancel:
+			sm.CancelReservation(cmd.transactionID)
+		case cmdStatus:
+			r.status = localStatus(p.city, sm, cmd.transactionID)
+		}
+		cmd.reply <- r
+	}
+}
+
+// call envia o comando e aguarda a resposta, respeitando o prazo do contexto nas duas direções.
+func (p *Channel) call(ctx context.Context, cmd command) reply {
+	cmd.reply = make(chan reply, 1)
+	select {
+	case p.commands <- cmd:
+	case <-ctx.Done():
+		return reply{err: ctx.Err()}
+	}
+	select {
+	case r := <-cmd.reply:
+		return r
+	case <-ctx.Done():
+		return reply{err: ctx.Err()}
+	}
+}
+
+func (p *Channel) City() string     { return p.city }
+func (p *Channel) Endpoint() string { return EndpointChannelPrefix + p.city }
+
+func (p *Channel) Prepare(ctx context.Context, req schemas.RemotePrepareRequest) (Prepared, error) {
+	r := p.call(ctx, command{kind: cmdPrepare, req: req})
+	if r.err != nil {
+		return Prepared{}, r.err
+	}
+	return preparedFrom(r.reservation), nil
+}
+
+func (p *Channel) PreCommit(ctx context.Context, transactionID string) error {
+	return p.call(ctx, command{kind: cmdPreCommit, transactionID: transactionID}).err
+}
+
+func (p *Channel) Commit(ctx context.Context, transactionID string) error {
+	return p.call(ctx, command{kind: cmdCommit, transactionID: transactionID}).err
+}
+
+func (p *Channel) Abort(ctx context.Context, transactionID string) error {
+	return p.call(ctx, command{kind: cmdAbort, transactionID: transactionID}).err
+}
+
+func (p *Channel) Reserve(ctx context.Context, req schemas.RemotePrepareRequest) (Allocation, error) {
+	r := p.call(ctx, command{kind: cmdReserve, req: req})
+	if r.err != nil {
+		return Allocation{}, r.err
+	}
+	return allocationFrom(r.reservation), nil
+}
+
+func (p *Channel) Cancel(ctx context.Context, transactionID string) error {
+	return p.call(ctx, command{kind: cmdCancel, transactionID: transactionID}).err
+}
+
+func (p *Channel) Status(ctx context.Context, transactionID string) (schemas.TransactionStatusResponse, error) {
+	r := p.call(ctx, command{kind: cmdStatus, transactionID: transactionID})
+	return r.status, r.err
+}
@@ -0,0 +1,326 @@
+// PBL-2/api/participant/http.go
+package participant
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Protocolos que definem o grupo de endpoints usado pelo participante HTTP.
+const (
+	Protocol2PC  = "2pc"
+	Protocol3PC  = "3pc"
+	ProtocolSaga = "saga"
+)
+
+// HTTP é um participante remoto alcançado pela API REST de outra empresa.
+type HTTP struct {
+	city     string
+	baseURL  string
+	protocol string
+	client   *http.Client
+
+	// Quando votes não é nil, o PREPARE é assíncrono: enviado a /prepare_async e o voto chega
+	// pelas URLs de callback retornadas por callbacks.
+	votes     *VoteRegistry
+	callbacks func(transactionID, segmentID string) schemas.CoordinatorCallbackURLs
+}
+
+// NewHTTP cria o participante da cidade servido pela API em baseURL. Os prazos vêm sempre do
+// contexto de cada chamada.
+func NewHTTP(city, baseURL, protocol string, client *http.Client) *HTTP {
+	return &HTTP{city: city, baseURL: baseURL, protocol: protocol, client: client}
+}
+
+// WithAsyncVotes habilita o PREPARE assíncrono com votos entregues por callback.
+func (p *HTTP) WithAsyncVotes(votes *VoteRegistry, callbacks func(transactionID, segmentID string) schemas.CoordinatorCallbackURLs) *HTTP {
+	p.votes = votes
+	p.callbacks = callbacks
+	return p
+}
+
+func (p *HTTP) City() string     { return p.city }
+func (p *HTTP) Endpoint() string { return p.baseURL }
+
+func (p *HTTP) pathPrefix() string {
+	if p.protocol == Protocol3PC {
+		return "/3pc_remote"
+	}
+	return "/2pc_remote"
+}
+
+func (p *HTTP) Prepare(ctx context.Context, req schemas.RemotePrepareRequest) (Prepared, error) {
+	if p.votes != nil {
+		return p.prepareAsync(ctx, req)
+	}
+	var remoteResp schemas.RemotePrepareResponse
+	resp, bodyBytes, err := p.post(ctx, p.pathPrefix()+"/prepare", req)
+	if err != nil {
+		return Prepared{}, fmt.Errorf("erro HTTP no PREPARE REMOTO: %w", err)
+	}
+	if err := json.Unmarshal(bodyBytes, &remoteResp); err != nil {
+		return Prepared{}, fmt.Errorf("resposta PREPARE REMOTO inválida (Status: %s, Corpo: %s): %w", resp.Status, string(bodyBytes), err)
+	}
+	if resp.StatusCode != http.StatusOK || remoteResp.Status != schemas.StatusReservationPrepared {
+		reason := fmt.Sprintf("PREPARE REMOTO rejeitado. Status: %s, Motivo: %s", resp.Status, remoteResp.Reason)
+		if len(remoteResp.Conflicts) > 0 {
+			return Prepared{}, &state.ConflictError{Reason: reason, Conflicts: remoteResp.Conflicts}
+		}
+		return Prepared{}, errors.New(reason)
+	}
+	preparedUntil, err := parsePreparedUntil(remoteResp.PreparedUntilUTC)
+	if err != nil {
+		return Prepared{}, err
+	}
+	return Prepared{Until: preparedUntil, Allocation: Allocation{ChargingPointID: remoteResp.ChargingPointID, Window: remoteResp.ReservationWindow}}, nil
+}
+
+// prepareAsync envia o PREPARE assíncrono e aguarda o voto pelo callback até o prazo do contexto.
+func (p *HTTP) prepareAsync(ctx context.Context, req schemas.RemotePrepareRequest) (Prepared, error) {
+	segmentID := asyncSegmentID(req)
+	votes := p.votes.register(req.TransactionID, segmentID)
+	defer p.votes.unregister(req.TransactionID, segmentID)
+
+	body := schemas.PrepareRequestBody{
+		TransactionID:           req.TransactionID,
+		SegmentID:               segmentID,
+		VehicleID:               req.VehicleID,
+		RequestID:               req.RequestID,
+		City:                    req.City,
+		ReservationWindow:       req.ReservationWindow,
+		CoordinatorURL:          req.CoordinatorURL,
+		ParticipantCities:       req.ParticipantCities,
+		Protocol:                req.Protocol,
+		PriorityUTC:             req.PriorityUTC,
+		Optional:                req.Optional,
+		ChargingPointID:         req.ChargingPointID,
+		Charge:                  req.Charge,
+		ReplacesTransactionID:   req.ReplacesTransactionID,
+		CoordinatorCallbackURLs: p.callbacks(req.TransactionID, segmentID),
+	}
+	resp, bodyBytes, err := p.post(ctx, p.pathPrefix()+"/prepare_async", body)
+	if err != nil {
+		return Prepared{}, fmt.Errorf("erro HTTP no PREPARE ASSÍNCRONO: %w", err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return Prepared{}, fmt.Errorf("PREPARE ASSÍNCRONO recusado (Status: %s, Corpo: %s)", resp.Status, string(bodyBytes))
+	}
+
+	select {
+	case vote := <-votes:
+		if !vote.Yes {
+			reason := fmt.Sprintf("PREPARE ASSÍNCRONO rejeitado. Motivo: %s", vote.Reason)
+			if len(vote.Conflicts) > 0 {
+				return Prepared{}, &state.ConflictError{Reason: reason, Conflicts: vote.Conflicts}
+			}
+			return Prepared{}, errors.New(reason)
+		}
+		preparedUntil, err := parsePreparedUntil(vote.PreparedUntilUTC)
+		if err != nil {
+			return Prepared{}, err
+		}
+		return Prepared{Until: preparedUntil, Allocation: Allocation{ChargingPointID: vote.ChargingPointID, Window: vote.ReservationWindow}}, nil
+	case <-ctx.Done():
+		return Prepared{}, fmt.Errorf("voto assíncrono não recebido: %w", ctx.Err())
+	}
+}
+
+func (p *HTTP) PreCommit(ctx context.Context, transactionID string) error {
+	return p.command(ctx, "/3pc_remote/precommit", transactionID)
+}
+
+// Commit envia COMMIT (DO-COMMIT no 3PC) e só o considera entregue com HTTP 200.
+func (p *HTTP) Commit(ctx context.Context, transactionID string) error {
+	if p.protocol == Protocol3PC {
+		return p.command(ctx, "/3pc_remote/docommit", transactionID)
+	}
+	return p.command(ctx, p.pathPrefix()+"/commit", transactionID)
+}
+
+// Abort envia ABORT; o status da resposta é o resultado local da cidade (ver abortOutcome).
+func (p *HTTP) Abort(ctx context.Context, transactionID string) error {
+	status, err := p.commandStatus(ctx, p.pathPrefix()+"/abort", transactionID)
+	if err != nil {
+		return err
+	}
+	return abortOutcome(status)
+}
+
+func (p *HTTP) Reserve(ctx context.Context, req schemas.RemotePrepareRequest) (Allocation, error) {
+	resp, bodyBytes, err := p.post(ctx, "/saga_remote/reserve", req)
+	if err != nil {
+		return Allocation{}, fmt.Errorf("erro HTTP: %w", err)
+	}
+	var remoteResp schemas.RemotePrepareResponse
+	if err := json.Unmarshal(bodyBytes, &remoteResp); err != nil {
+		return Allocation{}, fmt.Errorf("resposta inválida (Status: %s, Corpo: %s): %w", resp.Status, string(bodyBytes), err)
+	}
+	if resp.StatusCode != http.StatusOK || remoteResp.Status != schemas.StatusReservationCommitted {
+		return Allocation{}, fmt.Errorf("reserva rejeitada. Status: %s, Motivo: %s", resp.Status, remoteResp.Reason)
+	}
+	return Allocation{ChargingPointID: remoteResp.ChargingPointID, Window: remoteResp.ReservationWindow}, nil
+}
+
+func (p *HTTP) Cancel(ctx context.Context, transactionID string) error {
+	if p.protocol == ProtocolSaga {
+		return p.command(ctx, "/saga_remote/compensate", transactionID)
+	}
+	return p.command(ctx, p.pathPrefix()+"/cancel", transactionID)
+}
+
+func (p *HTTP) Status(ctx context.Context, transactionID string) (schemas.TransactionStatusResponse, error) {
+	return FetchStatus(ctx, p.client, p.baseURL, transactionID, p.city, true)
+}
+
+// FetchStatus consulta GET /2pc_remote/transactions/:id na API em baseURL. Se a API for a
+// coordenadora, a decisão retornada é a que vale para a cidade informada. Com terminating, a consulta
+// é a da terminação cooperativa (ver Participant.Status).
+func FetchStatus(ctx context.Context, client *http.Client, baseURL, transactionID, city string, terminating bool) (schemas.TransactionStatusResponse, error) {
+	var status schemas.TransactionStatusResponse
+	statusURL := fmt.Sprintf("%s/2pc_remote/transactions/%s?city=%s", baseURL, url.PathEscape(transactionID), url.QueryEscape(city))
+	if terminating {
+		statusURL += "&terminating=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, statusURL, nil)
+	if err != nil {
+		return status, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, fmt.Errorf("resposta inválida: %w", err)
+	}
+	return status, nil
+}
+
+// command envia um comando com apenas o TransactionID e só o considera entregue com HTTP 200. Um
+// corpo com status HEURISTIC_MIXED é entregue, mas retorna ErrHeuristicMixed.
+func (p *HTTP) command(ctx context.Context, path, transactionID string) error {
+	status, err := p.commandStatus(ctx, path, transactionID)
+	if err == nil && status == schemas.StatusHeuristicMixed {
+		return ErrHeuristicMixed
+	}
+	return err
+}
+
+// commandStatus envia o comando como command e retorna o status do corpo da resposta HTTP 200.
+func (p *HTTP) commandStatus(ctx context.Context, path, transactionID string) (string, error) {
+	resp, bodyBytes, err := p.post(ctx, path, schemas.RemoteCommitAbortRequest{TransactionID: transactionID})
+	if err != nil {
+		return "", fmt.Errorf("erro HTTP: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s, corpo: %s", resp.Status, string(bodyBytes))
+	}
+	var ack struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal(bodyBytes, &ack)
+	return ack.Status, nil
+}
+
+func (p *HTTP) post(ctx context.Context, path string, payload interface{}) (*http.Response, []byte, error) {
+	payloadBytes, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+path, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	return resp, bodyBytes, nil
+}
+
+// Vote é o voto de um participante assíncrono, recebido pelo callback do coordenador.
+type Vote struct {
+	Yes               bool
+	Reason            string
+	PreparedUntilUTC  string
+	ChargingPointID   string
+	ReservationWindow *schemas.ReservationWindow
+	Conflicts         []schemas.PrepareConflict
+}
+
+// VoteRegistry liga os callbacks de voto às fases de PREPARE em andamento, por transação e segmento.
+type VoteRegistry struct {
+	mux     sync.Mutex
+	waiters map[string]chan Vote
+}
+
+// NewVoteRegistry cria um registro de votos vazio.
+func NewVoteRegistry() *VoteRegistry {
+	return &VoteRegistry{waiters: make(map[string]chan Vote)}
+}
+
+// parsePreparedUntil lê o prazo da concessão de um voto SIM. Um prazo ilegível torna o voto
+// inválido: o coordenador o trata como NÃO e envia ABORT ao participante.
+func parsePreparedUntil(value string) (time.Time, error) {
+	preparedUntil, err := time.Parse(schemas.ISOFormat, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("voto SIM com prazo da concessão inválido (%q): %w", value, err)
+	}
+	return preparedUntil, nil
+}
+
+// asyncSegmentID identifica o segmento nos callbacks de voto pela cidade e pelo início da janela:
+// a mesma rota pode passar duas vezes por uma cidade, e os votos não podem se confundir.
+func asyncSegmentID(req schemas.RemotePrepareRequest) string {
+	return req.City + "@" + req.ReservationWindow.StartTimeUTC.UTC().Format("20060102T150405Z")
+}
+
+func voteKey(transactionID, segmentID string) string {
+	return transactionID + "/" + segmentID
+}
+
+// register deve ser chamada antes do envio do PREPARE, para que um voto rápido não se perca.
+func (r *VoteRegistry) register(transactionID, segmentID string) chan Vote {
+	ch := make(chan Vote, 1)
+	r.mux.Lock()
+	r.waiters[voteKey(transactionID, segmentID)] = ch
+	r.mux.Unlock()
+	return ch
+}
+
+func (r *VoteRegistry) unregister(transactionID, segmentID string) {
+	r.mux.Lock()
+	delete(r.waiters, voteKey(transactionID, segmentID))
+	r.mux.Unlock()
+}
+
+// Deliver entrega o voto à fase de PREPARE que o aguarda. Retorna false se ninguém aguarda
+// (prazo esgotado ou voto repetido); nesse caso o ABORT já foi ou será enviado ao participante.
+func (r *VoteRegistry) Deliver(transactionID, segmentID string, vote Vote) bool {
+	r.mux.Lock()
+	ch, ok := r.waiters[voteKey(transactionID, segmentID)]
+	r.mux.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- vote:
+		return true
+	default:
+		return false
+	}
+}
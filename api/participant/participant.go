@@ -0,0 +1,162 @@
+// PBL-2/api/participant/participant.go
+package participant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// EndpointLocal identifica o participante que é a própria cidade desta API.
+const EndpointLocal = "local"
+
+// ErrHeuristicMixed é retornado por Commit e Abort quando a cidade confirma a decisão global, mas
+// já tinha aplicado a decisão heurística contrária. A entrega está concluída e não deve ser repetida.
+var ErrHeuristicMixed = errors.New("a cidade já tinha aplicado a decisão heurística contrária (" + schemas.StatusHeuristicMixed + ")")
+
+// ErrAbortConflict é retornado por Abort quando a cidade não tinha reserva a abortar e a transação
+// já estava COMMITTED ou CANCELLED nela. A entrega está concluída, mas o conflito precisa ser visto.
+var ErrAbortConflict = errors.New("ABORT recebido para uma transação já resolvida de outra forma na cidade")
+
+// Participant é uma cidade participante de uma transação de reserva, independente do transporte.
+// O coordenador (2PC, 3PC ou saga) fala apenas com esta interface.
+type Participant interface {
+	City() string
+	// Endpoint identifica o participante no log de decisões e na fila de entregas, permitindo
+	// reencontrá-lo depois de uma queda ("local", URL da API ou "inproc://<cidade>").
+	Endpoint() string
+	Prepare(ctx context.Context, req schemas.RemotePrepareRequest) (Prepared, error)
+	PreCommit(ctx context.Context, transactionID string) error
+	Commit(ctx context.Context, transactionID string) error
+	Abort(ctx context.Context, transactionID string) error
+	// Reserve e Cancel são o passo e a compensação do modo saga. Cancel também remove a reserva
+	// efetivada de uma transação 2PC/3PC cancelada pelo veículo.
+	Reserve(ctx context.Context, req schemas.RemotePrepareRequest) (Allocation, error)
+	Cancel(ctx context.Context, transactionID string) error
+	// Status retorna o estado local da transação nesta cidade, para a terminação cooperativa: uma
+	// transação desconhecida é dada como ABORTED e a cidade passa a recusar o PREPARE dela.
+	Status(ctx context.Context, transactionID string) (schemas.TransactionStatusResponse, error)
+}
+
+// Allocation é o posto que o participante reservou e a janela que a recarga ocupa nele.
+type Allocation struct {
+	ChargingPointID string                     // Vazio se o participante não informa o posto
+	Window          *schemas.ReservationWindow // nil se o participante não informa a janela
+}
+
+// Prepared é o voto SIM de um participante: até quando a pré-alocação vale e o que foi alocado.
+type Prepared struct {
+	Until time.Time
+	Allocation
+}
+
+func allocationFrom(res schemas.ActiveReservation) Allocation {
+	window := res.ReservationWindow
+	return Allocation{ChargingPointID: res.ChargingPointID, Window: &window}
+}
+
+func preparedFrom(res schemas.ActiveReservation) Prepared {
+	return Prepared{Until: res.PreparedUntilUTC, Allocation: allocationFrom(res)}
+}
+
+// Local aplica os comandos diretamente no StateManager da cidade desta API.
+type Local struct {
+	city string
+	sm   *state.StateManager
+}
+
+// NewLocal cria o participante da cidade gerenciada por sm.
+func NewLocal(city string, sm *state.StateManager) *Local {
+	return &Local{city: city, sm: sm}
+}
+
+func (p *Local) City() string     { return p.city }
+func (p *Local) Endpoint() string { return EndpointLocal }
+
+func (p *Local) Prepare(ctx context.Context, req schemas.RemotePrepareRequest) (Prepared, error) {
+	if err := ctx.Err(); err != nil {
+		return Prepared{}, err
+	}
+	res, err := p.sm.PrepareReservation(req)
+	if err != nil {
+		return Prepared{}, err
+	}
+	return preparedFrom(res), nil
+}
+
+func (p *Local) PreCommit(ctx context.Context, transactionID string) error {
+	return preCommit(p.sm, transactionID)
+}
+
+func (p *Local) Commit(ctx context.Context, transactionID string) error {
+	return commit(p.sm, transactionID)
+}
+
+func (p *Local) Abort(ctx context.Context, transactionID string) error {
+	return abort(p.sm, transactionID)
+}
+
+func (p *Local) Reserve(ctx context.Context, req schemas.RemotePrepareRequest) (Allocation, error) {
+	if err := ctx.Err(); err != nil {
+		return Allocation{}, err
+	}
+	res, err := p.sm.ReserveDirect(req)
+	if err != nil {
+		return Allocation{}, err
+	}
+	return allocationFrom(res), nil
+}
+
+func (p *Local) Cancel(ctx context.Context, transactionID string) error {
+	p.sm.CancelReservation(transactionID)
+	return nil
+}
+
+func (p *Local) Status(ctx context.Context, transactionID string) (schemas.TransactionStatusResponse, error) {
+	return localStatus(p.city, p.sm, transactionID), nil
+}
+
+func preCommit(sm *state.StateManager, transactionID string) error {
+	if !sm.PreCommitReservation(transactionID) {
+		return fmt.Errorf("nenhuma reserva PREPARED para a transação %s", transactionID)
+	}
+	return nil
+}
+
+// commit efetiva a transação e transforma em erro qualquer resultado local diferente de COMMITTED,
+// para que o coordenador não registre o ACK. HEURISTIC_MIXED vira ErrHeuristicMixed.
+func commit(sm *state.StateManager, transactionID string) error {
+	switch outcome := sm.CommitReservation(transactionID); outcome {
+	case schemas.StatusReservationCommitted:
+		return nil
+	case schemas.StatusHeuristicMixed:
+		return ErrHeuristicMixed
+	default:
+		return fmt.Errorf("COMMIT não aplicado: transação %s %s nesta cidade", transactionID, outcome)
+	}
+}
+
+// abort aborta a transação e transforma HEURISTIC_MIXED em ErrHeuristicMixed e qualquer outro
+// resultado diferente de ABORTED em ErrAbortConflict.
+func abort(sm *state.StateManager, transactionID string) error {
+	return abortOutcome(sm.AbortReservation(transactionID))
+}
+
+func abortOutcome(outcome string) error {
+	switch outcome {
+	case schemas.StatusAborted:
+		return nil
+	case schemas.StatusHeuristicMixed:
+		return ErrHeuristicMixed
+	default:
+		return fmt.Errorf("%w: transação %s", ErrAbortConflict, outcome)
+	}
+}
+
+func localStatus(city string, sm *state.StateManager, transactionID string) schemas.TransactionStatusResponse {
+	return schemas.TransactionStatusResponse{TransactionID: transactionID, City: city, State: sm.TerminationStatus(transactionID)}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/4r7hur0/PBL-2/api/participant"
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/api/storage"
+)
+
+// inProcessCity é uma cidade hospedada neste mesmo processo (IN_PROCESS_CITIES), alcançada por canal.
+type inProcessCity struct {
+	sm          *state.StateManager
+	participant *participant.Channel
+}
+
+// inProcessCities são as cidades extras deste processo, por nome. Com elas uma única API roda
+// uma implantação com várias cidades, útil para demonstrações e testes.
+var inProcessCities = make(map[string]*inProcessCity)
+
+// parseInProcessCities lê IN_PROCESS_CITIES no formato "Cidade=postos,Outra Cidade=postos".
+// O estado de cada cidade é gravado em dataDir, como o da cidade desta API.
+func parseInProcessCities(value, dataDir string) {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		city, postsStr, found := strings.Cut(entry, "=")
+		city = strings.TrimSpace(city)
+		posts, err := strconv.Atoi(strings.TrimSpace(postsStr))
+		if !found || city == "" || err != nil || posts <= 0 {
+			log.Printf("Entrada inválida em IN_PROCESS_CITIES (%q). Ignorada.", entry)
+			continue
+		}
+		if city == ownedCity {
+			log.Printf("IN_PROCESS_CITIES: %s já é a cidade desta API. Ignorada.", city)
+			continue
+		}
+		sm := state.NewStateManager(city, posts)
+		sm.SetPrepareLease(stateMgr.PrepareLease())
+		sm.SetNoShowGrace(stateMgr.NoShowGrace())
+		sm.SetWaitlistOfferTimeout(stateMgr.WaitlistOfferTimeout())
+		sm.SetVictimPolicy(stateMgr.VictimPolicy())
+		if err := useCityStorage(sm, dataDir, city); err != nil {
+			log.Fatalf("[%s] Falha ao abrir o estado da cidade %s: %v", enterpriseName, city, err)
+		}
+		inProcessCities[city] = &inProcessCity{sm: sm, participant: participant.NewChannel(city, sm)}
+		log.Printf("[%s] Cidade %s hospedada neste processo com %d postos.", enterpriseName, city, posts)
+	}
+}
+
+// useCityStorage passa a gravar o estado da cidade em um diretório próprio dentro de dataDir,
+// recuperando as reservas gravadas antes.
+func useCityStorage(sm *state.StateManager, dataDir, city string) error {
+	st, err := storage.Open(filepath.Join(dataDir, fmt.Sprintf("%s-state-%s", enterpriseName, strings.ReplaceAll(city, " ", ""))))
+	if err != nil {
+		return err
+	}
+	if err := sm.UseStorage(st); err != nil {
+		st.Close()
+		return err
+	}
+	return nil
+}
+
+// errCityNotServed indica uma cidade que não é gerenciada por esta API.
+var errCityNotServed = errors.New("cidade não servida por esta API")
+
+// localCities retorna a cidade desta API seguida das cidades hospedadas no processo.
+func localCities() []string {
+	cities := []string{ownedCity}
+	for city := range inProcessCities {
+		cities = append(cities, city)
+	}
+	return cities
+}
+
+// cityStateManager retorna o StateManager de uma cidade servida por este processo, ou errCityNotServed.
+func cityStateManager(city string) (*state.StateManager, error) {
+	if city == ownedCity {
+		return stateMgr, nil
+	}
+	if c, ok := inProcessCities[city]; ok {
+		return c.sm, nil
+	}
+	return nil, fmt.Errorf("%w: %s não é servida por %s", errCityNotServed, city, enterpriseName)
+}
+
+// localStateManagers retorna os StateManagers de todas as cidades servidas por este processo.
+func localStateManagers() []*state.StateManager {
+	var managers []*state.StateManager
+	for _, city := range localCities() {
+		sm, _ := cityStateManager(city)
+		managers = append(managers, sm)
+	}
+	return managers
+}
+
+// participantFor retorna o participante de uma cidade para uma nova transação: a própria cidade,
+// uma cidade hospedada no processo ou a API remota descoberta pelo Registry.
+func participantFor(city, protocol string) (participant.Participant, error) {
+	if city == ownedCity {
+		return participant.NewLocal(city, stateMgr), nil
+	}
+	if c, ok := inProcessCities[city]; ok {
+		return c.participant, nil
+	}
+	discovered, err := registryClient.DiscoverService(city)
+	if err != nil || !discovered.Found {
+		return nil, fmt.Errorf("falha ao descobrir API para cidade remota '%s': %v (Found: %v)", city, err, discovered.Found)
+	}
+	return newHTTPParticipant(city, discovered.ApiURL, protocol), nil
+}
+
+// participantAt reconstrói o participante a partir do endpoint gravado no log ou na fila de entregas.
+func participantAt(city, endpoint, protocol string) (participant.Participant, error) {
+	switch {
+	case endpoint == participant.EndpointLocal:
+		return participant.NewLocal(city, stateMgr), nil
+	case strings.HasPrefix(endpoint, participant.EndpointChannelPrefix):
+		c, ok := inProcessCities[strings.TrimPrefix(endpoint, participant.EndpointChannelPrefix)]
+		if !ok {
+			return nil, fmt.Errorf("cidade %s não está mais hospedada neste processo", city)
+		}
+		return c.participant, nil
+	default:
+		return newHTTPParticipant(city, endpoint, protocol), nil
+	}
+}
+
+func newHTTPParticipant(city, apiURL, protocol string) participant.Participant {
+	p := participant.NewHTTP(city, apiURL, protocol, participantHTTPClient)
+	if prepareMode == prepareModeAsync {
+		p.WithAsyncVotes(asyncVotes, voteCallbackURLs)
+	}
+	return p
+}
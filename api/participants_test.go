@@ -0,0 +1,116 @@
+// PBL-2/api/participants_test.go
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/delivery"
+	"github.com/4r7hur0/PBL-2/api/participant"
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/api/txlog"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// startInProcessDeployment monta um coordenador cuja própria cidade fica fora das rotas e que
+// alcança as cidades de IN_PROCESS_CITIES só por canal, com log e fila de entregas em dir.
+func startInProcessDeployment(t *testing.T, cities string) {
+	t.Helper()
+	dir := t.TempDir()
+	enterpriseName = "Teste"
+	ownedCity = "Salvador"
+	stateMgr = state.NewStateManager(ownedCity, 1)
+	inProcessCities = make(map[string]*inProcessCity)
+	parseInProcessCities(cities, dir)
+
+	var err error
+	txLog, err = txlog.Open(filepath.Join(dir, "coordinator.log"))
+	if err != nil {
+		t.Fatalf("txlog.Open: %v", err)
+	}
+	deliveryQueue, err = delivery.Open(filepath.Join(dir, "delivery.json"), sendDeliveryItem, onDeliveryAck)
+	if err != nil {
+		t.Fatalf("delivery.Open: %v", err)
+	}
+	stop := make(chan struct{})
+	go deliveryQueue.Run(stop)
+	t.Cleanup(func() {
+		close(stop)
+		txLog.Close()
+	})
+}
+
+// route monta uma rota com um segmento por cidade, todos na mesma janela futura.
+func route(requestID string, cities ...string) schemas.ChosenRouteMsg {
+	start := time.Now().UTC().Add(2 * time.Hour).Truncate(time.Minute)
+	msg := schemas.ChosenRouteMsg{VehicleID: "car-1", RequestID: requestID}
+	for _, city := range cities {
+		msg.Route = append(msg.Route, schemas.RouteSegment{
+			City:              city,
+			ReservationWindow: schemas.ReservationWindow{StartTimeUTC: start, EndTimeUTC: start.Add(time.Hour)},
+		})
+	}
+	return msg
+}
+
+// awaitCompleted espera todos os participantes confirmarem a decisão e retorna a transação do log.
+func awaitCompleted(t *testing.T, transactionID string) *txlog.Transaction {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tx, err := txLog.Transaction(transactionID)
+		if err == nil && tx.Completed() {
+			return tx
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TX[%s] não foi concluída: %+v (erro %v)", transactionID, tx, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func assertCityStatus(t *testing.T, city, transactionID, want string) {
+	t.Helper()
+	if got := inProcessCities[city].sm.TransactionStatus(transactionID); got != want {
+		t.Errorf("%s: TX[%s] está %s, esperado %s", city, transactionID, got, want)
+	}
+}
+
+func TestInProcessCitiesCommitAndAbort(t *testing.T) {
+	startInProcessDeployment(t, "Feira de Santana=2, Ilheus=1")
+	cities := []string{"Feira de Santana", "Ilheus"}
+
+	committed := "tx-commit"
+	runAtomicCommit(committed, route("req-1", cities...), runTwoPhaseCommit)
+	tx := awaitCompleted(t, committed)
+	if tx.Decision != txlog.DecisionCommit {
+		t.Fatalf("decisão %q, esperado %s", tx.Decision, txlog.DecisionCommit)
+	}
+	for _, city := range cities {
+		if p := tx.Participants[city]; p == nil || p.Endpoint != participant.EndpointChannelPrefix+city {
+			t.Errorf("%s: participante %+v não foi alcançado por canal", city, p)
+		}
+		assertCityStatus(t, city, committed, schemas.StatusReservationCommitted)
+	}
+
+	// Ilheus só tem um posto, já ocupado pela primeira rota na mesma janela, e vota NÃO. Na ordem
+	// canônica Feira de Santana, que ainda tinha um posto livre, prepara antes e precisa desfazer o PREPARE.
+	prepareOrder = prepareOrderCanonical
+	t.Cleanup(func() { prepareOrder = prepareOrderParallel })
+	aborted := "tx-abort"
+	runAtomicCommit(aborted, route("req-2", cities...), runTwoPhaseCommit)
+	tx = awaitCompleted(t, aborted)
+	if tx.Decision != txlog.DecisionAbort {
+		t.Fatalf("decisão %q, esperado %s", tx.Decision, txlog.DecisionAbort)
+	}
+	for _, city := range cities {
+		assertCityStatus(t, city, aborted, schemas.StatusAborted)
+	}
+	for _, city := range cities {
+		_, _, reservations := inProcessCities[city].sm.GetCityAvailability()
+		if len(reservations) != 1 || reservations[0].TransactionID != committed {
+			t.Errorf("%s: reservas %v, esperado apenas a de %s", city, reservations, committed)
+		}
+	}
+}
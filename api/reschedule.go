@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/txlog"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Motivos de recusa próprios de um pedido de remarcação.
+var (
+	errRescheduleInvalid = errors.New("pedido de remarcação inválido")
+	errRescheduleSaga    = errors.New("rotas reservadas em saga não podem ser remarcadas; cancele a rota e escolha outra")
+)
+
+// rescheduleRoute inicia, a pedido do veículo, a remarcação de uma rota confirmada e coordenada
+// por esta API: uma nova transação 2PC/3PC (Replaces = transação atual) prepara em todas as
+// cidades da rota as novas janelas dos segmentos movidos e as janelas atuais dos demais. Só no
+// COMMIT cada cidade libera a reserva anterior; se a remarcação abortar, a rota anterior continua
+// valendo e o veículo recebe RESCHEDULE_REJECTED. Retorna o TransactionID da remarcação.
+func rescheduleRoute(req schemas.RescheduleRequestMsg) (string, error) {
+	routeChangeMux.Lock()
+	defer routeChangeMux.Unlock()
+
+	tx, err := txLog.Transaction(req.TransactionID)
+	if err != nil {
+		return "", fmt.Errorf("falha ao ler o log de transações: %w", err)
+	}
+	if tx == nil || len(tx.Route) == 0 {
+		return "", errRouteUnknown
+	}
+	if tx.VehicleID != req.VehicleID {
+		return "", errRouteForbidden
+	}
+	if err := checkRouteChangeable(tx.ID); err != nil {
+		return "", err
+	}
+	if tx.Protocol == protocolSaga {
+		return "", errRescheduleSaga
+	}
+	if tx.Decision != txlog.DecisionCommit || tx.Cancelled {
+		return "", errRouteNotConfirmed
+	}
+	if !tx.Completed() {
+		// Um COMMIT atrasado da reserva anterior a efetivaria depois da remarcação, ocupando duas janelas
+		return "", fmt.Errorf("%w: COMMIT ainda não confirmado por %v", errRouteChanging, tx.PendingCities())
+	}
+	// Segmentos que a cidade tirou numa redução de capacidade não entram: não há reserva a mover
+	reserved := reservedAllocations(tx)
+	if routeFinished(tx.Route, reserved) {
+		return "", errRouteFinished
+	}
+	moved, err := validateReschedule(req.Segments, reserved)
+	if err != nil {
+		return "", err
+	}
+
+	// A nova rota tem todas as cidades reservadas, para que a transação substitua a anterior inteira
+	chosenRoute := schemas.ChosenRouteMsg{RequestID: tx.RequestID, VehicleID: tx.VehicleID, Replaces: tx.ID}
+	for _, segment := range tx.Route {
+		alloc, ok := reserved[segment.City]
+		if !ok {
+			continue
+		}
+		segment = allocatedSegment(segment, alloc) // O posto atual é o preferido
+		if window, ok := moved[segment.City]; ok {
+			segment.ReservationWindow = window
+		}
+		segment.Optional = false
+		chosenRoute.Route = append(chosenRoute.Route, segment)
+	}
+
+	attempt := runTwoPhaseCommit
+	if reservationProtocol == protocol3PC {
+		attempt = runThreePhaseCommit
+	}
+	transactionID := uuid.New().String()
+	reschedulesInFlight[tx.ID] = transactionID
+	log.Printf("[%s] TX[%s]: Remarcação de %d segmento(s) pedida pelo veículo %s. Nova transação: TX[%s].", enterpriseName, tx.ID, len(moved), tx.VehicleID, transactionID)
+	go func() {
+		runAtomicCommit(transactionID, chosenRoute, attempt)
+		routeChangeMux.Lock()
+		delete(reschedulesInFlight, tx.ID)
+		routeChangeMux.Unlock()
+	}()
+	return transactionID, nil
+}
+
+// validateReschedule confere as novas janelas pedidas e as retorna por cidade. Cada cidade deve
+// ter uma reserva na rota e aparecer uma única vez, e a nova janela deve começar no futuro.
+func validateReschedule(segments []schemas.SegmentReschedule, reserved map[string]txlog.Allocation) (map[string]schemas.ReservationWindow, error) {
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("%w: nenhum segmento informado", errRescheduleInvalid)
+	}
+	now := time.Now().UTC()
+	moved := make(map[string]schemas.ReservationWindow, len(segments))
+	for _, segment := range segments {
+		window := segment.ReservationWindow
+		_, hasReservation := reserved[segment.City]
+		_, repeated := moved[segment.City]
+		switch {
+		case !hasReservation:
+			return nil, fmt.Errorf("%w: a rota não tem reserva em %s", errRescheduleInvalid, segment.City)
+		case repeated:
+			return nil, fmt.Errorf("%w: %s aparece mais de uma vez", errRescheduleInvalid, segment.City)
+		case !window.StartTimeUTC.Before(window.EndTimeUTC):
+			return nil, fmt.Errorf("%w: a nova janela de %s termina antes de começar", errRescheduleInvalid, segment.City)
+		case !window.StartTimeUTC.After(now):
+			return nil, fmt.Errorf("%w: a nova janela de %s já começou", errRescheduleInvalid, segment.City)
+		}
+		moved[segment.City] = window
+	}
+	return moved, nil
+}
+
+// publishRescheduleRejected avisa o veículo que a remarcação não foi feita. O status não é
+// gravado no log: o da rota continua sendo o da reserva anterior.
+func publishRescheduleRejected(transactionID string, chosenRoute schemas.ChosenRouteMsg, reason string) {
+	log.Printf("[%s] TX[%s]: Remarcação da TX[%s] não efetivada: %s.", enterpriseName, transactionID, chosenRoute.Replaces, reason)
+	publishUnloggedStatus(schemas.ReservationStatus{
+		TransactionID: transactionID,
+		VehicleID:     chosenRoute.VehicleID,
+		RequestID:     chosenRoute.RequestID,
+		Status:        schemas.StatusRescheduleRejected,
+		Message:       reason + "; a reserva anterior continua valendo",
+	})
+}
+
+// handleRescheduleMessage trata um pedido de remarcação recebido do veículo por MQTT. Se for
+// recusado, o veículo recebe RESCHEDULE_REJECTED e a reserva continua valendo.
+func handleRescheduleMessage(payload string) {
+	var req schemas.RescheduleRequestMsg
+	if err := json.Unmarshal([]byte(payload), &req); err != nil || req.TransactionID == "" || req.VehicleID == "" {
+		log.Printf("[%s] Pedido de remarcação inválido: %v. Mensagem original: %s", enterpriseName, err, payload)
+		return
+	}
+	if _, err := rescheduleRoute(req); err != nil {
+		log.Printf("[%s] TX[%s]: Remarcação recusada para VehicleID %s: %v", enterpriseName, req.TransactionID, req.VehicleID, err)
+		publishUnloggedStatus(schemas.ReservationStatus{TransactionID: req.TransactionID, VehicleID: req.VehicleID, Status: schemas.StatusRescheduleRejected, Message: "Remarcação recusada: " + err.Error()})
+	}
+}
+
+// handleRescheduleReservation é a remarcação por HTTP (POST /reservations/:id/reschedule), com o
+// VehicleID dono da reserva e as novas janelas no corpo. Responde 202 com o TransactionID da
+// remarcação; o resultado é publicado para o veículo.
+func handleRescheduleReservation(c *gin.Context) {
+	var req schemas.RescheduleRequestMsg
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	req.TransactionID = c.Param("id")
+	if req.VehicleID == "" {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: req.TransactionID, Reason: "vehicle_id é obrigatório"})
+		return
+	}
+	transactionID, err := rescheduleRoute(req)
+	if err != nil {
+		c.JSON(routeChangeErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: req.TransactionID, Reason: err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"status": schemas.StatusAccepted, "transaction_id": transactionID, "replaces": req.TransactionID})
+}
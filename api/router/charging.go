@@ -0,0 +1,37 @@
+package router
+
+import (
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// DefaultChargeEnergyKWh é a energia reservada em cada parada quando o veículo informa sua potência.
+const DefaultChargeEnergyKWh = 40.0
+
+// ApplyChargeProfile anexa a cada segmento o conector e a potência do veículo. Com a potência
+// informada, cada parada passa a durar o tempo de recarregar DefaultChargeEnergyKWh nela, e as
+// paradas seguintes são deslocadas; o participante ainda estende a janela se o posto escolhido
+// for mais lento que o veículo.
+func ApplyChargeProfile(routes [][]schemas.RouteSegment, connector string, maxChargePowerKW float64) [][]schemas.RouteSegment {
+	if connector == "" && maxChargePowerKW <= 0 {
+		return routes
+	}
+	for _, route := range routes {
+		if len(route) == 0 {
+			continue
+		}
+		currentTime := route[0].ReservationWindow.StartTimeUTC
+		for i := range route {
+			charge := &schemas.ChargeProfile{Connector: connector, MaxChargePowerKW: maxChargePowerKW}
+			if maxChargePowerKW > 0 {
+				charge.EnergyKWh = DefaultChargeEnergyKWh
+				route[i].ReservationWindow = schemas.ReservationWindow{
+					StartTimeUTC: currentTime,
+					EndTimeUTC:   currentTime.Add(schemas.ChargeDuration(charge.EnergyKWh, maxChargePowerKW)),
+				}
+				currentTime = route[i].ReservationWindow.EndTimeUTC
+			}
+			route[i].Charge = charge
+		}
+	}
+	return routes
+}
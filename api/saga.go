@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/participant"
+	"github.com/4r7hur0/PBL-2/api/saga"
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/api/timeline"
+	"github.com/4r7hur0/PBL-2/api/txlog"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// actionCompensate é a ação da fila de entregas que cancela um passo já reservado de uma saga.
+const actionCompensate = "COMPENSATE"
+
+// sagaStore guarda o estado das sagas coordenadas por esta API.
+var sagaStore *saga.Store
+
+// runSaga reserva a rota em modo saga: cada cidade é reservada e efetivada imediatamente, na ordem
+// da rota. Se uma cidade falhar, as cidades já reservadas recebem cancelamentos compensatórios.
+func runSaga(transactionID string, chosenRoute schemas.ChosenRouteMsg) {
+	// O BEGIN no log de decisões associa o RequestID à transação (deduplicação de rotas escolhidas)
+	err := txLog.Append(txlog.Record{
+		Type:          txlog.RecordBegin,
+		TransactionID: transactionID,
+		VehicleID:     chosenRoute.VehicleID,
+		RequestID:     chosenRoute.RequestID,
+		Route:         chosenRoute.Route,
+		Protocol:      protocolSaga,
+	})
+	if err == nil {
+		_, err = sagaStore.Create(transactionID, chosenRoute.VehicleID, chosenRoute.RequestID, chosenRoute.Route)
+	}
+	if err != nil {
+		log.Printf("[%s] SAGA[%s]: Falha ao registrar a saga: %v. Saga não iniciada.", enterpriseName, transactionID, err)
+		publishReservationStatus(chosenRoute.VehicleID, transactionID, "REJECTED", "Falha interna ao iniciar a transação", &chosenRoute, enterpriseName)
+		return
+	}
+
+	skipped := make(map[string]string)          // Segmentos opcionais que falharam: cidade -> motivo
+	allocs := make(map[string]txlog.Allocation) // Cidades reservadas: posto e janela
+	for _, segment := range chosenRoute.Route {
+		reserveReq := schemas.RemotePrepareRequest{
+			TransactionID:     transactionID,
+			VehicleID:         chosenRoute.VehicleID,
+			RequestID:         chosenRoute.RequestID,
+			City:              segment.City,
+			ReservationWindow: segment.ReservationWindow,
+			CoordinatorURL:    selfAPIURL,
+			ParticipantCities: requiredCities(chosenRoute.Route),
+			Optional:          segment.Optional,
+			ChargingPointID:   segment.ChargingPointID,
+			Charge:            segment.Charge,
+		}
+		endpoint, alloc, err := reserveSagaStep(reserveReq)
+		if err != nil && segment.Optional {
+			log.Printf("[%s] SAGA[%s]: FALHA ao reservar segmento opcional %s: %v. Seguindo sem ele.", enterpriseName, transactionID, segment.City, err)
+			updateSagaStep(transactionID, segment.City, endpoint, saga.StepFailed, err.Error())
+			if endpoint != "" {
+				// A reserva pode ter sido feita mesmo sem resposta; cancela só este passo
+				compensateSagaStep(transactionID, saga.Step{City: segment.City, Endpoint: endpoint, Reason: err.Error()})
+			}
+			skipped[segment.City] = err.Error()
+			continue
+		}
+		if err != nil {
+			log.Printf("[%s] SAGA[%s]: FALHA ao reservar %s: %v. Iniciando compensação.", enterpriseName, transactionID, segment.City, err)
+			updateSagaStep(transactionID, segment.City, endpoint, saga.StepFailed, err.Error())
+			compensateSaga(transactionID, fmt.Sprintf("falha ao reservar %s: %v", segment.City, err))
+			publishRouteOutcome(transactionID, chosenRoute, false, skipped, nil)
+			return
+		}
+		log.Printf("[%s] SAGA[%s]: %s reservada no posto %s.", enterpriseName, transactionID, segment.City, alloc.ChargingPointID)
+		allocs[segment.City] = txlog.Allocation{ChargingPointID: alloc.ChargingPointID, ReservationWindow: alloc.Window}
+		updateSagaStep(transactionID, segment.City, endpoint, saga.StepReserved, "")
+	}
+
+	if len(skipped) == len(chosenRoute.Route) {
+		log.Printf("[%s] SAGA[%s]: Nenhum segmento da rota pôde ser reservado.", enterpriseName, transactionID)
+		compensateSaga(transactionID, "nenhum segmento da rota pôde ser reservado")
+		publishRouteOutcome(transactionID, chosenRoute, false, skipped, nil)
+		return
+	}
+	if err := sagaStore.SetStatus(transactionID, saga.StatusCompleted, ""); err != nil {
+		log.Printf("[%s] SAGA[%s]: Falha ao persistir conclusão da saga: %v", enterpriseName, transactionID, err)
+	}
+	log.Printf("[%s] SAGA[%s]: Cidades reservadas (%d segmento(s) opcional(is) de fora).", enterpriseName, transactionID, len(skipped))
+	publishRouteOutcome(transactionID, chosenRoute, true, skipped, allocs)
+}
+
+// reserveSagaStep reserva e efetiva uma cidade, local ou remota, retornando o endpoint usado e o
+// que foi reservado. O endpoint é gravado na saga antes do envio: se a resposta se perder, a cidade
+// ainda é compensada.
+func reserveSagaStep(req schemas.RemotePrepareRequest) (string, participant.Allocation, error) {
+	p, err := participantFor(req.City, protocolSaga)
+	if err != nil {
+		return "", participant.Allocation{}, err
+	}
+	updateSagaStep(req.TransactionID, req.City, p.Endpoint(), saga.StepPending, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), decisionTimeout)
+	defer cancel()
+	alloc, err := p.Reserve(ctx, req)
+	return p.Endpoint(), alloc, err
+}
+
+// compensateSaga cancela, em ordem inversa, todas as cidades que foram (ou podem ter sido) reservadas.
+// Cancelamentos locais são imediatos; os remotos passam pela fila de entregas até serem confirmados.
+func compensateSaga(sagaID, reason string) {
+	if err := sagaStore.SetStatus(sagaID, saga.StatusCompensating, reason); err != nil {
+		log.Printf("[%s] SAGA[%s]: Falha ao persistir início da compensação: %v", enterpriseName, sagaID, err)
+	}
+	sg, ok := sagaStore.Get(sagaID)
+	if !ok {
+		return
+	}
+	for i := len(sg.Steps) - 1; i >= 0; i-- {
+		step := sg.Steps[i]
+		if step.Endpoint == "" || step.Status == saga.StepCompensated {
+			continue // Cidade nunca contatada ou já compensada
+		}
+		compensateSagaStep(sagaID, step)
+	}
+	finishCompensationIfDone(sagaID)
+}
+
+// compensateSagaStep cancela a reserva de uma cidade da saga: na hora, se local, ou pela fila de entregas.
+func compensateSagaStep(sagaID string, step saga.Step) {
+	if step.Endpoint == txlog.EndpointLocal {
+		stateMgr.CancelReservation(sagaID)
+		markStepCompensated(sagaID, step.City)
+		return
+	}
+	updateSagaStep(sagaID, step.City, step.Endpoint, saga.StepCompensating, step.Reason)
+	log.Printf("[%s] SAGA[%s]: Enfileirando compensação para %s (API: %s)", enterpriseName, sagaID, step.City, step.Endpoint)
+	if err := deliveryQueue.Enqueue(sagaID, step.City, step.Endpoint, actionCompensate); err != nil {
+		log.Printf("[%s] SAGA[%s]: ERRO ao agendar compensação para %s: %v", enterpriseName, sagaID, step.City, err)
+	}
+}
+
+// markStepCompensated registra a compensação confirmada de uma cidade e encerra a saga se for a última.
+func markStepCompensated(sagaID, city string) {
+	updateSagaStep(sagaID, city, "", saga.StepCompensated, "")
+	finishCompensationIfDone(sagaID)
+}
+
+func finishCompensationIfDone(sagaID string) {
+	sg, ok := sagaStore.Get(sagaID)
+	if !ok || sg.Status != saga.StatusCompensating {
+		return
+	}
+	for _, step := range sg.Steps {
+		if step.Status == saga.StepCompensating || step.Status == saga.StepReserved {
+			return
+		}
+	}
+	if err := sagaStore.SetStatus(sagaID, saga.StatusCompensated, ""); err != nil {
+		log.Printf("[%s] SAGA[%s]: Falha ao persistir fim da compensação: %v", enterpriseName, sagaID, err)
+		return
+	}
+	log.Printf("[%s] SAGA[%s]: Compensação concluída.", enterpriseName, sagaID)
+}
+
+func updateSagaStep(sagaID, city, endpoint, status, reason string) {
+	if err := sagaStore.UpdateStep(sagaID, city, endpoint, status, reason); err != nil {
+		log.Printf("[%s] SAGA[%s]: Falha ao persistir passo %s (%s): %v", enterpriseName, sagaID, city, status, err)
+	}
+	detail := status
+	if reason != "" {
+		detail += ": " + reason
+	}
+	history.AddEvent(sagaID, timeline.EventSagaStep, city, detail)
+}
+
+// pruneSagas descarta as sagas encerradas há mais de txLogRetention, como a compactação do log de
+// decisões faz com as transações.
+func pruneSagas() {
+	if _, err := sagaStore.Prune(time.Now().UTC().Add(-txLogRetention)); err != nil {
+		log.Printf("[%s] Falha ao descartar sagas encerradas: %v", enterpriseName, err)
+	}
+}
+
+// recoverSagas conclui as sagas interrompidas por uma queda: sagas ainda em execução são
+// compensadas (o resultado nunca foi informado ao veículo) e compensações pendentes são retomadas.
+func recoverSagas() {
+	for _, sg := range sagaStore.List() {
+		switch sg.Status {
+		case saga.StatusRunning:
+			log.Printf("[%s] SAGA[%s]: Saga interrompida durante as reservas. Compensando na recuperação.", enterpriseName, sg.ID)
+			compensateSaga(sg.ID, "saga interrompida por falha do coordenador")
+			chosenRoute := schemas.ChosenRouteMsg{RequestID: sg.RequestID, VehicleID: sg.VehicleID, Route: sg.Route}
+			publishReservationStatus(sg.VehicleID, sg.ID, "REJECTED", "Transação interrompida por falha do coordenador; reservas já feitas foram canceladas", &chosenRoute, enterpriseName)
+		case saga.StatusCompensating:
+			log.Printf("[%s] SAGA[%s]: Retomando compensação interrompida.", enterpriseName, sg.ID)
+			compensateSaga(sg.ID, "")
+		}
+	}
+}
+
+// handleSagaReserve é o passo de saga do lado participante: reserva já efetivada, sem PREPARE.
+func handleSagaReserve(c *gin.Context, sm *state.StateManager, localEntName string) {
+	var req schemas.RemotePrepareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.RemotePrepareResponse{Status: "REJECTED", TransactionID: req.TransactionID, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	if req.City != ownedCity {
+		errMsg := fmt.Sprintf("Requisição de RESERVA SAGA para cidade %s, mas esta API gerencia %s", req.City, ownedCity)
+		log.Printf("[%s] SAGA[%s]: %s", localEntName, req.TransactionID, errMsg)
+		c.JSON(http.StatusBadRequest, schemas.RemotePrepareResponse{Status: "REJECTED", TransactionID: req.TransactionID, Reason: errMsg})
+		return
+	}
+	log.Printf("[%s] SAGA[%s]: Recebida RESERVA SAGA para VehicleID %s na cidade %s", localEntName, req.TransactionID, req.VehicleID, req.City)
+	reservation, err := sm.ReserveDirect(req)
+	if err != nil {
+		c.JSON(http.StatusConflict, schemas.RemotePrepareResponse{Status: "REJECTED", TransactionID: req.TransactionID, Reason: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, schemas.RemotePrepareResponse{Status: schemas.StatusReservationCommitted, TransactionID: req.TransactionID, ChargingPointID: reservation.ChargingPointID, ReservationWindow: &reservation.ReservationWindow})
+}
+
+// handleSagaCompensate cancela a reserva de um passo de saga. É idempotente.
+func handleSagaCompensate(c *gin.Context, sm *state.StateManager, localEntName string) {
+	var req schemas.RemoteCommitAbortRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	log.Printf("[%s] SAGA[%s]: Recebida COMPENSAÇÃO", localEntName, req.TransactionID)
+	sm.CancelReservation(req.TransactionID)
+	c.JSON(http.StatusOK, gin.H{"status": schemas.StatusCancelled, "transaction_id": req.TransactionID})
+}
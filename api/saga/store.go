@@ -0,0 +1,251 @@
+// PBL-2/api/saga/store.go
+package saga
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/durable"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Estados de uma saga.
+const (
+	StatusRunning      = "RUNNING"      // Passos sendo reservados
+	StatusCompleted    = "COMPLETED"    // Todas as cidades reservadas
+	StatusCompensating = "COMPENSATING" // Falhou; cancelando as cidades já reservadas
+	StatusCompensated  = "COMPENSATED"  // Todas as compensações confirmadas
+)
+
+// Estados de um passo (uma cidade) da saga.
+const (
+	StepPending      = "PENDING"
+	StepReserved     = "RESERVED"
+	StepFailed       = "FAILED"
+	StepCompensating = "COMPENSATING"
+	StepCompensated  = "COMPENSATED"
+)
+
+// Step é a reserva de uma cidade da rota dentro da saga.
+type Step struct {
+	City         string    `json:"city"`
+	Endpoint     string    `json:"endpoint,omitempty"` // "local" ou URL da API remota
+	Status       string    `json:"status"`
+	Reason       string    `json:"reason,omitempty"`
+	UpdatedAtUTC time.Time `json:"updated_at_utc"`
+}
+
+// Saga é o estado persistido de uma reserva de rota feita em modo saga.
+type Saga struct {
+	ID           string                 `json:"id"` // Igual ao TransactionID
+	VehicleID    string                 `json:"vehicle_id"`
+	RequestID    string                 `json:"request_id"`
+	Route        []schemas.RouteSegment `json:"route"`
+	Status       string                 `json:"status"`
+	Reason       string                 `json:"reason,omitempty"`
+	Steps        []Step                 `json:"steps"`
+	CreatedAtUTC time.Time              `json:"created_at_utc"`
+	UpdatedAtUTC time.Time              `json:"updated_at_utc"`
+}
+
+// Store guarda as sagas coordenadas por esta API em um arquivo JSON.
+type Store struct {
+	path  string
+	sagas map[string]*Saga
+	mux   sync.Mutex
+}
+
+// Open carrega as sagas persistidas no caminho informado (ou cria um armazenamento vazio).
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("falha ao criar diretório das sagas: %w", err)
+	}
+	st := &Store{path: path, sagas: make(map[string]*Saga)}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("falha ao ler sagas de %s: %w", path, err)
+	}
+	if len(data) > 0 {
+		var sagas []*Saga
+		if err := json.Unmarshal(data, &sagas); err != nil {
+			return nil, fmt.Errorf("arquivo de sagas %s corrompido: %w", path, err)
+		}
+		for _, sg := range sagas {
+			st.sagas[sg.ID] = sg
+		}
+	}
+	log.Printf("[SagaStore] Sagas carregadas de %s (%d sagas)", path, len(st.sagas))
+	return st, nil
+}
+
+// Create registra uma nova saga em execução, com um passo PENDING por cidade da rota.
+func (st *Store) Create(id, vehicleID, requestID string, route []schemas.RouteSegment) (Saga, error) {
+	now := time.Now().UTC()
+	sg := &Saga{
+		ID:           id,
+		VehicleID:    vehicleID,
+		RequestID:    requestID,
+		Route:        route,
+		Status:       StatusRunning,
+		CreatedAtUTC: now,
+		UpdatedAtUTC: now,
+	}
+	for _, segment := range route {
+		sg.Steps = append(sg.Steps, Step{City: segment.City, Status: StepPending, UpdatedAtUTC: now})
+	}
+
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	if _, exists := st.sagas[id]; exists {
+		return Saga{}, fmt.Errorf("saga %s já existe", id)
+	}
+	st.sagas[id] = sg
+	if err := st.persistLocked(); err != nil {
+		delete(st.sagas, id)
+		return Saga{}, err
+	}
+	return cloneSaga(sg), nil
+}
+
+// UpdateStep altera o estado do passo da cidade informada e persiste a saga.
+func (st *Store) UpdateStep(id, city, endpoint, status, reason string) error {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	sg, ok := st.sagas[id]
+	if !ok {
+		return fmt.Errorf("saga %s não encontrada", id)
+	}
+	now := time.Now().UTC()
+	for i := range sg.Steps {
+		if sg.Steps[i].City != city {
+			continue
+		}
+		if endpoint != "" {
+			sg.Steps[i].Endpoint = endpoint
+		}
+		sg.Steps[i].Status = status
+		sg.Steps[i].Reason = reason
+		sg.Steps[i].UpdatedAtUTC = now
+	}
+	sg.UpdatedAtUTC = now
+	return st.persistLocked()
+}
+
+// SetStatus altera o estado geral da saga e persiste.
+func (st *Store) SetStatus(id, status, reason string) error {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	sg, ok := st.sagas[id]
+	if !ok {
+		return fmt.Errorf("saga %s não encontrada", id)
+	}
+	sg.Status = status
+	if reason != "" {
+		sg.Reason = reason
+	}
+	sg.UpdatedAtUTC = time.Now().UTC()
+	return st.persistLocked()
+}
+
+// Get retorna uma cópia da saga.
+func (st *Store) Get(id string) (Saga, bool) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	sg, ok := st.sagas[id]
+	if !ok {
+		return Saga{}, false
+	}
+	return cloneSaga(sg), true
+}
+
+// List retorna cópias de todas as sagas, da mais recente para a mais antiga.
+func (st *Store) List() []Saga {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	list := make([]Saga, 0, len(st.sagas))
+	for _, sg := range st.sagas {
+		list = append(list, cloneSaga(sg))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAtUTC.After(list[j].CreatedAtUTC) })
+	return list
+}
+
+// Prune descarta as sagas encerradas antes de cutoff: compensadas, ou concluídas com todas as
+// recargas da rota terminadas (até lá o veículo pode cancelar a rota). Retorna quantas foram descartadas.
+func (st *Store) Prune(cutoff time.Time) (int, error) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	var pruned []*Saga
+	for id, sg := range st.sagas {
+		if sg.finishedBefore(cutoff) {
+			pruned = append(pruned, sg)
+			delete(st.sagas, id)
+		}
+	}
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+	if err := st.persistLocked(); err != nil {
+		for _, sg := range pruned {
+			st.sagas[sg.ID] = sg
+		}
+		return 0, err
+	}
+	log.Printf("[SagaStore] %d sagas encerradas descartadas (%d mantidas)", len(pruned), len(st.sagas))
+	return len(pruned), nil
+}
+
+// finishedBefore indica se a saga encerrou e não mudou desde antes de cutoff.
+func (sg *Saga) finishedBefore(cutoff time.Time) bool {
+	if !sg.UpdatedAtUTC.Before(cutoff) {
+		return false
+	}
+	switch sg.Status {
+	case StatusCompensated:
+		return true
+	case StatusCompleted:
+		for _, segment := range sg.Route {
+			if !segment.ReservationWindow.EndTimeUTC.Before(cutoff) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func cloneSaga(sg *Saga) Saga {
+	clone := *sg
+	clone.Steps = append([]Step(nil), sg.Steps...)
+	clone.Route = append([]schemas.RouteSegment(nil), sg.Route...)
+	return clone
+}
+
+// persistLocked grava todas as sagas no arquivo, de forma atômica e sincronizada em disco, para que
+// a troca sobreviva a uma queda. Requer st.mux travado.
+func (st *Store) persistLocked() error {
+	sagas := make([]*Saga, 0, len(st.sagas))
+	for _, sg := range st.sagas {
+		sagas = append(sagas, sg)
+	}
+	data, err := json.MarshalIndent(sagas, "", "  ")
+	if err != nil {
+		return fmt.Errorf("falha ao serializar sagas: %w", err)
+	}
+	if err := durable.WriteFile(st.path, data); err != nil {
+		return fmt.Errorf("falha ao persistir sagas: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+// PBL-2/api/state/capacity.go
+package state
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/storage"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/google/uuid"
+)
+
+// Políticas de escolha das reservas que perdem o posto quando a capacidade da cidade diminui. As
+// reservas deslocadas são realocadas na ordem da política; as que sobram sem posto perdem a vaga.
+const (
+	VictimPolicyLatestStart = "latest-start" // As que começam mais tarde perdem primeiro: têm mais tempo para reservar de novo
+	VictimPolicyLongest     = "longest"      // As mais longas perdem primeiro: cabem menos reservas no lugar delas
+)
+
+// Motivos de recusa de uma alteração de capacidade.
+var (
+	ErrUnknownPost      = errors.New("posto não encontrado nesta cidade")
+	ErrCapacityInvalid  = errors.New("alteração de capacidade inválida")
+	ErrCapacityConflict = errors.New("alteração de capacidade em conflito")
+)
+
+// ValidVictimPolicy indica se a política de escolha das reservas deslocadas é conhecida.
+func ValidVictimPolicy(policy string) bool {
+	return policy == VictimPolicyLatestStart || policy == VictimPolicyLongest
+}
+
+// SetVictimPolicy define a política usada quando a alteração de capacidade não informa uma.
+func (m *StateManager) SetVictimPolicy(policy string) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	m.victimPolicy = policy
+}
+
+// SetDisplacedHook define quem é avisado quando a reserva de uma transação perde a vaga numa
+// redução de capacidade, para informar o coordenador. fn é chamada com o StateManager travado e
+// não deve chamar seus métodos.
+func (m *StateManager) SetDisplacedHook(fn func(res schemas.ActiveReservation)) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	m.onDisplaced = fn
+}
+
+// VictimPolicy retorna a política usada quando a alteração de capacidade não informa uma.
+func (m *StateManager) VictimPolicy() string {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	return m.victimPolicy
+}
+
+// AddPosts acrescenta à cidade os postos descritos em spec, numerados depois do maior número em
+// uso, e retorna os novos postos. As entradas da fila de espera que passam a caber recebem oferta.
+func (m *StateManager) AddPosts(spec PostSpec) ([]schemas.ChargingPoint, error) {
+	if spec.Count <= 0 {
+		return nil, fmt.Errorf("%w: a quantidade deve ser positiva", ErrCapacityInvalid)
+	}
+	if _, ok := powerLevelKW[spec.PowerLevel]; !ok {
+		return nil, fmt.Errorf("%w: nível de potência desconhecido %q", ErrCapacityInvalid, spec.PowerLevel)
+	}
+	if !knownConnectors[spec.Connector] {
+		return nil, fmt.Errorf("%w: conector desconhecido %q", ErrCapacityInvalid, spec.Connector)
+	}
+
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	next := m.nextPostNumberLocked()
+	var added []schemas.ChargingPoint
+	for i := 0; i < spec.Count; i++ {
+		added = append(added, newChargingPoint(m.ownedCity, next+i, spec))
+	}
+	m.cityData.Posts = append(m.cityData.Posts, added...)
+	m.cityData.MaxPosts = len(m.cityData.Posts)
+	m.pending = append(m.pending, storage.Record{Type: storage.RecordPosts, Posts: m.cityData.Posts})
+	log.Printf("[StateManager-%s] CAPACIDADE: %d posto(s) %s/%s acrescentado(s). Agora são %d postos.", m.ownedCity, spec.Count, spec.PowerLevel, spec.Connector, m.cityData.MaxPosts)
+	m.offerFreedPostsLocked()
+	m.persistLocked("novos postos")
+	return added, nil
+}
+
+// RemovePost tira o posto da cidade. As reservas que o ocupavam são transferidas para outro posto
+// compatível livre na mesma janela, na ordem da política (vazia: a da cidade); as que não cabem
+// perdem a vaga (ver displaceLocked). Enquanto o posto tiver reservas aguardando a decisão do
+// coordenador, a remoção é recusada com ErrCapacityConflict.
+func (m *StateManager) RemovePost(postID, policy string) (schemas.CapacityChangeResult, error) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	policy, err := m.resolvePolicyLocked(policy)
+	if err != nil {
+		return schemas.CapacityChangeResult{}, err
+	}
+	post, ok := m.postLocked(postID)
+	if !ok {
+		return schemas.CapacityChangeResult{}, fmt.Errorf("%w: %s", ErrUnknownPost, postID)
+	}
+	if len(m.cityData.Posts) == 1 {
+		return schemas.CapacityChangeResult{}, fmt.Errorf("%w: a cidade precisa de ao menos um posto", ErrCapacityInvalid)
+	}
+	if err := m.checkUndecidedLocked(postID, nil); err != nil {
+		return schemas.CapacityChangeResult{}, err
+	}
+
+	// As manutenções do posto deixam de fazer sentido
+	m.takeReservationsLocked(func(res schemas.ActiveReservation) bool {
+		if res.ChargingPointID == postID && res.Status == schemas.StatusReservationMaintenance {
+			m.deleteReservationLocked(res)
+			return true
+		}
+		return false
+	})
+	affected := m.takeReservationsLocked(func(res schemas.ActiveReservation) bool {
+		return res.ChargingPointID == postID && occupiesPost(res)
+	})
+	for i, p := range m.cityData.Posts {
+		if p.ID == postID {
+			m.cityData.Posts = append(m.cityData.Posts[:i:i], m.cityData.Posts[i+1:]...)
+			break
+		}
+	}
+	m.cityData.MaxPosts = len(m.cityData.Posts)
+	m.pending = append(m.pending, storage.Record{Type: storage.RecordPosts, Posts: m.cityData.Posts})
+	log.Printf("[StateManager-%s] CAPACIDADE: posto %s removido. Agora são %d postos; %d reserva(s) a realocar.", m.ownedCity, postID, m.cityData.MaxPosts, len(affected))
+
+	result := m.relocateLocked(affected, post, policy, "Posto "+postID+" removido")
+	m.persistLocked("remoção do posto " + postID)
+	return result, nil
+}
+
+// ScheduleMaintenance bloqueia o posto durante a janela com uma reserva MAINTENANCE. As reservas do
+// posto que cruzam a janela são transferidas ou perdem a vaga, como em RemovePost, que também
+// recusa a manutenção sobre reservas ainda não decididas.
+func (m *StateManager) ScheduleMaintenance(postID string, window schemas.ReservationWindow, policy string) (schemas.CapacityChangeResult, error) {
+	if !window.StartTimeUTC.Before(window.EndTimeUTC) {
+		return schemas.CapacityChangeResult{}, fmt.Errorf("%w: a janela termina antes de começar", ErrCapacityInvalid)
+	}
+	if !window.EndTimeUTC.After(time.Now().UTC()) {
+		return schemas.CapacityChangeResult{}, fmt.Errorf("%w: a janela já terminou", ErrCapacityInvalid)
+	}
+
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	policy, err := m.resolvePolicyLocked(policy)
+	if err != nil {
+		return schemas.CapacityChangeResult{}, err
+	}
+	post, ok := m.postLocked(postID)
+	if !ok {
+		return schemas.CapacityChangeResult{}, fmt.Errorf("%w: %s", ErrUnknownPost, postID)
+	}
+	for _, res := range m.cityData.ActiveReservations {
+		if res.ChargingPointID == postID && res.Status == schemas.StatusReservationMaintenance && windowsOverlap(res.ReservationWindow, window) {
+			return schemas.CapacityChangeResult{}, fmt.Errorf("%w: o posto já tem a manutenção %s nessa janela", ErrCapacityConflict, res.TransactionID)
+		}
+	}
+	if err := m.checkUndecidedLocked(postID, &window); err != nil {
+		return schemas.CapacityChangeResult{}, err
+	}
+
+	affected := m.takeReservationsLocked(func(res schemas.ActiveReservation) bool {
+		return res.ChargingPointID == postID && occupiesPost(res) && windowsOverlap(res.ReservationWindow, window)
+	})
+	block := schemas.ActiveReservation{
+		TransactionID:     "maintenance-" + uuid.New().String(),
+		City:              m.ownedCity,
+		ReservationWindow: window,
+		Status:            schemas.StatusReservationMaintenance,
+		ChargingPointID:   postID,
+	}
+	m.cityData.ActiveReservations = append(m.cityData.ActiveReservations, block)
+	m.index.insert(block)
+	m.putReservationLocked(block)
+	log.Printf("[StateManager-%s] CAPACIDADE: posto %s em manutenção de %s a %s (%s); %d reserva(s) a realocar.", m.ownedCity, postID, window.StartTimeUTC.Format(schemas.ISOFormat), window.EndTimeUTC.Format(schemas.ISOFormat), block.TransactionID, len(affected))
+
+	reason := fmt.Sprintf("Posto %s em manutenção de %s a %s", postID, window.StartTimeUTC.Format(schemas.ISOFormat), window.EndTimeUTC.Format(schemas.ISOFormat))
+	result := m.relocateLocked(affected, post, policy, reason)
+	result.Maintenance = &block
+	m.persistLocked("manutenção do posto " + postID)
+	return result, nil
+}
+
+// EndMaintenance encerra antes do fim a manutenção e oferece o posto à fila de espera.
+func (m *StateManager) EndMaintenance(maintenanceID string) bool {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	ended := m.takeReservationsLocked(func(res schemas.ActiveReservation) bool {
+		return res.TransactionID == maintenanceID && res.Status == schemas.StatusReservationMaintenance
+	})
+	if len(ended) == 0 {
+		return false
+	}
+	m.deleteReservationLocked(ended[0])
+	log.Printf("[StateManager-%s] CAPACIDADE: manutenção %s do posto %s encerrada pelo operador.", m.ownedCity, maintenanceID, ended[0].ChargingPointID)
+	m.offerFreedPostsLocked()
+	m.persistLocked("fim da manutenção " + maintenanceID)
+	return true
+}
+
+// Maintenance retorna as manutenções agendadas ou em andamento nos postos da cidade.
+func (m *StateManager) Maintenance() []schemas.ActiveReservation {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	var blocks []schemas.ActiveReservation
+	for _, res := range m.cityData.ActiveReservations {
+		if res.Status == schemas.StatusReservationMaintenance {
+			blocks = append(blocks, res)
+		}
+	}
+	return blocks
+}
+
+// occupiesPost indica se a reserva de um veículo ainda ocupa o posto: NO_SHOW já o liberou.
+func occupiesPost(res schemas.ActiveReservation) bool {
+	return res.Status != schemas.StatusReservationNoShow && res.Status != schemas.StatusReservationMaintenance
+}
+
+// checkUndecidedLocked recusa alterar o posto enquanto ele tiver, na janela (nil: em qualquer
+// janela), reservas PREPARED/PRECOMMITTED: o coordenador pode ainda efetivá-las, e o posto que
+// elas informaram no voto não pode mudar nem sumir antes da decisão. Requer cityDataMux travado.
+func (m *StateManager) checkUndecidedLocked(postID string, window *schemas.ReservationWindow) error {
+	var pending []string
+	for _, res := range m.cityData.ActiveReservations {
+		if res.ChargingPointID == postID && isUndecided(res.Status) && (window == nil || windowsOverlap(res.ReservationWindow, *window)) {
+			pending = append(pending, res.TransactionID)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: o posto tem reservas aguardando a decisão do coordenador (%s); tente de novo depois da decisão", ErrCapacityConflict, strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// resolvePolicyLocked retorna a política informada, ou a da cidade se vazia. Requer cityDataMux travado.
+func (m *StateManager) resolvePolicyLocked(policy string) (string, error) {
+	if policy == "" {
+		return m.victimPolicy, nil
+	}
+	if !ValidVictimPolicy(policy) {
+		return "", fmt.Errorf("%w: política desconhecida %q (use %s ou %s)", ErrCapacityInvalid, policy, VictimPolicyLatestStart, VictimPolicyLongest)
+	}
+	return policy, nil
+}
+
+// nextPostNumberLocked retorna o número seguinte ao maior número de posto em uso, para que um posto
+// novo não repita o ID de um posto existente. Requer cityDataMux travado.
+func (m *StateManager) nextPostNumberLocked() int {
+	highest := 0
+	for _, post := range m.cityData.Posts {
+		if n, err := strconv.Atoi(post.ID[strings.LastIndex(post.ID, "-")+1:]); err == nil && n > highest {
+			highest = n
+		}
+	}
+	return highest + 1
+}
+
+// takeReservationsLocked tira da lista e do índice as reservas aceitas por match e as retorna. A
+// gravação fica por conta de quem chama. Requer cityDataMux travado.
+func (m *StateManager) takeReservationsLocked(match func(schemas.ActiveReservation) bool) []schemas.ActiveReservation {
+	var taken, keptReservations []schemas.ActiveReservation
+	for _, res := range m.cityData.ActiveReservations {
+		if match(res) {
+			m.index.remove(res)
+			taken = append(taken, res)
+		} else {
+			keptReservations = append(keptReservations, res)
+		}
+	}
+	m.cityData.ActiveReservations = keptReservations
+	return taken
+}
+
+// relocateLocked tenta colocar cada reserva tirada do posto from em outro posto com o mesmo
+// conector e potência suficiente, livre durante a mesma janela. As que estão recarregando são
+// realocadas primeiro e os segmentos opcionais por último; dentro de cada grupo, vale a política.
+// Os veículos são avisados em car/reservation/event/<vehicle_id>. Requer cityDataMux travado.
+func (m *StateManager) relocateLocked(affected []schemas.ActiveReservation, from schemas.ChargingPoint, policy, reason string) schemas.CapacityChangeResult {
+	sortForRelocation(affected, policy)
+	result := schemas.CapacityChangeResult{City: m.ownedCity, Policy: policy, Moved: []schemas.ActiveReservation{}, Displaced: []schemas.ActiveReservation{}}
+	for _, res := range affected {
+		candidates := make(map[string]bool)
+		for _, post := range m.cityData.Posts {
+			if post.ID != from.ID && post.Connector == from.Connector && post.PowerKW >= res.ChargePowerKW {
+				candidates[post.ID] = true
+			}
+		}
+		alloc, err := m.allocateInWindowLocked(res.TransactionID, "", "", chargeOption{window: res.ReservationWindow, posts: candidates})
+		if err != nil {
+			m.displaceLocked(res, from, reason)
+			result.Displaced = append(result.Displaced, res)
+			continue
+		}
+		res.ChargingPointID = alloc.post.ID
+		m.cityData.ActiveReservations = append(m.cityData.ActiveReservations, res)
+		m.index.insert(res)
+		m.putReservationLocked(res)
+		result.Moved = append(result.Moved, res)
+		log.Printf("[StateManager-%s] TX[%s]: %s. Reserva do veículo %s transferida para o posto %s.", m.ownedCity, res.TransactionID, reason, res.VehicleID, res.ChargingPointID)
+		if res.Status == schemas.StatusReservationOffered {
+			if i := m.waitlistIndexLocked(res.TransactionID); i >= 0 {
+				m.waitlist[i].ChargingPointID = res.ChargingPointID
+				m.putWaitlistLocked(m.waitlist[i])
+			}
+			continue // O veículo só tem a oferta; o posto aceito é o da reserva
+		}
+		publishReservationEvent(res, fmt.Sprintf("%s; reserva transferida do posto %s para o posto %s", reason, from.ID, res.ChargingPointID))
+	}
+	return result
+}
+
+// displaceLocked tira a vaga da reserva que não coube em nenhum posto. Uma oferta da fila de espera
+// volta a esperar. As demais são canceladas nesta cidade, o veículo recebe DISPLACED e, se a janela
+// ainda não começou, entra no início da fila de espera para receber o próximo posto que vagar. O
+// coordenador da transação é avisado pelo hook de SetDisplacedHook. Requer cityDataMux travado.
+func (m *StateManager) displaceLocked(res schemas.ActiveReservation, from schemas.ChargingPoint, reason string) {
+	m.deleteReservationLocked(res)
+	if res.Status == schemas.StatusReservationOffered {
+		if i := m.waitlistIndexLocked(res.TransactionID); i >= 0 {
+			m.waitlist[i].OfferedUntilUTC, m.waitlist[i].ChargingPointID = time.Time{}, ""
+			m.putWaitlistLocked(m.waitlist[i])
+		}
+		log.Printf("[StateManager-%s] FILA DE ESPERA: %s. Oferta %s ao veículo %s desfeita; a entrada volta a esperar.", m.ownedCity, reason, res.TransactionID, res.VehicleID)
+		return
+	}
+	m.rememberOutcome(res.TransactionID, schemas.StatusCancelled)
+	message := reason + "; nenhum outro posto compatível está livre na janela e a reserva foi cancelada"
+	if now := time.Now().UTC(); now.Before(res.ReservationWindow.StartTimeUTC) {
+		entry := schemas.WaitlistEntry{
+			ID:                uuid.New().String(),
+			VehicleID:         res.VehicleID,
+			City:              m.ownedCity,
+			ReservationWindow: res.ReservationWindow,
+			Charge:            &schemas.ChargeProfile{Connector: from.Connector},
+			JoinedAtUTC:       now,
+		}
+		m.waitlist = append([]schemas.WaitlistEntry{entry}, m.waitlist...)
+		m.putWaitlistLocked(entry)
+		message += "; o veículo entrou no início da fila de espera (entrada " + entry.ID + ")"
+	}
+	log.Printf("[StateManager-%s] TX[%s]: DESLOCADA. %s. Veículo %s avisado.", m.ownedCity, res.TransactionID, reason, res.VehicleID)
+	res.Status = schemas.StatusReservationDisplaced
+	publishReservationEvent(res, message)
+	if m.onDisplaced != nil && res.CoordinatorURL != "" {
+		m.onDisplaced(res)
+	}
+}
+
+// sortForRelocation ordena as reservas deslocadas na ordem em que são realocadas: as que estão
+// recarregando, depois as obrigatórias e por fim os segmentos opcionais, cada grupo pela política.
+func sortForRelocation(reservations []schemas.ActiveReservation, policy string) {
+	rank := func(res schemas.ActiveReservation) int {
+		switch {
+		case res.Status == schemas.StatusReservationCharging:
+			return 0
+		case res.Optional:
+			return 2
+		default:
+			return 1
+		}
+	}
+	sort.SliceStable(reservations, func(i, j int) bool {
+		a, b := reservations[i], reservations[j]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		if policy == VictimPolicyLongest {
+			return a.ReservationWindow.EndTimeUTC.Sub(a.ReservationWindow.StartTimeUTC) < b.ReservationWindow.EndTimeUTC.Sub(b.ReservationWindow.StartTimeUTC)
+		}
+		return a.ReservationWindow.StartTimeUTC.Before(b.ReservationWindow.StartTimeUTC)
+	})
+}
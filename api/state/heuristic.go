@@ -0,0 +1,92 @@
+// PBL-2/api/state/heuristic.go
+package state
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// ForceDecision aplica uma decisão heurística (COMMIT ou ABORT) a uma reserva ainda não decidida,
+// sem esperar o coordenador. É o último recurso do operador para reservas PREPARED presas.
+func (m *StateManager) ForceDecision(transactionID, decision string) error {
+	if decision != schemas.DecisionCommit && decision != schemas.DecisionAbort {
+		return fmt.Errorf("decisão heurística inválida: %s", decision)
+	}
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	var keptReservations []schemas.ActiveReservation
+	found := false
+	replaced := ""
+	for _, res := range m.cityData.ActiveReservations {
+		if res.TransactionID != transactionID || !isUndecided(res.Status) {
+			keptReservations = append(keptReservations, res)
+			continue
+		}
+		found = true
+		if decision == schemas.DecisionCommit {
+			m.index.markDecided(res)
+			res.Status = schemas.StatusReservationCommitted
+			keptReservations = append(keptReservations, res)
+			m.putReservationLocked(res)
+			if res.ReplacesTransactionID != "" {
+				replaced = res.ReplacesTransactionID
+			}
+		} else {
+			m.index.remove(res)
+			m.deleteReservationLocked(res)
+		}
+	}
+	if !found {
+		return fmt.Errorf("nenhuma reserva PREPARED da transação %s em %s", transactionID, m.ownedCity)
+	}
+	m.cityData.ActiveReservations = keptReservations
+	if decision == schemas.DecisionCommit {
+		m.releaseReplacedLocked(transactionID, replaced)
+		m.rememberOutcome(transactionID, schemas.StatusReservationCommitted)
+	} else {
+		m.offerFreedPostsLocked()
+		m.rememberOutcome(transactionID, schemas.StatusAborted)
+	}
+	m.heuristics[transactionID] = decision
+	m.persistLocked("decisão heurística da TX[" + transactionID + "]")
+	log.Printf("[StateManager-%s] TX[%s]: DECISÃO HEURÍSTICA %s aplicada pelo operador.", m.ownedCity, transactionID, decision)
+	return nil
+}
+
+// RestoreHeuristic recarrega uma decisão heurística registrada antes de um reinício.
+func (m *StateManager) RestoreHeuristic(transactionID, decision string) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	m.heuristics[transactionID] = decision
+}
+
+// SetHeuristicResolvedHook define quem é avisado quando a decisão do coordenador chega para uma
+// transação com decisão heurística, concordando ou não com ela. fn é chamada com o StateManager
+// travado e não deve chamar seus métodos.
+func (m *StateManager) SetHeuristicResolvedHook(fn func(transactionID, heuristic, decision string)) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	m.onHeuristicResolved = fn
+}
+
+// checkHeuristicLocked compara a decisão do coordenador, recebida para uma transação sem reserva
+// pendente, com a decisão heurística tomada antes, e indica se elas divergem (HEURISTIC_MIXED).
+// Requer cityDataMux travado.
+func (m *StateManager) checkHeuristicLocked(transactionID, decision string) bool {
+	heuristic, ok := m.heuristics[transactionID]
+	if !ok {
+		return false
+	}
+	if m.onHeuristicResolved != nil {
+		m.onHeuristicResolved(transactionID, heuristic, decision)
+	}
+	if heuristic == decision {
+		log.Printf("[StateManager-%s] TX[%s]: Decisão do coordenador (%s) confirma a decisão heurística.", m.ownedCity, transactionID, decision)
+		return false
+	}
+	log.Printf("[StateManager-%s] TX[%s]: HEURISTIC MIXED - decisão heurística %s, mas o coordenador decidiu %s.", m.ownedCity, transactionID, heuristic, decision)
+	return true
+}
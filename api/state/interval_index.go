@@ -0,0 +1,162 @@
+// PBL-2/api/state/interval_index.go
+package state
+
+import (
+	"sort"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// interval é a parte de uma reserva que importa para a ocupação dos postos.
+type interval struct {
+	transactionID   string
+	chargingPointID string
+	start, end      time.Time // Janela semiaberta [start, end)
+	undecided       bool      // PREPARED/PRECOMMITTED: ainda pode vagar
+	priority        time.Time
+	coordinatorURL  string
+}
+
+func newInterval(res schemas.ActiveReservation) interval {
+	return interval{
+		transactionID:   res.TransactionID,
+		chargingPointID: res.ChargingPointID,
+		start:           res.ReservationWindow.StartTimeUTC,
+		end:             res.ReservationWindow.EndTimeUTC,
+		undecided:       isUndecided(res.Status),
+		priority:        res.PriorityUTC,
+		coordinatorURL:  res.CoordinatorURL,
+	}
+}
+
+// intervalIndex indexa as reservas que ocupam postos pelo início da janela. Como nenhuma janela
+// dura mais que maxDuration, as que cruzam [s, e) começam em (s-maxDuration, e): a consulta é uma
+// busca binária seguida de uma varredura só sobre as candidatas.
+type intervalIndex struct {
+	items       []interval // Ordenados por início
+	maxDuration time.Duration
+}
+
+// firstStartingAtOrAfter retorna a posição da primeira janela que começa em t ou depois.
+func (ix *intervalIndex) firstStartingAtOrAfter(t time.Time) int {
+	return sort.Search(len(ix.items), func(i int) bool { return !ix.items[i].start.Before(t) })
+}
+
+// find retorna a posição da reserva no índice, ou -1.
+func (ix *intervalIndex) find(res schemas.ActiveReservation) int {
+	window := res.ReservationWindow
+	for i := ix.firstStartingAtOrAfter(window.StartTimeUTC); i < len(ix.items) && ix.items[i].start.Equal(window.StartTimeUTC); i++ {
+		if ix.items[i].transactionID == res.TransactionID && ix.items[i].end.Equal(window.EndTimeUTC) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (ix *intervalIndex) insert(res schemas.ActiveReservation) {
+	iv := newInterval(res)
+	pos := sort.Search(len(ix.items), func(i int) bool { return iv.start.Before(ix.items[i].start) })
+	ix.items = append(ix.items, interval{})
+	copy(ix.items[pos+1:], ix.items[pos:])
+	ix.items[pos] = iv
+	if d := iv.end.Sub(iv.start); d > ix.maxDuration {
+		ix.maxDuration = d
+	}
+}
+
+func (ix *intervalIndex) remove(res schemas.ActiveReservation) {
+	pos := ix.find(res)
+	if pos < 0 {
+		return
+	}
+	removed := ix.items[pos]
+	ix.items = append(ix.items[:pos], ix.items[pos+1:]...)
+	if removed.end.Sub(removed.start) == ix.maxDuration {
+		ix.maxDuration = 0
+		for _, iv := range ix.items {
+			if d := iv.end.Sub(iv.start); d > ix.maxDuration {
+				ix.maxDuration = d
+			}
+		}
+	}
+}
+
+// markDecided registra que a reserva foi efetivada: continua ocupando o posto, mas não vaga mais.
+func (ix *intervalIndex) markDecided(res schemas.ActiveReservation) {
+	if pos := ix.find(res); pos >= 0 {
+		ix.items[pos].undecided = false
+	}
+}
+
+// overlapping retorna as reservas cuja janela cruza [start, end).
+func (ix *intervalIndex) overlapping(start, end time.Time) []interval {
+	var found []interval
+	for i := ix.firstStartingAtOrAfter(start.Add(-ix.maxDuration)); i < len(ix.items) && ix.items[i].start.Before(end); i++ {
+		if ix.items[i].end.After(start) {
+			found = append(found, ix.items[i])
+		}
+	}
+	return found
+}
+
+// neighborGaps retorna, para cada posto em posts, a folga entre a reserva anterior do posto e o
+// início da janela, e entre o fim da janela e a próxima reserva. Postos sem vizinho ficam de fora.
+// As reservas de um mesmo posto nunca se sobrepõem, então a primeira encontrada em cada direção
+// é a vizinha.
+func (ix *intervalIndex) neighborGaps(start, end time.Time, posts map[string]bool) (before, after map[string]time.Duration) {
+	before, after = make(map[string]time.Duration), make(map[string]time.Duration)
+	for i := ix.firstStartingAtOrAfter(start) - 1; i >= 0 && len(before) < len(posts); i-- {
+		iv := ix.items[i]
+		if _, seen := before[iv.chargingPointID]; posts[iv.chargingPointID] && !seen {
+			before[iv.chargingPointID] = start.Sub(iv.end)
+		}
+	}
+	for i := ix.firstStartingAtOrAfter(end); i < len(ix.items) && len(after) < len(posts); i++ {
+		iv := ix.items[i]
+		if _, seen := after[iv.chargingPointID]; posts[iv.chargingPointID] && !seen {
+			after[iv.chargingPointID] = iv.start.Sub(end)
+		}
+	}
+	return before, after
+}
+
+// peakOccupancy calcula, por varredura, o maior número de reservas simultâneas dentro de
+// [start, end) entre as aceitas por include (todas, se nil). Reservas encostadas (uma termina
+// quando a outra começa) não coexistem.
+func peakOccupancy(intervals []interval, start, end time.Time, include func(interval) bool) int {
+	type event struct {
+		at    time.Time
+		delta int
+	}
+	events := make([]event, 0, 2*len(intervals))
+	for _, iv := range intervals {
+		if include != nil && !include(iv) {
+			continue
+		}
+		from, to := iv.start, iv.end
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		if from.Before(to) {
+			events = append(events, event{from, 1}, event{to, -1})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].at.Equal(events[j].at) {
+			return events[i].at.Before(events[j].at)
+		}
+		return events[i].delta < events[j].delta // Saídas antes das entradas no mesmo instante
+	})
+	peak, current := 0, 0
+	for _, ev := range events {
+		current += ev.delta
+		if current > peak {
+			peak = current
+		}
+	}
+	return peak
+}
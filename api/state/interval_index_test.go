@@ -0,0 +1,202 @@
+// PBL-2/api/state/interval_index_test.go
+package state
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+var base = time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+
+// at retorna o instante base + minutos.
+func at(minutes int) time.Time {
+	return base.Add(time.Duration(minutes) * time.Minute)
+}
+
+func reservation(transactionID, post string, from, to int, status string) schemas.ActiveReservation {
+	return schemas.ActiveReservation{
+		TransactionID:     transactionID,
+		ChargingPointID:   post,
+		Status:            status,
+		ReservationWindow: schemas.ReservationWindow{StartTimeUTC: at(from), EndTimeUTC: at(to)},
+	}
+}
+
+func indexOf(reservations ...schemas.ActiveReservation) *intervalIndex {
+	ix := &intervalIndex{}
+	for _, res := range reservations {
+		ix.insert(res)
+	}
+	return ix
+}
+
+func transactionIDs(intervals []interval) []string {
+	ids := make([]string, 0, len(intervals))
+	for _, iv := range intervals {
+		ids = append(ids, iv.transactionID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestIntervalIndexOverlapping(t *testing.T) {
+	ix := indexOf(
+		reservation("a", "P-01", 0, 60, schemas.StatusReservationCommitted),
+		reservation("b", "P-02", 30, 90, schemas.StatusReservationPrepared),
+		reservation("c", "P-01", 60, 120, schemas.StatusReservationCommitted),
+		reservation("long", "P-03", -300, 45, schemas.StatusReservationCommitted),
+	)
+	tests := []struct {
+		name     string
+		from, to int
+		want     []string
+	}{
+		{"começa quando a termina", 60, 70, []string{"b", "c"}},
+		{"termina quando c começa", 50, 60, []string{"a", "b"}},
+		{"antes de tudo", -400, -300, []string{}},
+		{"janela longa começando bem antes", 40, 41, []string{"a", "b", "long"}},
+		{"depois de tudo", 120, 180, []string{}},
+		{"cobre todas", -300, 120, []string{"a", "b", "c", "long"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transactionIDs(ix.overlapping(at(tt.from), at(tt.to))); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("overlapping(%d, %d) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntervalIndexMaxDurationOnRemove(t *testing.T) {
+	short := reservation("short", "P-01", 0, 30, schemas.StatusReservationCommitted)
+	long := reservation("long", "P-02", 0, 240, schemas.StatusReservationCommitted)
+	medium := reservation("medium", "P-03", 100, 160, schemas.StatusReservationCommitted)
+	tests := []struct {
+		name    string
+		remove  []schemas.ActiveReservation
+		want    time.Duration
+		overlap []string // Reservas que cruzam [200, 210) depois das remoções
+	}{
+		{"sem remoção", nil, 240 * time.Minute, []string{"long"}},
+		{"remove a mais longa", []schemas.ActiveReservation{long}, 60 * time.Minute, []string{}},
+		{"remove uma mais curta", []schemas.ActiveReservation{short}, 240 * time.Minute, []string{"long"}},
+		{"remove todas", []schemas.ActiveReservation{long, medium, short}, 0, []string{}},
+		{"remove desconhecida", []schemas.ActiveReservation{reservation("x", "P-01", 0, 240, "")}, 240 * time.Minute, []string{"long"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ix := indexOf(short, long, medium)
+			for _, res := range tt.remove {
+				ix.remove(res)
+			}
+			if ix.maxDuration != tt.want {
+				t.Errorf("maxDuration = %s, want %s", ix.maxDuration, tt.want)
+			}
+			if got := transactionIDs(ix.overlapping(at(200), at(210))); !reflect.DeepEqual(got, tt.overlap) {
+				t.Errorf("overlapping(200, 210) = %v, want %v", got, tt.overlap)
+			}
+		})
+	}
+}
+
+func TestIntervalIndexMarkDecided(t *testing.T) {
+	res := reservation("a", "P-01", 0, 60, schemas.StatusReservationPrepared)
+	ix := indexOf(res)
+	if !ix.items[0].undecided {
+		t.Fatal("reserva PREPARED indexada como decidida")
+	}
+	ix.markDecided(res)
+	if ix.items[0].undecided {
+		t.Error("markDecided não marcou a reserva como decidida")
+	}
+}
+
+func TestIntervalIndexNeighborGaps(t *testing.T) {
+	ix := indexOf(
+		reservation("a1", "P-01", 0, 50, schemas.StatusReservationCommitted),
+		reservation("a0", "P-01", -100, -60, schemas.StatusReservationCommitted),
+		reservation("a2", "P-01", 150, 200, schemas.StatusReservationCommitted),
+		reservation("b1", "P-02", 60, 100, schemas.StatusReservationCommitted),
+		reservation("c1", "P-03", 20, 40, schemas.StatusReservationCommitted),
+		reservation("c2", "P-03", 130, 140, schemas.StatusReservationCommitted),
+	)
+	tests := []struct {
+		name          string
+		from, to      int
+		posts         []string
+		before, after map[string]time.Duration
+	}{
+		{
+			name: "vizinhas mais próximas em cada posto", from: 100, to: 120, posts: []string{"P-01", "P-02", "P-03"},
+			before: map[string]time.Duration{"P-01": 50 * time.Minute, "P-02": 0, "P-03": 60 * time.Minute},
+			after:  map[string]time.Duration{"P-01": 30 * time.Minute, "P-03": 10 * time.Minute},
+		},
+		{
+			name: "só os postos pedidos", from: 100, to: 120, posts: []string{"P-02"},
+			before: map[string]time.Duration{"P-02": 0},
+			after:  map[string]time.Duration{},
+		},
+		{
+			name: "encostada nas duas vizinhas", from: 50, to: 150, posts: []string{"P-01"},
+			before: map[string]time.Duration{"P-01": 0},
+			after:  map[string]time.Duration{"P-01": 0},
+		},
+		{
+			name: "antes de todas", from: -200, to: -150, posts: []string{"P-01", "P-02"},
+			before: map[string]time.Duration{},
+			after:  map[string]time.Duration{"P-01": 50 * time.Minute, "P-02": 210 * time.Minute},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posts := make(map[string]bool)
+			for _, post := range tt.posts {
+				posts[post] = true
+			}
+			before, after := ix.neighborGaps(at(tt.from), at(tt.to), posts)
+			if !reflect.DeepEqual(before, tt.before) {
+				t.Errorf("before = %v, want %v", before, tt.before)
+			}
+			if !reflect.DeepEqual(after, tt.after) {
+				t.Errorf("after = %v, want %v", after, tt.after)
+			}
+		})
+	}
+}
+
+func TestPeakOccupancy(t *testing.T) {
+	intervals := []interval{
+		newInterval(reservation("a", "P-01", 0, 60, schemas.StatusReservationCommitted)),
+		newInterval(reservation("b", "P-02", 60, 120, schemas.StatusReservationPrepared)),
+		newInterval(reservation("c", "P-03", 30, 90, schemas.StatusReservationCommitted)),
+		newInterval(reservation("d", "P-04", 100, 110, schemas.StatusReservationPreCommitted)),
+	}
+	decided := func(iv interval) bool { return !iv.undecided }
+	tests := []struct {
+		name     string
+		from, to int
+		include  func(interval) bool
+		want     int
+	}{
+		{"encostadas não coexistem", 0, 120, func(iv interval) bool { return iv.transactionID == "a" || iv.transactionID == "b" }, 1},
+		{"pico com sobreposição", 0, 120, nil, 2},
+		{"janela antes de c", 0, 30, nil, 1},
+		{"recorte encostado no fim de a", 60, 61, nil, 2},
+		{"b e d juntas", 100, 110, nil, 2},
+		{"só decididas", 0, 120, decided, 2},
+		{"só decididas depois de a", 90, 120, decided, 0},
+		{"janela vazia", 50, 50, nil, 0},
+		{"nenhuma reserva", 0, 120, func(interval) bool { return false }, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := peakOccupancy(intervals, at(tt.from), at(tt.to), tt.include); got != tt.want {
+				t.Errorf("peakOccupancy(%d, %d) = %d, want %d", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
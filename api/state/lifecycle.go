@@ -0,0 +1,142 @@
+// PBL-2/api/state/lifecycle.go
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// DefaultNoShowGrace é quanto tempo depois do início da janela o veículo ainda pode fazer check-in
+// antes de a reserva ser marcada NO_SHOW.
+const DefaultNoShowGrace = 15 * time.Minute
+
+// Motivos de recusa de um check-in.
+var (
+	ErrNoReservation  = errors.New("nenhuma reserva efetivada da transação nesta cidade")
+	ErrCheckInRefused = errors.New("check-in recusado")
+)
+
+// SetNoShowGrace define a tolerância para o check-in depois do início da janela.
+func (m *StateManager) SetNoShowGrace(grace time.Duration) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	m.noShowGrace = grace
+}
+
+// NoShowGrace retorna a tolerância para o check-in depois do início da janela.
+func (m *StateManager) NoShowGrace() time.Duration {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	return m.noShowGrace
+}
+
+// CheckIn registra a chegada do veículo ao posto reservado: a reserva efetivada passa a CHARGING
+// e o veículo é avisado. Só vale dentro da janela reservada; repetir o check-in retorna a mesma
+// reserva.
+func (m *StateManager) CheckIn(transactionID, vehicleID string) (schemas.ActiveReservation, error) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	now := time.Now().UTC()
+	for i, res := range m.cityData.ActiveReservations {
+		if res.TransactionID != transactionID || isUndecided(res.Status) {
+			continue
+		}
+		window := res.ReservationWindow
+		switch {
+		case res.VehicleID != vehicleID:
+			return schemas.ActiveReservation{}, fmt.Errorf("%w: a reserva pertence a outro veículo", ErrCheckInRefused)
+		case res.Status == schemas.StatusReservationCharging:
+			return res, nil
+		case res.Status == schemas.StatusReservationOffered:
+			return schemas.ActiveReservation{}, fmt.Errorf("%w: a oferta da fila de espera ainda não foi aceita", ErrCheckInRefused)
+		case res.Status == schemas.StatusReservationNoShow:
+			return schemas.ActiveReservation{}, fmt.Errorf("%w: a reserva foi marcada NO_SHOW e o posto %s liberado", ErrCheckInRefused, res.ChargingPointID)
+		case now.Before(window.StartTimeUTC):
+			return schemas.ActiveReservation{}, fmt.Errorf("%w: a janela da reserva começa às %s", ErrCheckInRefused, window.StartTimeUTC.Format(schemas.ISOFormat))
+		case !now.Before(window.EndTimeUTC):
+			return schemas.ActiveReservation{}, fmt.Errorf("%w: a janela da reserva já terminou", ErrCheckInRefused)
+		}
+		m.cityData.ActiveReservations[i].Status = schemas.StatusReservationCharging
+		m.putReservationLocked(m.cityData.ActiveReservations[i])
+		m.persistLocked("check-in da TX[" + transactionID + "]")
+		res = m.cityData.ActiveReservations[i]
+		log.Printf("[StateManager-%s] TX[%s]: CHECK-IN do veículo %s. Recarga iniciada no posto %s.", m.ownedCity, transactionID, vehicleID, res.ChargingPointID)
+		publishReservationEvent(res, "Recarga iniciada no posto "+res.ChargingPointID)
+		return res, nil
+	}
+	return schemas.ActiveReservation{}, ErrNoReservation
+}
+
+// CheckOut encerra a recarga antes do fim da janela: a reserva CHARGING é removida, o veículo
+// recebe o aviso de fim e o posto é oferecido à fila de espera.
+func (m *StateManager) CheckOut(transactionID, vehicleID string) error {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	for i, res := range m.cityData.ActiveReservations {
+		if res.TransactionID != transactionID || res.Status != schemas.StatusReservationCharging {
+			continue
+		}
+		if res.VehicleID != vehicleID {
+			return fmt.Errorf("%w: a reserva pertence a outro veículo", ErrCheckInRefused)
+		}
+		m.index.remove(res)
+		m.deleteReservationLocked(res)
+		m.cityData.ActiveReservations = append(m.cityData.ActiveReservations[:i], m.cityData.ActiveReservations[i+1:]...)
+		publishReservationEnd(res, time.Now().UTC(), "Recarga encerrada antes do fim da janela")
+		log.Printf("[StateManager-%s] TX[%s]: CHECK-OUT do veículo %s. Posto %s liberado antes do fim da janela.", m.ownedCity, transactionID, vehicleID, res.ChargingPointID)
+		m.offerFreedPostsLocked()
+		m.persistLocked("check-out da TX[" + transactionID + "]")
+		return nil
+	}
+	return ErrNoReservation
+}
+
+// markNoShowsLocked marca NO_SHOW as reservas efetivadas sem check-in depois da tolerância e libera
+// os postos delas. A reserva continua listada até o fim da janela. Requer cityDataMux travado.
+func (m *StateManager) markNoShowsLocked(now time.Time) {
+	for i, res := range m.cityData.ActiveReservations {
+		if res.Status != schemas.StatusReservationCommitted || !now.After(res.ReservationWindow.StartTimeUTC.Add(m.noShowGrace)) {
+			continue
+		}
+		m.index.remove(res)
+		m.cityData.ActiveReservations[i].Status = schemas.StatusReservationNoShow
+		m.putReservationLocked(m.cityData.ActiveReservations[i])
+		log.Printf("[StateManager-%s] TX[%s]: NO_SHOW do veículo %s. Posto %s liberado.", m.ownedCity, res.TransactionID, res.VehicleID, res.ChargingPointID)
+		publishReservationEvent(m.cityData.ActiveReservations[i], fmt.Sprintf("Check-in não feito até %s depois do início da janela; posto liberado", m.noShowGrace))
+	}
+}
+
+// publishReservationEnd avisa o veículo do fim da reserva, no tópico de fim de reserva.
+func publishReservationEnd(res schemas.ActiveReservation, end time.Time, message string) {
+	endMessage := schemas.ReservationEndMessage{
+		VehicleID:     res.VehicleID,
+		TransactionID: res.TransactionID,
+		EndTimeUTC:    end,
+		Message:       message,
+	}
+	payloadBytes, _ := json.Marshal(endMessage)
+	mqtt.Publish(fmt.Sprintf("car/reservation/end/%s", res.VehicleID), string(payloadBytes))
+}
+
+// publishReservationEvent avisa o veículo da mudança de estado da reserva.
+func publishReservationEvent(res schemas.ActiveReservation, message string) {
+	event := schemas.ReservationEventMessage{
+		VehicleID:       res.VehicleID,
+		TransactionID:   res.TransactionID,
+		City:            res.City,
+		ChargingPointID: res.ChargingPointID,
+		Status:          res.Status,
+		Message:         message,
+		TimeUTC:         time.Now().UTC(),
+	}
+	payloadBytes, _ := json.Marshal(event)
+	mqtt.Publish(fmt.Sprintf("car/reservation/event/%s", res.VehicleID), string(payloadBytes))
+}
@@ -2,6 +2,7 @@
 package state
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -9,22 +10,61 @@ import (
 	"encoding/json"
 
   "github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/api/storage"
 	"github.com/4r7hur0/PBL-2/schemas" 
 )
 
+// isUndecided indica se a reserva ainda aguarda a decisão final (PREPARED no 2PC; PREPARED ou PRECOMMITTED no 3PC).
+func isUndecided(status string) bool {
+	return status == schemas.StatusReservationPrepared || status == schemas.StatusReservationPreCommitted
+}
+
 func windowsOverlap(r1 schemas.ReservationWindow, r2 schemas.ReservationWindow) bool {
 	return r1.StartTimeUTC.Before(r2.EndTimeUTC) && r1.EndTimeUTC.After(r2.StartTimeUTC)
 }
 
 type CityState struct {
 	MaxPosts           int
+	Posts              []schemas.ChargingPoint // Postos da cidade; MaxPosts == len(Posts)
 	ActiveReservations []schemas.ActiveReservation
 }
 
+// DefaultPrepareLease é o tempo que uma reserva PREPARED fica garantida antes de ser resolvida.
+const DefaultPrepareLease = 30 * time.Second
+
+// maxRememberedOutcomes limita quantos resultados de transações já resolvidas ficam em memória.
+const maxRememberedOutcomes = storage.MaxOutcomes
+
 type StateManager struct {
-	ownedCity   string 
-	cityData    *CityState
-	cityDataMux *sync.Mutex
+	ownedCity    string 
+	cityData     *CityState
+	cityDataMux  *sync.Mutex
+	prepareLease time.Duration
+	noShowGrace  time.Duration // Tolerância depois do início da janela antes de marcar NO_SHOW
+	index        intervalIndex // Reservas que ocupam postos, para a verificação de capacidade
+
+	// Resultado (COMMITTED/ABORTED) das transações já resolvidas nesta cidade, para responder
+	// consultas mesmo depois que a reserva foi removida. outcomeOrder guarda a ordem de inserção.
+	outcomes     map[string]string
+	outcomeOrder []string
+
+	// Decisões heurísticas tomadas por um operador (ver ForceDecision) e quem avisar quando a
+	// decisão do coordenador chegar diferente.
+	heuristics          map[string]string
+	onHeuristicResolved func(transactionID, heuristic, decision string)
+
+	// Onde o estado da cidade é gravado (ver UseStorage) e as alterações ainda não gravadas.
+	store   storage.Storage
+	pending []storage.Record
+
+	// Fila de espera por janelas lotadas, na ordem de chegada, e o prazo de cada oferta.
+	waitlist     []schemas.WaitlistEntry
+	offerTimeout time.Duration
+
+	// Política de escolha das reservas que perdem o posto quando a capacidade diminui, e quem
+	// avisar quando a reserva de uma transação perde a vaga (ver SetDisplacedHook).
+	victimPolicy string
+	onDisplaced  func(res schemas.ActiveReservation)
 }
 
 func NewStateManager(ownedCity string, initialPostsForOwnedCity int) *StateManager {
@@ -33,74 +73,370 @@ func NewStateManager(ownedCity string, initialPostsForOwnedCity int) *StateManag
 		ownedCity: ownedCity,
 		cityData: &CityState{
 			MaxPosts:           initialPostsForOwnedCity,
+			Posts:              newChargingPoints(ownedCity, defaultPostSpecs(initialPostsForOwnedCity)),
 			ActiveReservations: []schemas.ActiveReservation{},
 		},
-		cityDataMux: &sync.Mutex{},
+		cityDataMux:  &sync.Mutex{},
+		prepareLease: DefaultPrepareLease,
+		noShowGrace:  DefaultNoShowGrace,
+		outcomes:     make(map[string]string),
+		heuristics:   make(map[string]string),
+		store:        storage.NewMemory(),
+		offerTimeout: DefaultWaitlistOfferTimeout,
+		victimPolicy: VictimPolicyLatestStart,
 	}
 }
 
-// PrepareReservation verifica e "pré-aloca" um posto na cidade gerenciada.
-func (m *StateManager) PrepareReservation(transactionID, vehicleID, requestID string, window schemas.ReservationWindow) (bool, error) {
+// SetPrepareLease define a duração da concessão dada a novas reservas PREPARED.
+func (m *StateManager) SetPrepareLease(lease time.Duration) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	m.prepareLease = lease
+}
+
+// PrepareLease retorna a duração da concessão das reservas PREPARED.
+func (m *StateManager) PrepareLease() time.Duration {
 	m.cityDataMux.Lock()
 	defer m.cityDataMux.Unlock()
+	return m.prepareLease
+}
 
-	overlappingCount := 0
-	for _, existingRes := range m.cityData.ActiveReservations {
-		if existingRes.Status == schemas.StatusReservationCommitted ||
-			(existingRes.Status == schemas.StatusReservationPrepared && existingRes.TransactionID != transactionID) {
-			if windowsOverlap(existingRes.ReservationWindow, window) {
-				overlappingCount++
-			}
+// PrepareReservation verifica e "pré-aloca" um posto na cidade gerenciada, retornando a reserva
+// com o posto escolhido. A pré-alocação vale até PreparedUntilUTC; depois disso ela é resolvida
+// junto ao coordenador. Repetir o PREPARE retorna a mesma reserva.
+func (m *StateManager) PrepareReservation(req schemas.RemotePrepareRequest) (schemas.ActiveReservation, error) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	transactionID := req.TransactionID
+
+	for _, res := range m.cityData.ActiveReservations {
+		// A janela reservada pode ter sido ajustada à potência do posto; só o início é o pedido
+		if res.TransactionID == transactionID && isUndecided(res.Status) && res.ReservationWindow.StartTimeUTC.Equal(req.ReservationWindow.StartTimeUTC) {
+			log.Printf("[StateManager-%s] TX[%s]: PREPARE repetido; reserva já existe no posto %s.", m.ownedCity, transactionID, res.ChargingPointID)
+			return res, nil
 		}
 	}
-
-	if overlappingCount >= m.cityData.MaxPosts {
-		errMsg := fmt.Sprintf("conflito de horário ou capacidade máxima (%d/%d) atingida para a cidade %s na janela solicitada", overlappingCount, m.cityData.MaxPosts, m.ownedCity)
-		log.Printf("[StateManager-%s] TX[%s]: FALHA PREPARE - %s", m.ownedCity, transactionID, errMsg)
-		return false, fmt.Errorf(errMsg)
+	alloc, err := m.allocatePostLocked(req)
+	if err != nil {
+		log.Printf("[StateManager-%s] TX[%s]: FALHA PREPARE - %v", m.ownedCity, transactionID, err)
+		return schemas.ActiveReservation{}, err
 	}
 
 	// Adiciona a nova reserva como PREPARED
 	newRes := schemas.ActiveReservation{
-		TransactionID:     transactionID,
-		VehicleID:         vehicleID,
-		RequestID:         requestID,
-		City:              m.ownedCity, // Sempre a cidade gerenciada
-		ReservationWindow: window,
-		Status:            schemas.StatusReservationPrepared,
+		TransactionID:         transactionID,
+		VehicleID:             req.VehicleID,
+		RequestID:             req.RequestID,
+		City:                  m.ownedCity, // Sempre a cidade gerenciada
+		ReservationWindow:     alloc.window,
+		Status:                schemas.StatusReservationPrepared,
+		PreparedUntilUTC:      time.Now().UTC().Add(m.prepareLease),
+		CoordinatorURL:        req.CoordinatorURL,
+		ParticipantCities:     req.ParticipantCities,
+		Protocol:              req.Protocol,
+		PriorityUTC:           req.PriorityUTC,
+		Optional:              req.Optional,
+		ChargingPointID:       alloc.post.ID,
+		ChargePowerKW:         chargePower(alloc.post, req.Charge),
+		ReplacesTransactionID: req.ReplacesTransactionID,
+	}
+	// Só conta como pré-alocada depois de gravada: o voto SIM não pode ser esquecido num reinício
+	m.putReservationLocked(newRes)
+	if err := m.flushLocked(); err != nil {
+		log.Printf("[StateManager-%s] TX[%s]: FALHA PREPARE - %v", m.ownedCity, transactionID, err)
+		return schemas.ActiveReservation{}, err
+	}
+	m.cityData.ActiveReservations = append(m.cityData.ActiveReservations, newRes)
+	m.index.insert(newRes)
+	log.Printf("[StateManager-%s] TX[%s]: SUCESSO PREPARE no posto %s. %d postos ocupados na janela. Reserva: %+v", m.ownedCity, transactionID, alloc.post.ID, alloc.peak+1, newRes)
+	return newRes, nil
+}
+
+// allocation é o posto escolhido para uma reserva e a janela que a recarga ocupa nele.
+type allocation struct {
+	post   schemas.ChargingPoint
+	window schemas.ReservationWindow
+	peak   int // Ocupação máxima atual da janela, sem contar a nova reserva
+}
+
+// allocatePostLocked escolhe o posto em que a transação vai ocupar a janela: entre os postos
+// compatíveis com o veículo, os de recarga mais rápida primeiro e, entre eles, o preferido, se
+// livre, ou o de melhor encaixe. Requer cityDataMux travado.
+func (m *StateManager) allocatePostLocked(req schemas.RemotePrepareRequest) (allocation, error) {
+	// Uma requisição atrasada não pode ressuscitar uma transação que esta cidade já resolveu
+	if outcome, resolved := m.outcomes[req.TransactionID]; resolved {
+		return allocation{}, fmt.Errorf("transação já resolvida nesta cidade com resultado %s", outcome)
+	}
+	options := m.chargeOptionsLocked(req.ReservationWindow, req.Charge)
+	if len(options) == 0 && len(m.cityData.Posts) > 0 {
+		return allocation{}, fmt.Errorf("nenhum posto de %s é compatível com o conector %s", m.ownedCity, req.Charge.Connector)
+	}
+	if len(options) == 0 {
+		return allocation{}, fmt.Errorf("a cidade %s não tem postos", m.ownedCity)
+	}
+	// O posto preferido, se compatível, é tentado antes dos mais rápidos
+	for i, option := range options {
+		if option.posts[req.ChargingPointID] {
+			options = append(append([]chargeOption{option}, options[:i]...), options[i+1:]...)
+			break
+		}
+	}
+
+	var firstErr error
+	var conflict *ConflictError
+	for _, option := range options {
+		alloc, err := m.allocateInWindowLocked(req.TransactionID, req.ReplacesTransactionID, req.ChargingPointID, option)
+		if err == nil {
+			return alloc, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if conflict == nil {
+			errors.As(err, &conflict)
+		}
+	}
+	if conflict != nil {
+		return allocation{}, conflict
+	}
+	return allocation{}, firstErr
+}
+
+// allocateInWindowLocked procura, entre os postos da opção, um livre durante toda a janela dela e
+// retorna também a ocupação máxima atual da janela. As reservas efetivadas da transação remarcada
+// (replaces) não contam: são liberadas no COMMIT. Requer cityDataMux travado.
+func (m *StateManager) allocateInWindowLocked(transactionID, replaces, preferred string, option chargeOption) (allocation, error) {
+	window := option.window
+	var overlapping []interval
+	var undecided []schemas.PrepareConflict
+	for _, existing := range m.index.overlapping(window.StartTimeUTC, window.EndTimeUTC) {
+		if existing.undecided && existing.transactionID == transactionID {
+			continue // PREPARE repetido da mesma transação
+		}
+		if replaces != "" && !existing.undecided && existing.transactionID == replaces {
+			continue // Reserva que a remarcação substitui
+		}
+		overlapping = append(overlapping, existing)
+		if existing.undecided {
+			undecided = append(undecided, schemas.PrepareConflict{
+				TransactionID:  existing.transactionID,
+				PriorityUTC:    existing.priority,
+				CoordinatorURL: existing.coordinatorURL,
+			})
+		}
+	}
+
+	// Ocupação máxima simultânea dentro da janela, não o total de reservas que a cruzam
+	peak := peakOccupancy(overlapping, window.StartTimeUTC, window.EndTimeUTC, nil)
+	// A reserva fica em um único posto, que precisa estar livre durante a janela inteira
+	free, freeOnceDecided := freePosts(overlapping, option.posts, false), freePosts(overlapping, option.posts, true)
+	if peak < m.cityData.MaxPosts && len(free) > 0 {
+		post, _ := m.postLocked(m.bestFitPostLocked(preferred, window, free))
+		return allocation{post: post, window: window, peak: peak}, nil
+	}
+
+	err := fmt.Errorf("conflito de horário ou capacidade máxima (%d/%d) atingida para a cidade %s na janela solicitada", peak, m.cityData.MaxPosts, m.ownedCity)
+	if peak < m.cityData.MaxPosts {
+		err = fmt.Errorf("nenhum posto compatível de %s fica livre durante toda a janela solicitada (%d/%d ocupados no pico)", m.ownedCity, peak, m.cityData.MaxPosts)
+	}
+	decidedPeak := peakOccupancy(overlapping, window.StartTimeUTC, window.EndTimeUTC, func(iv interval) bool { return !iv.undecided })
+	if len(undecided) > 0 && decidedPeak < m.cityData.MaxPosts && len(freeOnceDecided) > 0 {
+		// Um posto pode vagar quando as reservas ainda não decididas forem resolvidas
+		return allocation{peak: peak}, &ConflictError{Reason: err.Error(), Conflicts: undecided}
+	}
+	return allocation{peak: peak}, err
+}
+
+// freePosts retorna os postos candidatos sem nenhuma das reservas informadas; com decidedOnly,
+// as reservas ainda não decididas são ignoradas.
+func freePosts(overlapping []interval, candidates map[string]bool, decidedOnly bool) map[string]bool {
+	busy := make(map[string]bool)
+	for _, iv := range overlapping {
+		if !decidedOnly || !iv.undecided {
+			busy[iv.chargingPointID] = true
+		}
+	}
+	free := make(map[string]bool)
+	for id := range candidates {
+		if !busy[id] {
+			free[id] = true
+		}
+	}
+	return free
+}
+
+// ConflictError indica que o posto pedido está ocupado apenas por reservas ainda não decididas
+// de outras transações; o coordenador pode esperar por elas ou feri-las (wait-die/wound-wait).
+type ConflictError struct {
+	Reason    string
+	Conflicts []schemas.PrepareConflict
+}
+
+func (e *ConflictError) Error() string {
+	return e.Reason
+}
+
+// ReserveDirect reserva um posto já como COMMITTED, sem fase de preparação (passo de uma saga), e
+// retorna a reserva. Repetir a chamada para uma transação já reservada não cria uma segunda reserva.
+func (m *StateManager) ReserveDirect(req schemas.RemotePrepareRequest) (schemas.ActiveReservation, error) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	for _, res := range m.cityData.ActiveReservations {
+		if res.TransactionID == req.TransactionID && !isUndecided(res.Status) {
+			log.Printf("[StateManager-%s] TX[%s]: RESERVA DIRETA repetida; reserva já existe.", m.ownedCity, req.TransactionID)
+			return res, nil
+		}
+	}
+	alloc, err := m.allocatePostLocked(req)
+	if err != nil {
+		log.Printf("[StateManager-%s] TX[%s]: FALHA RESERVA DIRETA - %v", m.ownedCity, req.TransactionID, err)
+		return schemas.ActiveReservation{}, err
+	}
+	newRes := schemas.ActiveReservation{
+		TransactionID:     req.TransactionID,
+		VehicleID:         req.VehicleID,
+		RequestID:         req.RequestID,
+		City:              m.ownedCity,
+		ReservationWindow: alloc.window,
+		Status:            schemas.StatusReservationCommitted,
+		CoordinatorURL:    req.CoordinatorURL,
+		ParticipantCities: req.ParticipantCities,
+		ChargingPointID:   alloc.post.ID,
+		ChargePowerKW:     chargePower(alloc.post, req.Charge),
+	}
+	m.putReservationLocked(newRes)
+	m.recordOutcomeLocked(req.TransactionID, schemas.StatusReservationCommitted)
+	if err := m.flushLocked(); err != nil {
+		log.Printf("[StateManager-%s] TX[%s]: FALHA RESERVA DIRETA - %v", m.ownedCity, req.TransactionID, err)
+		return schemas.ActiveReservation{}, err
 	}
 	m.cityData.ActiveReservations = append(m.cityData.ActiveReservations, newRes)
-	log.Printf("[StateManager-%s] TX[%s]: SUCESSO PREPARE. %d postos ocupados na janela. Reserva: %+v", m.ownedCity, transactionID, overlappingCount+1, newRes)
-	return true, nil
+	m.index.insert(newRes)
+	m.applyOutcome(req.TransactionID, schemas.StatusReservationCommitted)
+	log.Printf("[StateManager-%s] TX[%s]: SUCESSO RESERVA DIRETA no posto %s. %d postos ocupados na janela. Reserva: %+v", m.ownedCity, req.TransactionID, alloc.post.ID, alloc.peak+1, newRes)
+	return newRes, nil
+}
+
+// CancelReservation remove as reservas da transação nesta cidade, efetivadas ou não.
+// O cancelamento é lembrado mesmo sem reserva, para recusar uma requisição que chegue atrasada.
+func (m *StateManager) CancelReservation(transactionID string) bool {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	var keptReservations []schemas.ActiveReservation
+	cancelled := false
+	for _, res := range m.cityData.ActiveReservations {
+		if res.TransactionID == transactionID {
+			log.Printf("[StateManager-%s] TX[%s]: SUCESSO CANCELAMENTO. Removendo reserva: %+v", m.ownedCity, transactionID, res)
+			m.index.remove(res)
+			m.deleteReservationLocked(res)
+			cancelled = true
+		} else {
+			keptReservations = append(keptReservations, res)
+		}
+	}
+	m.cityData.ActiveReservations = keptReservations
+	if !cancelled {
+		log.Printf("[StateManager-%s] TX[%s]: AVISO CANCELAMENTO - Nenhuma reserva encontrada para este TransactionID.", m.ownedCity, transactionID)
+	} else {
+		m.offerFreedPostsLocked()
+	}
+	m.rememberOutcome(transactionID, schemas.StatusCancelled)
+	m.persistLocked("CANCELAMENTO da TX[" + transactionID + "]")
+	return cancelled
 }
 
-func (m *StateManager) CommitReservation(transactionID string) {
+// CommitReservation efetiva as reservas PREPARED da transação e retorna o resultado local: COMMITTED,
+// também para um COMMIT repetido, HEURISTIC_MIXED se um operador já tinha forçado o ABORT, ou o que
+// a cidade já sabe da transação (ABORTED, CANCELLED, UNKNOWN) quando não há reserva a efetivar.
+// Só COMMITTED e HEURISTIC_MIXED confirmam a decisão ao coordenador: a decisão heurística não
+// pode mais ser desfeita, e repetir o COMMIT não mudaria nada.
+func (m *StateManager) CommitReservation(transactionID string) string {
 	m.cityDataMux.Lock()
 	defer m.cityDataMux.Unlock()
 
 	found := false
+	replaced := ""
 	for i, res := range m.cityData.ActiveReservations {
-		if res.TransactionID == transactionID && res.Status == schemas.StatusReservationPrepared {
+		if res.TransactionID == transactionID && isUndecided(res.Status) {
 			m.cityData.ActiveReservations[i].Status = schemas.StatusReservationCommitted
+			m.index.markDecided(res)
+			m.putReservationLocked(m.cityData.ActiveReservations[i])
 			log.Printf("[StateManager-%s] TX[%s]: SUCESSO COMMIT. Reserva: %+v", m.ownedCity, transactionID, m.cityData.ActiveReservations[i])
 			found = true
+			if res.ReplacesTransactionID != "" {
+				replaced = res.ReplacesTransactionID
+			}
 			// Não precisa retornar, pode haver múltiplos segmentos para a mesma TX (embora não neste modelo de cidade única por API)
 		}
 	}
 	if !found {
-		log.Printf("[StateManager-%s] TX[%s]: AVISO COMMIT - Nenhuma reserva PREPARED encontrada para este TransactionID.", m.ownedCity, transactionID)
+		outcome := m.transactionStatusLocked(transactionID)
+		if outcome != schemas.StatusReservationCommitted {
+			log.Printf("[StateManager-%s] TX[%s]: AVISO COMMIT - Nenhuma reserva PREPARED encontrada para este TransactionID (resultado local: %s).", m.ownedCity, transactionID, outcome)
+		}
+		if m.checkHeuristicLocked(transactionID, schemas.DecisionCommit) {
+			return schemas.StatusHeuristicMixed
+		}
+		return outcome
+	}
+	if replaced != "" {
+		m.releaseReplacedLocked(transactionID, replaced)
+		m.offerFreedPostsLocked()
 	}
+	m.rememberOutcome(transactionID, schemas.StatusReservationCommitted)
+	m.persistLocked("COMMIT da TX[" + transactionID + "]")
+	return schemas.StatusReservationCommitted
 }
 
-func (m *StateManager) AbortReservation(transactionID string) {
+// releaseReplacedLocked remove as reservas efetivadas da transação que a remarcação transactionID
+// substituiu, agora que a nova reserva foi efetivada. Se o veículo já estava recarregando, a nova
+// reserva continua CHARGING. Requer cityDataMux travado.
+func (m *StateManager) releaseReplacedLocked(transactionID, replaced string) {
+	if replaced == "" {
+		return
+	}
+	var keptReservations []schemas.ActiveReservation
+	charging := false
+	for _, res := range m.cityData.ActiveReservations {
+		if res.TransactionID == replaced && !isUndecided(res.Status) {
+			log.Printf("[StateManager-%s] TX[%s]: Remarcação efetivada. Liberando reserva anterior: %+v", m.ownedCity, transactionID, res)
+			m.index.remove(res)
+			m.deleteReservationLocked(res)
+			charging = charging || res.Status == schemas.StatusReservationCharging
+		} else {
+			keptReservations = append(keptReservations, res)
+		}
+	}
+	m.cityData.ActiveReservations = keptReservations
+	if !charging {
+		return
+	}
+	for i, res := range m.cityData.ActiveReservations {
+		if res.TransactionID == transactionID && res.Status == schemas.StatusReservationCommitted {
+			m.cityData.ActiveReservations[i].Status = schemas.StatusReservationCharging
+			m.putReservationLocked(m.cityData.ActiveReservations[i])
+		}
+	}
+}
+
+// AbortReservation remove as reservas ainda não decididas da transação e retorna ABORTED, também
+// para um ABORT repetido, HEURISTIC_MIXED se um operador já tinha forçado o COMMIT, ou o resultado
+// já registrado (COMMITTED, CANCELLED) quando não havia reserva a abortar, para que o coordenador
+// veja o conflito.
+func (m *StateManager) AbortReservation(transactionID string) string {
 	m.cityDataMux.Lock()
 	defer m.cityDataMux.Unlock()
 
 	var keptReservations []schemas.ActiveReservation
 	aborted := false
 	for _, res := range m.cityData.ActiveReservations {
-		if res.TransactionID == transactionID && res.Status == schemas.StatusReservationPrepared {
+		if res.TransactionID == transactionID && isUndecided(res.Status) {
 			log.Printf("[StateManager-%s] TX[%s]: SUCESSO ABORT. Removendo reserva: %+v", m.ownedCity, transactionID, res)
+			m.index.remove(res)
+			m.deleteReservationLocked(res)
 			aborted = true
 		} else {
 			keptReservations = append(keptReservations, res)
@@ -109,19 +445,101 @@ func (m *StateManager) AbortReservation(transactionID string) {
 	m.cityData.ActiveReservations = keptReservations
 	if !aborted {
 		log.Printf("[StateManager-%s] TX[%s]: AVISO ABORT - Nenhuma reserva PREPARED encontrada para este TransactionID.", m.ownedCity, transactionID)
+		if m.checkHeuristicLocked(transactionID, schemas.DecisionAbort) {
+			return schemas.StatusHeuristicMixed
+		}
+		if outcome := m.transactionStatusLocked(transactionID); outcome != schemas.StatusUnknown {
+			if outcome != schemas.StatusAborted {
+				log.Printf("[StateManager-%s] TX[%s]: AVISO ABORT - transação já está %s nesta cidade.", m.ownedCity, transactionID, outcome)
+			}
+			return outcome
+		}
+	}
+	if aborted {
+		m.offerFreedPostsLocked()
+	}
+	// Mesmo sem reserva, o ABORT é lembrado para recusar um PREPARE que chegue atrasado
+	m.rememberOutcome(transactionID, schemas.StatusAborted)
+	m.persistLocked("ABORT da TX[" + transactionID + "]")
+	return schemas.StatusAborted
+}
+
+// rememberOutcome registra o resultado de uma transação resolvida, para ser gravado com as demais
+// alterações. Requer cityDataMux travado.
+func (m *StateManager) rememberOutcome(transactionID, outcome string) {
+	m.recordOutcomeLocked(transactionID, outcome)
+	m.applyOutcome(transactionID, outcome)
+}
+
+// applyOutcome guarda o resultado em memória, descartando os mais antigos quando o limite é
+// atingido. Requer cityDataMux travado.
+func (m *StateManager) applyOutcome(transactionID, outcome string) {
+	if _, exists := m.outcomes[transactionID]; !exists {
+		m.outcomeOrder = append(m.outcomeOrder, transactionID)
+		if len(m.outcomeOrder) > maxRememberedOutcomes {
+			delete(m.outcomes, m.outcomeOrder[0])
+			m.outcomeOrder = m.outcomeOrder[1:]
+		}
+	}
+	m.outcomes[transactionID] = outcome
+}
+
+// TransactionStatus retorna o estado local da transação nesta cidade:
+// PREPARED, COMMITTED, ABORTED ou UNKNOWN (nunca vista ou já esquecida).
+func (m *StateManager) TransactionStatus(transactionID string) string {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	return m.transactionStatusLocked(transactionID)
+}
+
+// TerminationStatus é o TransactionStatus pedido por outro participante na terminação cooperativa.
+// Uma transação desconhecida passa a ser lembrada como ABORTED: quem consulta vai abortar a própria
+// reserva, e um PREPARE que chegasse depois, com voto SIM, deixaria o coordenador efetivar a
+// transação nas demais cidades.
+func (m *StateManager) TerminationStatus(transactionID string) string {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	if status := m.transactionStatusLocked(transactionID); status != schemas.StatusUnknown {
+		return status
+	}
+	log.Printf("[StateManager-%s] TX[%s]: Transação desconhecida consultada na terminação; ABORT lembrado para recusar um PREPARE atrasado.", m.ownedCity, transactionID)
+	m.rememberOutcome(transactionID, schemas.StatusAborted)
+	m.persistLocked("ABORT presumido da TX[" + transactionID + "]")
+	return schemas.StatusAborted
+}
+
+// transactionStatusLocked é o TransactionStatus com cityDataMux já travado.
+func (m *StateManager) transactionStatusLocked(transactionID string) string {
+	for _, res := range m.cityData.ActiveReservations {
+		if res.TransactionID != transactionID {
+			continue
+		}
+		if res.Status == schemas.StatusReservationCharging || res.Status == schemas.StatusReservationNoShow {
+			return schemas.StatusReservationCommitted // Etapas de uma reserva efetivada
+		}
+		return res.Status
 	}
+	if outcome, resolved := m.outcomes[transactionID]; resolved {
+		return outcome
+	}
+	return schemas.StatusUnknown
 }
 
-// CheckAndEndReservations verifica as reservas e envia notificações MQTT se necessário.
+// CheckAndEndReservations verifica as reservas e envia notificações MQTT se necessário: marca
+// NO_SHOW as que passaram da tolerância sem check-in e encerra as que terminaram.
 func (m *StateManager) CheckAndEndReservations() {
     m.cityDataMux.Lock()
     defer m.cityDataMux.Unlock()
 
     now := time.Now().UTC()
+    m.markNoShowsLocked(now)
     var keptReservations []schemas.ActiveReservation
 
     for _, res := range m.cityData.ActiveReservations {
-        if res.Status == schemas.StatusReservationCommitted && now.After(res.ReservationWindow.EndTimeUTC) {
+        if res.Status == schemas.StatusReservationNoShow && now.After(res.ReservationWindow.EndTimeUTC) {
+            // O veículo já foi avisado do NO_SHOW; a reserva só deixa de ser listada
+            m.deleteReservationLocked(res)
+        } else if (res.Status == schemas.StatusReservationCommitted || res.Status == schemas.StatusReservationCharging) && now.After(res.ReservationWindow.EndTimeUTC) {
             // Reserva expirou! Enviar notificação MQTT
             endMessage := schemas.ReservationEndMessage{
                 VehicleID:     res.VehicleID,
@@ -132,12 +550,80 @@ func (m *StateManager) CheckAndEndReservations() {
             payloadBytes, _ := json.Marshal(endMessage)
             mqtt.Publish(fmt.Sprintf("car/reservation/end/%s", res.VehicleID), string(payloadBytes)) // Tópico específico para fim de reserva
             log.Printf("[StateManager-%s] TX[%s]: Reserva para veículo %s encerrada. Notificação MQTT enviada.", m.ownedCity, res.TransactionID, res.VehicleID)
+            m.index.remove(res)
+            m.deleteReservationLocked(res)
+        } else if res.Status == schemas.StatusReservationMaintenance && now.After(res.ReservationWindow.EndTimeUTC) {
+            log.Printf("[StateManager-%s] Manutenção %s do posto %s encerrada.", m.ownedCity, res.TransactionID, res.ChargingPointID)
+            m.index.remove(res)
+            m.deleteReservationLocked(res)
         } else {
             keptReservations = append(keptReservations, res) // Manter reservas não expiradas
         }
     }
 
     m.cityData.ActiveReservations = keptReservations // Atualizar a lista de reservas
+    m.expireWaitlistLocked(now)
+    m.offerFreedPostsLocked()
+    m.persistLocked("encerramento de reservas")
+}
+
+// PreCommitReservation move as reservas PREPARED da transação para PRECOMMITTED (fase
+// intermediária do 3PC), renovando a concessão. Repetir o PRE-COMMIT é inofensivo. Retorna false se
+// não havia reserva pendente de decisão.
+func (m *StateManager) PreCommitReservation(transactionID string) bool {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	found := false
+	until := time.Now().UTC().Add(m.prepareLease)
+	for i, res := range m.cityData.ActiveReservations {
+		if res.TransactionID == transactionID && isUndecided(res.Status) {
+			m.cityData.ActiveReservations[i].Status = schemas.StatusReservationPreCommitted
+			m.cityData.ActiveReservations[i].PreparedUntilUTC = until
+			m.putReservationLocked(m.cityData.ActiveReservations[i])
+			found = true
+		}
+	}
+	if !found {
+		log.Printf("[StateManager-%s] TX[%s]: AVISO PRE-COMMIT - Nenhuma reserva PREPARED encontrada para este TransactionID.", m.ownedCity, transactionID)
+		return false
+	}
+	m.persistLocked("PRE-COMMIT da TX[" + transactionID + "]")
+	log.Printf("[StateManager-%s] TX[%s]: SUCESSO PRE-COMMIT. Concessão até %s", m.ownedCity, transactionID, until.Format(schemas.ISOFormat))
+	return true
+}
+
+// ExpiredPreparedReservations retorna as reservas PREPARED (ou PRECOMMITTED) cuja concessão já expirou.
+// Elas continuam ocupando o posto até serem resolvidas com CommitReservation ou AbortReservation.
+func (m *StateManager) ExpiredPreparedReservations() []schemas.ActiveReservation {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	now := time.Now().UTC()
+	var expired []schemas.ActiveReservation
+	for _, res := range m.cityData.ActiveReservations {
+		if isUndecided(res.Status) && now.After(res.PreparedUntilUTC) {
+			expired = append(expired, res)
+		}
+	}
+	return expired
+}
+
+// ExtendPreparedLease renova a concessão das reservas PREPARED da transação, retornando o novo prazo.
+func (m *StateManager) ExtendPreparedLease(transactionID string) time.Time {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	until := time.Now().UTC().Add(m.prepareLease)
+	for i, res := range m.cityData.ActiveReservations {
+		if res.TransactionID == transactionID && isUndecided(res.Status) {
+			m.cityData.ActiveReservations[i].PreparedUntilUTC = until
+			m.putReservationLocked(m.cityData.ActiveReservations[i])
+		}
+	}
+	m.persistLocked("renovação da concessão da TX[" + transactionID + "]")
+	log.Printf("[StateManager-%s] TX[%s]: Concessão PREPARED renovada até %s", m.ownedCity, transactionID, until.Format(schemas.ISOFormat))
+	return until
 }
 
 // GetCityAvailability - pode ser útil para um endpoint de status
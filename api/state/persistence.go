@@ -0,0 +1,98 @@
+// PBL-2/api/state/persistence.go
+package state
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/4r7hur0/PBL-2/api/storage"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// UseStorage passa a gravar o estado da cidade em st e recupera dele as reservas, os resultados
+// das transações resolvidas e os postos. Os postos gravados prevalecem sobre os configurados,
+// pois são os que as reservas referenciam; se st ainda não tem postos, os atuais são gravados.
+// Deve ser chamada na inicialização, antes de qualquer reserva.
+func (m *StateManager) UseStorage(st storage.Storage) error {
+	snapshot, err := st.Load()
+	if err != nil {
+		return fmt.Errorf("falha ao carregar o estado de %s: %w", m.ownedCity, err)
+	}
+
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	if len(snapshot.Posts) > 0 {
+		if !slices.Equal(snapshot.Posts, m.cityData.Posts) {
+			log.Printf("[StateManager-%s] Usando os %d postos gravados; a configuração de postos é ignorada.", m.ownedCity, len(snapshot.Posts))
+		}
+		m.cityData.Posts = snapshot.Posts
+		m.cityData.MaxPosts = len(snapshot.Posts)
+	} else if err := st.Append(storage.Record{Type: storage.RecordPosts, Posts: m.cityData.Posts}); err != nil {
+		return fmt.Errorf("falha ao gravar os postos de %s: %w", m.ownedCity, err)
+	}
+	m.store = st
+	m.pending = nil
+
+	m.cityData.ActiveReservations = append([]schemas.ActiveReservation{}, snapshot.Reservations...)
+	m.index = intervalIndex{}
+	for _, res := range m.cityData.ActiveReservations {
+		if res.Status != schemas.StatusReservationNoShow { // O posto de um NO_SHOW já foi liberado
+			m.index.insert(res)
+		}
+	}
+	m.outcomes, m.outcomeOrder = make(map[string]string), nil
+	for _, o := range snapshot.Outcomes {
+		m.applyOutcome(o.TransactionID, o.Outcome)
+	}
+	m.waitlist = append([]schemas.WaitlistEntry{}, snapshot.Waitlist...)
+	log.Printf("[StateManager-%s] Estado recuperado: %d postos, %d reservas, %d transações resolvidas, %d na fila de espera.", m.ownedCity, len(m.cityData.Posts), len(m.cityData.ActiveReservations), len(m.outcomes), len(m.waitlist))
+	return nil
+}
+
+// putReservationLocked agenda a gravação da reserva como está. Requer cityDataMux travado.
+func (m *StateManager) putReservationLocked(res schemas.ActiveReservation) {
+	m.pending = append(m.pending, storage.Record{Type: storage.RecordPutReservation, Reservation: &res})
+}
+
+// deleteReservationLocked agenda a remoção da reserva. Requer cityDataMux travado.
+func (m *StateManager) deleteReservationLocked(res schemas.ActiveReservation) {
+	m.pending = append(m.pending, storage.Record{Type: storage.RecordDeleteReservation, Reservation: &res})
+}
+
+// recordOutcomeLocked agenda a gravação do resultado da transação. Requer cityDataMux travado.
+func (m *StateManager) recordOutcomeLocked(transactionID, outcome string) {
+	m.pending = append(m.pending, storage.Record{Type: storage.RecordOutcome, TransactionID: transactionID, Outcome: outcome})
+}
+
+// putWaitlistLocked agenda a gravação da entrada da fila de espera. Requer cityDataMux travado.
+func (m *StateManager) putWaitlistLocked(entry schemas.WaitlistEntry) {
+	m.pending = append(m.pending, storage.Record{Type: storage.RecordPutWaitlist, Waitlist: &entry})
+}
+
+// deleteWaitlistLocked agenda a remoção da entrada da fila de espera. Requer cityDataMux travado.
+func (m *StateManager) deleteWaitlistLocked(entry schemas.WaitlistEntry) {
+	m.pending = append(m.pending, storage.Record{Type: storage.RecordDeleteWaitlist, Waitlist: &entry})
+}
+
+// flushLocked grava de uma vez as alterações agendadas. Em caso de falha elas são descartadas.
+// Requer cityDataMux travado.
+func (m *StateManager) flushLocked() error {
+	if len(m.pending) == 0 {
+		return nil
+	}
+	recs := m.pending
+	m.pending = nil
+	if err := m.store.Append(recs...); err != nil {
+		return fmt.Errorf("falha ao gravar o estado da cidade: %w", err)
+	}
+	return nil
+}
+
+// persistLocked grava as alterações de uma operação que já foi aplicada em memória e não pode
+// mais ser recusada; uma falha é apenas registrada. Requer cityDataMux travado.
+func (m *StateManager) persistLocked(operation string) {
+	if err := m.flushLocked(); err != nil {
+		log.Printf("[StateManager-%s] AVISO: falha ao gravar em disco (%s): %v", m.ownedCity, operation, err)
+	}
+}
@@ -0,0 +1,199 @@
+// PBL-2/api/state/posts.go
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/storage"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// noNeighborGap é a folga considerada quando o posto não tem reserva antes ou depois da janela.
+const noNeighborGap = 365 * 24 * time.Hour
+
+// powerLevelKW é a potência de cada nível de posto.
+var powerLevelKW = map[string]float64{
+	schemas.PowerLevelSlow:      22,
+	schemas.PowerLevelFast:      50,
+	schemas.PowerLevelUltraFast: 150,
+}
+
+var knownConnectors = map[string]bool{
+	schemas.ConnectorType2:   true,
+	schemas.ConnectorCCS2:    true,
+	schemas.ConnectorCHAdeMO: true,
+}
+
+// PostSpec descreve um grupo de postos iguais da cidade.
+type PostSpec struct {
+	Count      int
+	PowerLevel string
+	Connector  string
+}
+
+// defaultPostSpecs é a configuração usada quando só a quantidade de postos é informada.
+func defaultPostSpecs(quantity int) []PostSpec {
+	return []PostSpec{{Count: quantity, PowerLevel: schemas.PowerLevelFast, Connector: schemas.ConnectorCCS2}}
+}
+
+// ParsePostLayout interpreta a configuração dos postos no formato "quantidade:nível:conector",
+// separada por vírgulas (ex.: "2:fast:CCS2,1:slow:Type2").
+func ParsePostLayout(value string) ([]PostSpec, error) {
+	var specs []PostSpec
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("entrada %q não está no formato quantidade:nível:conector", entry)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("quantidade inválida em %q", entry)
+		}
+		spec := PostSpec{Count: count, PowerLevel: strings.TrimSpace(parts[1]), Connector: strings.TrimSpace(parts[2])}
+		if _, ok := powerLevelKW[spec.PowerLevel]; !ok {
+			return nil, fmt.Errorf("nível de potência desconhecido em %q", entry)
+		}
+		if !knownConnectors[spec.Connector] {
+			return nil, fmt.Errorf("conector desconhecido em %q", entry)
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("nenhum posto configurado")
+	}
+	return specs, nil
+}
+
+// newChargingPoints cria os postos da cidade com IDs estáveis ("FeiradeSantana-01", ...).
+func newChargingPoints(city string, specs []PostSpec) []schemas.ChargingPoint {
+	var points []schemas.ChargingPoint
+	for _, spec := range specs {
+		for i := 0; i < spec.Count; i++ {
+			points = append(points, newChargingPoint(city, len(points)+1, spec))
+		}
+	}
+	return points
+}
+
+// newChargingPoint cria o posto de número n da cidade.
+func newChargingPoint(city string, n int, spec PostSpec) schemas.ChargingPoint {
+	return schemas.ChargingPoint{
+		ID:         fmt.Sprintf("%s-%02d", strings.ReplaceAll(city, " ", ""), n),
+		Name:       fmt.Sprintf("Posto %02d - %s", n, city),
+		PowerLevel: spec.PowerLevel,
+		PowerKW:    powerLevelKW[spec.PowerLevel],
+		Connector:  spec.Connector,
+	}
+}
+
+// SetPostLayout substitui os postos da cidade pelos descritos em specs. Deve ser chamada na
+// inicialização, antes de qualquer reserva.
+func (m *StateManager) SetPostLayout(specs []PostSpec) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	m.cityData.Posts = newChargingPoints(m.ownedCity, specs)
+	m.cityData.MaxPosts = len(m.cityData.Posts)
+	m.pending = append(m.pending, storage.Record{Type: storage.RecordPosts, Posts: m.cityData.Posts})
+	m.persistLocked("postos")
+}
+
+// Posts retorna os postos da cidade.
+func (m *StateManager) Posts() []schemas.ChargingPoint {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	return append([]schemas.ChargingPoint(nil), m.cityData.Posts...)
+}
+
+// chargeOption é um grupo de postos compatíveis com o veículo em que a recarga ocupa a mesma janela.
+type chargeOption struct {
+	window schemas.ReservationWindow
+	posts  map[string]bool
+}
+
+// chargePower retorna a potência da recarga no posto: a do posto, limitada pela do veículo.
+func chargePower(post schemas.ChargingPoint, charge *schemas.ChargeProfile) float64 {
+	if charge != nil && charge.MaxChargePowerKW > 0 && charge.MaxChargePowerKW < post.PowerKW {
+		return charge.MaxChargePowerKW
+	}
+	return post.PowerKW
+}
+
+// chargeWindow retorna a janela que a recarga ocupa no posto: começa no início pedido e dura o
+// necessário para a energia pedida na potência resultante. Sem energia, vale a janela pedida.
+func chargeWindow(requested schemas.ReservationWindow, post schemas.ChargingPoint, charge *schemas.ChargeProfile) schemas.ReservationWindow {
+	if charge == nil || charge.EnergyKWh <= 0 {
+		return requested
+	}
+	power := chargePower(post, charge)
+	if power <= 0 {
+		return requested
+	}
+	start := requested.StartTimeUTC
+	return schemas.ReservationWindow{StartTimeUTC: start, EndTimeUTC: start.Add(schemas.ChargeDuration(charge.EnergyKWh, power))}
+}
+
+// chargeOptionsLocked agrupa os postos compatíveis com o conector do veículo pela janela que a
+// recarga ocuparia, da mais curta (recarga mais rápida) para a mais longa. Requer cityDataMux travado.
+func (m *StateManager) chargeOptionsLocked(requested schemas.ReservationWindow, charge *schemas.ChargeProfile) []chargeOption {
+	var options []chargeOption
+	for _, post := range m.cityData.Posts {
+		if charge != nil && charge.Connector != "" && post.Connector != charge.Connector {
+			continue
+		}
+		window := chargeWindow(requested, post, charge)
+		i := sort.Search(len(options), func(i int) bool { return !options[i].window.EndTimeUTC.Before(window.EndTimeUTC) })
+		if i < len(options) && options[i].window == window {
+			options[i].posts[post.ID] = true
+			continue
+		}
+		options = append(options, chargeOption{})
+		copy(options[i+1:], options[i:])
+		options[i] = chargeOption{window: window, posts: map[string]bool{post.ID: true}}
+	}
+	return options
+}
+
+// postLocked retorna o posto com o ID informado. Requer cityDataMux travado.
+func (m *StateManager) postLocked(id string) (schemas.ChargingPoint, bool) {
+	for _, post := range m.cityData.Posts {
+		if post.ID == id {
+			return post, true
+		}
+	}
+	return schemas.ChargingPoint{}, false
+}
+
+// bestFitPostLocked escolhe, entre os postos livres durante toda a janela, o que deixa a menor
+// folga somada antes e depois dela, preservando os intervalos longos para reservas maiores.
+// O posto preferido é usado se estiver livre. Requer cityDataMux travado.
+func (m *StateManager) bestFitPostLocked(preferred string, window schemas.ReservationWindow, free map[string]bool) string {
+	if free[preferred] {
+		return preferred
+	}
+	before, after := m.index.neighborGaps(window.StartTimeUTC, window.EndTimeUTC, free)
+	best, bestGap := "", time.Duration(0)
+	for _, post := range m.cityData.Posts { // Na ordem dos postos, para desempatar sempre igual
+		if !free[post.ID] {
+			continue
+		}
+		gapBefore, gapAfter := noNeighborGap, noNeighborGap
+		if d, ok := before[post.ID]; ok {
+			gapBefore = d
+		}
+		if d, ok := after[post.ID]; ok {
+			gapAfter = d
+		}
+		if gap := gapBefore + gapAfter; best == "" || gap < bestGap {
+			best, bestGap = post.ID, gap
+		}
+	}
+	return best
+}
@@ -0,0 +1,250 @@
+// PBL-2/api/state/waitlist.go
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/google/uuid"
+)
+
+// DefaultWaitlistOfferTimeout é o prazo para o veículo aceitar o posto oferecido pela fila de espera.
+const DefaultWaitlistOfferTimeout = time.Minute
+
+// Motivos de recusa de um pedido à fila de espera.
+var (
+	ErrWaitlistInvalid = errors.New("pedido de fila de espera inválido")
+	ErrNoOffer         = errors.New("nenhuma oferta em aberto com este ID nesta cidade")
+	ErrOfferRefused    = errors.New("aceitação recusada")
+)
+
+// SetWaitlistOfferTimeout define o prazo para aceitar uma oferta da fila de espera.
+func (m *StateManager) SetWaitlistOfferTimeout(timeout time.Duration) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	m.offerTimeout = timeout
+}
+
+// WaitlistOfferTimeout retorna o prazo para aceitar uma oferta da fila de espera.
+func (m *StateManager) WaitlistOfferTimeout() time.Duration {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	return m.offerTimeout
+}
+
+// JoinWaitlist coloca o veículo na fila de espera da cidade pela janela pedida e retorna a entrada.
+// Se já houver um posto livre, a oferta é feita na hora. Entrar de novo na fila pela mesma janela
+// retorna a entrada existente.
+func (m *StateManager) JoinWaitlist(req schemas.WaitlistJoinMsg) (schemas.WaitlistEntry, error) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	window := req.ReservationWindow
+	if !window.StartTimeUTC.Before(window.EndTimeUTC) {
+		return schemas.WaitlistEntry{}, fmt.Errorf("%w: a janela termina antes de começar", ErrWaitlistInvalid)
+	}
+	if !window.StartTimeUTC.After(time.Now().UTC()) {
+		return schemas.WaitlistEntry{}, fmt.Errorf("%w: a janela já começou", ErrWaitlistInvalid)
+	}
+	for _, entry := range m.waitlist {
+		if entry.VehicleID == req.VehicleID && entry.ReservationWindow.StartTimeUTC.Equal(window.StartTimeUTC) && entry.ReservationWindow.EndTimeUTC.Equal(window.EndTimeUTC) {
+			return entry, nil
+		}
+	}
+	entry := schemas.WaitlistEntry{
+		ID:                uuid.New().String(),
+		VehicleID:         req.VehicleID,
+		City:              m.ownedCity,
+		ReservationWindow: window,
+		Charge:            req.Charge,
+		JoinedAtUTC:       time.Now().UTC(),
+	}
+	m.putWaitlistLocked(entry)
+	if err := m.flushLocked(); err != nil {
+		return schemas.WaitlistEntry{}, err
+	}
+	m.waitlist = append(m.waitlist, entry)
+	log.Printf("[StateManager-%s] FILA DE ESPERA: veículo %s entrou na posição %d para %s - %s.", m.ownedCity, entry.VehicleID, len(m.waitlist), window.StartTimeUTC.Format(schemas.ISOFormat), window.EndTimeUTC.Format(schemas.ISOFormat))
+	m.offerFreedPostsLocked()
+	m.persistLocked("oferta da fila de espera")
+	return m.waitlist[m.waitlistIndexLocked(entry.ID)], nil // Com a oferta, se já houve
+}
+
+// LeaveWaitlist tira a entrada da fila de espera, liberando o posto de uma oferta em aberto.
+func (m *StateManager) LeaveWaitlist(entryID string) bool {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	i := m.waitlistIndexLocked(entryID)
+	if i < 0 {
+		return false
+	}
+	entry := m.waitlist[i]
+	m.removeWaitlistLocked(i)
+	if m.releaseOfferLocked(entry) {
+		m.offerFreedPostsLocked()
+	}
+	m.persistLocked("saída da fila de espera")
+	log.Printf("[StateManager-%s] FILA DE ESPERA: veículo %s saiu da fila (entrada %s).", m.ownedCity, entry.VehicleID, entry.ID)
+	return true
+}
+
+// Waitlist retorna a fila de espera da cidade, na ordem de chegada.
+func (m *StateManager) Waitlist() []schemas.WaitlistEntry {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+	return append([]schemas.WaitlistEntry{}, m.waitlist...)
+}
+
+// AcceptOffer aceita a oferta em aberto: o posto guardado vira uma reserva COMMITTED, com o ID da
+// entrada como TransactionID, e a entrada sai da fila.
+func (m *StateManager) AcceptOffer(offerID, vehicleID string) (schemas.ActiveReservation, error) {
+	m.cityDataMux.Lock()
+	defer m.cityDataMux.Unlock()
+
+	for _, res := range m.cityData.ActiveReservations {
+		if res.TransactionID == offerID && res.Status != schemas.StatusReservationOffered && res.VehicleID == vehicleID {
+			return res, nil // Aceitação repetida
+		}
+	}
+	i := m.waitlistIndexLocked(offerID)
+	if i < 0 || m.waitlist[i].OfferedUntilUTC.IsZero() {
+		return schemas.ActiveReservation{}, ErrNoOffer
+	}
+	entry := m.waitlist[i]
+	if entry.VehicleID != vehicleID {
+		return schemas.ActiveReservation{}, fmt.Errorf("%w: a oferta é de outro veículo", ErrOfferRefused)
+	}
+	if time.Now().UTC().After(entry.OfferedUntilUTC) {
+		return schemas.ActiveReservation{}, fmt.Errorf("%w: a oferta expirou às %s", ErrOfferRefused, entry.OfferedUntilUTC.Format(schemas.ISOFormat))
+	}
+	for j, res := range m.cityData.ActiveReservations {
+		if res.TransactionID != offerID || res.Status != schemas.StatusReservationOffered {
+			continue
+		}
+		m.cityData.ActiveReservations[j].Status = schemas.StatusReservationCommitted
+		m.cityData.ActiveReservations[j].PreparedUntilUTC = time.Time{}
+		m.putReservationLocked(m.cityData.ActiveReservations[j])
+		m.removeWaitlistLocked(i)
+		m.rememberOutcome(offerID, schemas.StatusReservationCommitted)
+		m.persistLocked("aceitação da oferta " + offerID)
+		res = m.cityData.ActiveReservations[j]
+		log.Printf("[StateManager-%s] FILA DE ESPERA: veículo %s aceitou o posto %s. Reserva: %+v", m.ownedCity, vehicleID, res.ChargingPointID, res)
+		publishReservationEvent(res, "Oferta da fila de espera aceita; posto "+res.ChargingPointID+" reservado")
+		return res, nil
+	}
+	return schemas.ActiveReservation{}, ErrNoOffer
+}
+
+// expireWaitlistLocked tira da fila as ofertas vencidas, liberando os postos delas e avisando o
+// veículo, e as entradas sem oferta cuja janela já começou. Uma oferta ainda no prazo é mantida,
+// mesmo com a janela já começada. Requer cityDataMux travado.
+func (m *StateManager) expireWaitlistLocked(now time.Time) {
+	for i := 0; i < len(m.waitlist); {
+		entry := m.waitlist[i]
+		offered := !entry.OfferedUntilUTC.IsZero()
+		offerExpired := offered && now.After(entry.OfferedUntilUTC)
+		if (offered && !offerExpired) || (!offered && now.Before(entry.ReservationWindow.StartTimeUTC)) {
+			i++
+			continue
+		}
+		m.removeWaitlistLocked(i)
+		m.releaseOfferLocked(entry)
+		if offerExpired {
+			log.Printf("[StateManager-%s] FILA DE ESPERA: oferta do posto %s ao veículo %s expirou.", m.ownedCity, entry.ChargingPointID, entry.VehicleID)
+			publishWaitlistOffer(schemas.WaitlistOfferMsg{
+				OfferID:           entry.ID,
+				Status:            schemas.StatusOfferExpired,
+				VehicleID:         entry.VehicleID,
+				City:              m.ownedCity,
+				ChargingPointID:   entry.ChargingPointID,
+				ReservationWindow: entry.ReservationWindow,
+				ExpiresAtUTC:      entry.OfferedUntilUTC,
+			})
+		} else {
+			log.Printf("[StateManager-%s] FILA DE ESPERA: janela do veículo %s começou sem vaga; entrada %s removida.", m.ownedCity, entry.VehicleID, entry.ID)
+		}
+	}
+}
+
+// offerFreedPostsLocked oferece os postos livres às entradas da fila que ainda esperam, na ordem de
+// chegada: o posto fica guardado como OFFERED até a oferta ser aceita ou expirar. Deve ser chamada
+// sempre que um posto vaga. Requer cityDataMux travado.
+func (m *StateManager) offerFreedPostsLocked() {
+	for i, entry := range m.waitlist {
+		if !entry.OfferedUntilUTC.IsZero() {
+			continue
+		}
+		req := schemas.RemotePrepareRequest{TransactionID: entry.ID, VehicleID: entry.VehicleID, City: m.ownedCity, ReservationWindow: entry.ReservationWindow, Charge: entry.Charge}
+		alloc, err := m.allocatePostLocked(req)
+		if err != nil {
+			continue // Ainda não cabe; a próxima entrada pode caber em outra janela
+		}
+		hold := schemas.ActiveReservation{
+			TransactionID:     entry.ID,
+			VehicleID:         entry.VehicleID,
+			City:              m.ownedCity,
+			ReservationWindow: alloc.window,
+			Status:            schemas.StatusReservationOffered,
+			PreparedUntilUTC:  time.Now().UTC().Add(m.offerTimeout),
+			ChargingPointID:   alloc.post.ID,
+			ChargePowerKW:     chargePower(alloc.post, entry.Charge),
+		}
+		m.cityData.ActiveReservations = append(m.cityData.ActiveReservations, hold)
+		m.index.insert(hold)
+		m.putReservationLocked(hold)
+		entry.OfferedUntilUTC, entry.ChargingPointID = hold.PreparedUntilUTC, hold.ChargingPointID
+		m.waitlist[i] = entry
+		m.putWaitlistLocked(entry)
+		log.Printf("[StateManager-%s] FILA DE ESPERA: posto %s oferecido ao veículo %s até %s.", m.ownedCity, hold.ChargingPointID, entry.VehicleID, hold.PreparedUntilUTC.Format(schemas.ISOFormat))
+		publishWaitlistOffer(schemas.WaitlistOfferMsg{
+			OfferID:           entry.ID,
+			Status:            schemas.StatusReservationOffered,
+			VehicleID:         entry.VehicleID,
+			City:              m.ownedCity,
+			ChargingPointID:   hold.ChargingPointID,
+			ReservationWindow: hold.ReservationWindow,
+			ExpiresAtUTC:      hold.PreparedUntilUTC,
+		})
+	}
+}
+
+// publishWaitlistOffer publica a oferta, ou a expiração dela, no tópico do veículo.
+func publishWaitlistOffer(offer schemas.WaitlistOfferMsg) {
+	payloadBytes, _ := json.Marshal(offer)
+	mqtt.Publish(fmt.Sprintf("car/waitlist/offer/%s", offer.VehicleID), string(payloadBytes))
+}
+
+// releaseOfferLocked remove o posto guardado para a oferta da entrada, se houver. Requer
+// cityDataMux travado.
+func (m *StateManager) releaseOfferLocked(entry schemas.WaitlistEntry) bool {
+	for i, res := range m.cityData.ActiveReservations {
+		if res.TransactionID == entry.ID && res.Status == schemas.StatusReservationOffered {
+			m.index.remove(res)
+			m.deleteReservationLocked(res)
+			m.cityData.ActiveReservations = append(m.cityData.ActiveReservations[:i], m.cityData.ActiveReservations[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (m *StateManager) waitlistIndexLocked(entryID string) int {
+	for i, entry := range m.waitlist {
+		if entry.ID == entryID {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeWaitlistLocked tira da fila a entrada na posição i. Requer cityDataMux travado.
+func (m *StateManager) removeWaitlistLocked(i int) {
+	m.deleteWaitlistLocked(m.waitlist[i])
+	m.waitlist = append(m.waitlist[:i], m.waitlist[i+1:]...)
+}
@@ -0,0 +1,221 @@
+// PBL-2/api/storage/file.go
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/4r7hur0/PBL-2/api/durable"
+)
+
+// DefaultSnapshotInterval é quantos registros o log acumula antes de um novo snapshot.
+const DefaultSnapshotInterval = 500
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "wal.log"
+)
+
+// File guarda o estado da cidade em um diretório: um snapshot JSON do estado completo e um log
+// de escrita antecipada (JSON por linha, sincronizado a cada Append) com as alterações feitas
+// depois dele. A cada snapshotInterval registros o estado é regravado no snapshot e o log
+// esvaziado. Uma queda entre as duas etapas é inofensiva: os registros que sobram no log já estão
+// no snapshot e aplicá-los de novo não muda nada.
+type File struct {
+	mux              sync.Mutex
+	dir              string
+	wal              *os.File
+	walSize          int64 // Tamanho do log até o último registro gravado por inteiro
+	state            *replica
+	sinceSnapshot    int
+	snapshotInterval int
+}
+
+// Open abre (ou cria) o armazenamento no diretório informado, recuperando o snapshot e o log.
+func Open(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("falha ao criar diretório do estado da cidade: %w", err)
+	}
+	s := &File{dir: dir, state: newReplica(), snapshotInterval: DefaultSnapshotInterval}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	replayed, err := s.replayWAL()
+	if err != nil {
+		return nil, err
+	}
+	// Começa com o log vazio, para que o próximo reinício não precise reaplicar os mesmos registros
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	log.Printf("[Storage] Estado da cidade aberto em %s (%d reservas, %d registros do log reaplicados)", dir, len(s.state.reservations), replayed)
+	return s, nil
+}
+
+// SetSnapshotInterval define a cada quantos registros um novo snapshot é gravado.
+func (s *File) SetSnapshotInterval(n int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if n > 0 {
+		s.snapshotInterval = n
+	}
+}
+
+func (s *File) Load() (Snapshot, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.state.snapshot(), nil
+}
+
+// Append grava os registros no final do log e força a escrita em disco antes de aplicá-los.
+func (s *File) Append(recs ...Record) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	var lines []byte
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("falha ao serializar registro do estado: %w", err)
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.wal == nil {
+		return errors.New("armazenamento do estado fechado")
+	}
+	if _, err := s.wal.Write(lines); err != nil {
+		s.discardPartialWrite()
+		return fmt.Errorf("falha ao gravar registro do estado: %w", err)
+	}
+	if err := s.wal.Sync(); err != nil {
+		s.discardPartialWrite()
+		return fmt.Errorf("falha ao sincronizar log do estado em disco: %w", err)
+	}
+	s.walSize += int64(len(lines))
+	for _, rec := range recs {
+		s.state.apply(rec)
+	}
+	s.sinceSnapshot += len(recs)
+	if s.sinceSnapshot >= s.snapshotInterval {
+		// Os registros já estão seguros no log; uma falha aqui só adia o snapshot
+		if err := s.compact(); err != nil {
+			log.Printf("[Storage] AVISO: falha ao gravar snapshot em %s: %v", s.dir, err)
+		}
+	}
+	return nil
+}
+
+// discardPartialWrite corta do log o que uma escrita que falhou deixou depois do último registro
+// inteiro. Sem isso, o próximo registro seria colado nessa sobra e os dois se perderiam no replay.
+// Requer s.mux travado.
+func (s *File) discardPartialWrite() {
+	if err := s.wal.Truncate(s.walSize); err != nil {
+		log.Printf("[Storage] AVISO: falha ao descartar escrita parcial do log em %s: %v", s.dir, err)
+	}
+}
+
+// Close grava um último snapshot e fecha o log.
+func (s *File) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.wal == nil {
+		return nil
+	}
+	err := s.compact()
+	if closeErr := s.wal.Close(); err == nil {
+		err = closeErr
+	}
+	s.wal = nil
+	return err
+}
+
+func (s *File) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("falha ao ler snapshot do estado: %w", err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("snapshot do estado inválido: %w", err)
+	}
+	s.state.load(snapshot)
+	return nil
+}
+
+// replayWAL aplica os registros do log sobre o snapshot, retornando quantos foram aplicados. Só a
+// última linha pode ser ilegível (queda durante a escrita); uma linha inválida antes dela indica
+// log corrompido e interrompe a abertura.
+func (s *File) replayWAL() (int, error) {
+	file, err := os.Open(filepath.Join(s.dir, walFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("falha ao abrir log do estado para leitura: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	lineNum, applied := 0, 0
+	var badLine error
+	for scanner.Scan() {
+		lineNum++
+		if badLine != nil {
+			return applied, fmt.Errorf("log do estado corrompido: %w", badLine)
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			badLine = fmt.Errorf("linha %d inválida: %w", lineNum, err)
+			continue
+		}
+		s.state.apply(rec)
+		applied++
+	}
+	if err := scanner.Err(); err != nil {
+		return applied, fmt.Errorf("falha ao ler log do estado: %w", err)
+	}
+	if badLine != nil {
+		log.Printf("[Storage] AVISO: última linha do log ignorada (escrita interrompida): %v", badLine)
+	}
+	return applied, nil
+}
+
+// compact grava o estado em um snapshot (ver durable.WriteFile) e reabre o
+// log vazio. Requer s.mux travado (ou s ainda não publicado).
+func (s *File) compact() error {
+	data, err := json.MarshalIndent(s.state.snapshot(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("falha ao serializar snapshot do estado: %w", err)
+	}
+	// O diretório é sincronizado antes de o log ser esvaziado: sem isso, uma queda poderia manter o
+	// log vazio e desfazer a troca do snapshot, perdendo as reservas gravadas só no log
+	if err := durable.WriteFile(filepath.Join(s.dir, snapshotFile), data); err != nil {
+		return fmt.Errorf("falha ao gravar snapshot do estado: %w", err)
+	}
+
+	// Só depois do snapshot no lugar o log pode ser esvaziado
+	wal, err := os.OpenFile(filepath.Join(s.dir, walFile), os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("falha ao abrir log do estado: %w", err)
+	}
+	if s.wal != nil {
+		s.wal.Close()
+	}
+	s.wal = wal
+	s.walSize = 0
+	s.sinceSnapshot = 0
+	return nil
+}
@@ -0,0 +1,33 @@
+// PBL-2/api/storage/memory.go
+package storage
+
+import "sync"
+
+// Memory guarda o estado só em memória; é perdido quando o processo termina. Usado quando não há
+// diretório de dados e em testes.
+type Memory struct {
+	mux   sync.Mutex
+	state *replica
+}
+
+// NewMemory cria um armazenamento em memória vazio.
+func NewMemory() *Memory {
+	return &Memory{state: newReplica()}
+}
+
+func (s *Memory) Load() (Snapshot, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.state.snapshot(), nil
+}
+
+func (s *Memory) Append(recs ...Record) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, rec := range recs {
+		s.state.apply(rec)
+	}
+	return nil
+}
+
+func (s *Memory) Close() error { return nil }
@@ -0,0 +1,169 @@
+// PBL-2/api/storage/storage.go
+package storage
+
+import (
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Tipos de registro de alteração do estado de uma cidade.
+const (
+	RecordPutReservation    = "PUT_RESERVATION"    // Cria ou substitui uma reserva
+	RecordDeleteReservation = "DELETE_RESERVATION" // Remove uma reserva
+	RecordOutcome           = "OUTCOME"            // Resultado de uma transação resolvida
+	RecordPosts             = "POSTS"              // Substitui os postos da cidade
+	RecordPutWaitlist       = "PUT_WAITLIST"       // Cria ou substitui uma entrada da fila de espera
+	RecordDeleteWaitlist    = "DELETE_WAITLIST"    // Remove uma entrada da fila de espera
+)
+
+// MaxOutcomes limita quantos resultados de transações já resolvidas são guardados; os mais
+// antigos são descartados primeiro.
+const MaxOutcomes = 10000
+
+// Record é uma alteração do estado da cidade. Todo registro sobrescreve um valor inteiro (nunca
+// soma nem desconta), então aplicar o mesmo registro de novo não muda o resultado.
+type Record struct {
+	Type          string                     `json:"type"`
+	Reservation   *schemas.ActiveReservation `json:"reservation,omitempty"`    // PUT_RESERVATION/DELETE_RESERVATION
+	TransactionID string                     `json:"transaction_id,omitempty"` // OUTCOME
+	Outcome       string                     `json:"outcome,omitempty"`        // OUTCOME
+	Posts         []schemas.ChargingPoint    `json:"posts,omitempty"`          // POSTS
+	Waitlist      *schemas.WaitlistEntry     `json:"waitlist,omitempty"`       // PUT_WAITLIST/DELETE_WAITLIST
+}
+
+// Outcome é o resultado de uma transação resolvida na cidade.
+type Outcome struct {
+	TransactionID string `json:"transaction_id"`
+	Outcome       string `json:"outcome"`
+}
+
+// Snapshot é o estado completo de uma cidade.
+type Snapshot struct {
+	Posts        []schemas.ChargingPoint     `json:"posts,omitempty"` // Vazio se os postos nunca foram gravados
+	Reservations []schemas.ActiveReservation `json:"reservations"`
+	Outcomes     []Outcome                   `json:"outcomes"`           // Do mais antigo para o mais recente
+	Waitlist     []schemas.WaitlistEntry     `json:"waitlist,omitempty"` // Na ordem de chegada
+}
+
+// Storage guarda o estado de uma cidade (ver state.StateManager).
+type Storage interface {
+	// Load retorna o estado gravado.
+	Load() (Snapshot, error)
+	// Append grava as alterações, na ordem, antes de retornar.
+	Append(recs ...Record) error
+	Close() error
+}
+
+// ReservationKey identifica uma reserva: a transação e o início da janela pedida, que não muda
+// quando a reserva é efetivada.
+func ReservationKey(res schemas.ActiveReservation) string {
+	return res.TransactionID + "@" + res.ReservationWindow.StartTimeUTC.UTC().Format(time.RFC3339Nano)
+}
+
+// replica é o estado resultante da aplicação dos registros, mantido pelas implementações.
+type replica struct {
+	posts        []schemas.ChargingPoint
+	reservations []schemas.ActiveReservation
+	outcomes     map[string]string
+	outcomeOrder []string
+	waitlist     []schemas.WaitlistEntry
+}
+
+func newReplica() *replica {
+	return &replica{outcomes: make(map[string]string)}
+}
+
+func (r *replica) load(s Snapshot) {
+	r.posts = s.Posts
+	r.reservations = s.Reservations
+	r.waitlist = s.Waitlist
+	for _, o := range s.Outcomes {
+		r.putOutcome(o.TransactionID, o.Outcome)
+	}
+}
+
+func (r *replica) apply(rec Record) {
+	switch rec.Type {
+	case RecordPutReservation:
+		if rec.Reservation == nil {
+			return
+		}
+		if i := r.find(*rec.Reservation); i >= 0 {
+			r.reservations[i] = *rec.Reservation
+		} else {
+			r.reservations = append(r.reservations, *rec.Reservation)
+		}
+	case RecordDeleteReservation:
+		if rec.Reservation == nil {
+			return
+		}
+		if i := r.find(*rec.Reservation); i >= 0 {
+			r.reservations = append(r.reservations[:i], r.reservations[i+1:]...)
+		}
+	case RecordOutcome:
+		r.putOutcome(rec.TransactionID, rec.Outcome)
+	case RecordPosts:
+		r.posts = rec.Posts
+	case RecordPutWaitlist:
+		if rec.Waitlist == nil {
+			return
+		}
+		if i := r.findWaitlist(rec.Waitlist.ID); i >= 0 {
+			r.waitlist[i] = *rec.Waitlist
+		} else {
+			r.waitlist = append(r.waitlist, *rec.Waitlist)
+		}
+	case RecordDeleteWaitlist:
+		if rec.Waitlist == nil {
+			return
+		}
+		if i := r.findWaitlist(rec.Waitlist.ID); i >= 0 {
+			r.waitlist = append(r.waitlist[:i], r.waitlist[i+1:]...)
+		}
+	}
+}
+
+func (r *replica) find(res schemas.ActiveReservation) int {
+	key := ReservationKey(res)
+	for i, existing := range r.reservations {
+		if ReservationKey(existing) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *replica) findWaitlist(id string) int {
+	for i, entry := range r.waitlist {
+		if entry.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *replica) putOutcome(transactionID, outcome string) {
+	if _, exists := r.outcomes[transactionID]; !exists {
+		r.outcomeOrder = append(r.outcomeOrder, transactionID)
+		if len(r.outcomeOrder) > MaxOutcomes {
+			delete(r.outcomes, r.outcomeOrder[0])
+			r.outcomeOrder = r.outcomeOrder[1:]
+		}
+	}
+	r.outcomes[transactionID] = outcome
+}
+
+// snapshot retorna uma cópia do estado.
+func (r *replica) snapshot() Snapshot {
+	s := Snapshot{
+		Posts:        append([]schemas.ChargingPoint(nil), r.posts...),
+		Reservations: append([]schemas.ActiveReservation{}, r.reservations...),
+		Outcomes:     make([]Outcome, 0, len(r.outcomeOrder)),
+		Waitlist:     append([]schemas.WaitlistEntry(nil), r.waitlist...),
+	}
+	for _, id := range r.outcomeOrder {
+		s.Outcomes = append(s.Outcomes, Outcome{TransactionID: id, Outcome: r.outcomes[id]})
+	}
+	return s
+}
@@ -0,0 +1,268 @@
+// PBL-2/api/storage/storage_test.go
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+var start = time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+
+func reservation(transactionID, status string, hour int) *schemas.ActiveReservation {
+	return &schemas.ActiveReservation{
+		TransactionID:     transactionID,
+		City:              "Salvador",
+		Status:            status,
+		ChargingPointID:   "Salvador-CP-01",
+		ReservationWindow: schemas.ReservationWindow{StartTimeUTC: start.Add(time.Duration(hour) * time.Hour), EndTimeUTC: start.Add(time.Duration(hour+1) * time.Hour)},
+	}
+}
+
+// history é uma sequência de alterações que passa por todos os tipos de registro.
+func history() []Record {
+	return []Record{
+		{Type: RecordPosts, Posts: []schemas.ChargingPoint{{ID: "Salvador-CP-01"}, {ID: "Salvador-CP-02"}}},
+		{Type: RecordPutReservation, Reservation: reservation("tx-1", schemas.StatusReservationPrepared, 0)},
+		{Type: RecordPutReservation, Reservation: reservation("tx-2", schemas.StatusReservationPrepared, 2)},
+		{Type: RecordPutReservation, Reservation: reservation("tx-1", schemas.StatusReservationCommitted, 0)},
+		{Type: RecordOutcome, TransactionID: "tx-1", Outcome: schemas.StatusReservationCommitted},
+		{Type: RecordDeleteReservation, Reservation: reservation("tx-2", schemas.StatusReservationPrepared, 2)},
+		{Type: RecordOutcome, TransactionID: "tx-2", Outcome: schemas.StatusAborted},
+		{Type: RecordPutWaitlist, Waitlist: &schemas.WaitlistEntry{ID: "w-1", VehicleID: "car-1"}},
+		{Type: RecordPutWaitlist, Waitlist: &schemas.WaitlistEntry{ID: "w-2", VehicleID: "car-2"}},
+		{Type: RecordDeleteWaitlist, Waitlist: &schemas.WaitlistEntry{ID: "w-1"}},
+	}
+}
+
+// expected é o estado resultante de history.
+func expected() Snapshot {
+	return Snapshot{
+		Posts:        []schemas.ChargingPoint{{ID: "Salvador-CP-01"}, {ID: "Salvador-CP-02"}},
+		Reservations: []schemas.ActiveReservation{*reservation("tx-1", schemas.StatusReservationCommitted, 0)},
+		Outcomes:     []Outcome{{TransactionID: "tx-1", Outcome: schemas.StatusReservationCommitted}, {TransactionID: "tx-2", Outcome: schemas.StatusAborted}},
+		Waitlist:     []schemas.WaitlistEntry{{ID: "w-2", VehicleID: "car-2"}},
+	}
+}
+
+func jsonLine(rec Record) ([]byte, error) {
+	line, err := json.Marshal(rec)
+	return append(line, '\n'), err
+}
+
+func mustLoad(t *testing.T, s Storage) Snapshot {
+	t.Helper()
+	snapshot, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return snapshot
+}
+
+func mustOpen(t *testing.T, dir string) *File {
+	t.Helper()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", dir, err)
+	}
+	return s
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat(%s): %v", path, err)
+	}
+	return info.Size()
+}
+
+func TestMemoryAppliesRecords(t *testing.T) {
+	s := NewMemory()
+	if err := s.Append(history()...); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if got := mustLoad(t, s); !reflect.DeepEqual(got, expected()) {
+		t.Errorf("Load() = %+v, want %+v", got, expected())
+	}
+}
+
+func TestFileRecovery(t *testing.T) {
+	tests := []struct {
+		name             string
+		snapshotInterval int
+		close            bool // Fechar antes de reabrir (grava o snapshot final)
+		appendOneByOne   bool
+	}{
+		{"só o log, sem fechar", DefaultSnapshotInterval, false, true},
+		{"só o log, em lote", DefaultSnapshotInterval, false, false},
+		{"snapshot intermediário e log", 4, false, true},
+		{"snapshot a cada registro", 1, false, true},
+		{"fechado normalmente", DefaultSnapshotInterval, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := mustOpen(t, dir)
+			s.SetSnapshotInterval(tt.snapshotInterval)
+			if tt.appendOneByOne {
+				for _, rec := range history() {
+					if err := s.Append(rec); err != nil {
+						t.Fatalf("Append: %v", err)
+					}
+				}
+			} else if err := s.Append(history()...); err != nil {
+				t.Fatalf("Append: %v", err)
+			}
+			if got := mustLoad(t, s); !reflect.DeepEqual(got, expected()) {
+				t.Fatalf("Load() antes de reabrir = %+v, want %+v", got, expected())
+			}
+			if tt.close {
+				if err := s.Close(); err != nil {
+					t.Fatalf("Close: %v", err)
+				}
+			}
+
+			reopened := mustOpen(t, dir)
+			defer reopened.Close()
+			if got := mustLoad(t, reopened); !reflect.DeepEqual(got, expected()) {
+				t.Errorf("Load() depois de reabrir = %+v, want %+v", got, expected())
+			}
+			// A abertura grava o estado recuperado no snapshot e começa com o log vazio
+			if size := fileSize(t, filepath.Join(dir, walFile)); size != 0 {
+				t.Errorf("log com %d bytes depois da abertura, want 0", size)
+			}
+		})
+	}
+}
+
+func TestFileSnapshotInterval(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, dir)
+	defer s.Close()
+	s.SetSnapshotInterval(3)
+	walPath := filepath.Join(dir, walFile)
+
+	records := history()
+	for i, rec := range records[:5] {
+		if err := s.Append(rec); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		if emptied := fileSize(t, walPath) == 0; emptied != ((i+1)%3 == 0) {
+			t.Errorf("depois do registro %d: log vazio = %v", i+1, emptied)
+		}
+	}
+
+	// O snapshot gravado no terceiro registro não inclui os seguintes, que estão só no log
+	reopened := mustOpen(t, dir)
+	defer reopened.Close()
+	memory := NewMemory()
+	memory.Append(records[:5]...)
+	if got, want := mustLoad(t, reopened), mustLoad(t, memory); !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() = %+v, want %+v", got, want)
+	}
+}
+
+func TestFileReplayIsIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, dir)
+	if err := s.Append(history()...); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Simula uma queda entre a gravação do snapshot e o esvaziamento do log: os registros que
+	// sobram no log já estão no snapshot
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail := history()[3:]
+	for _, rec := range tail {
+		line, _ := jsonLine(rec)
+		wal.Write(line)
+	}
+	wal.Close()
+
+	reopened := mustOpen(t, dir)
+	defer reopened.Close()
+	if got := mustLoad(t, reopened); !reflect.DeepEqual(got, expected()) {
+		t.Errorf("Load() = %+v, want %+v", got, expected())
+	}
+}
+
+func TestFileIgnoresPartialLastLine(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, dir)
+	if err := s.Append(history()...); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	// Queda no meio da escrita do próximo registro
+	line, _ := jsonLine(Record{Type: RecordPutReservation, Reservation: reservation("tx-3", schemas.StatusReservationPrepared, 4)})
+	s.wal.Write(line[:len(line)/2])
+
+	reopened := mustOpen(t, dir)
+	defer reopened.Close()
+	if got := mustLoad(t, reopened); !reflect.DeepEqual(got, expected()) {
+		t.Errorf("Load() = %+v, want %+v", got, expected())
+	}
+}
+
+func TestFileRejectsCorruptLineBeforeEnd(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, dir)
+	if err := s.Append(history()[0]); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	line, _ := jsonLine(history()[1])
+	s.wal.Write(line[:len(line)/2])
+	s.wal.Write([]byte("\n"))
+	s.wal.Write(line)
+
+	if _, err := Open(dir); err == nil {
+		t.Fatal("Open aceitou um log com uma linha inválida antes do final")
+	}
+}
+
+func TestFileDiscardsFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, dir)
+	if err := s.Append(history()...); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	// Sobra de uma escrita que falhou no meio
+	line, _ := jsonLine(Record{Type: RecordPutReservation, Reservation: reservation("tx-3", schemas.StatusReservationPrepared, 4)})
+	s.wal.Write(line[:len(line)/2])
+	s.discardPartialWrite()
+	if err := s.Append(history()[3:]...); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	reopened := mustOpen(t, dir)
+	defer reopened.Close()
+	if got := mustLoad(t, reopened); !reflect.DeepEqual(got, expected()) {
+		t.Errorf("Load() = %+v, want %+v", got, expected())
+	}
+}
+
+func TestOutcomesAreBounded(t *testing.T) {
+	s := NewMemory()
+	for i := 0; i < MaxOutcomes+2; i++ {
+		s.Append(Record{Type: RecordOutcome, TransactionID: "tx-" + strconv.Itoa(i), Outcome: schemas.StatusAborted})
+	}
+	outcomes := mustLoad(t, s).Outcomes
+	if len(outcomes) != MaxOutcomes {
+		t.Fatalf("%d resultados guardados, want %d", len(outcomes), MaxOutcomes)
+	}
+	if first := outcomes[0].TransactionID; first != "tx-2" {
+		t.Errorf("resultado mais antigo = %s, want os dois primeiros descartados", first)
+	}
+}
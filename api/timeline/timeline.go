@@ -0,0 +1,250 @@
+// PBL-2/api/timeline/timeline.go
+package timeline
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/txlog"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// DefaultCapacity é quantas transações o histórico guarda quando nada é configurado.
+const DefaultCapacity = 200
+
+// Tipos de evento que não vêm do log de decisões.
+const (
+	EventRestart  = "RESTART"   // Tentativa abortada pela política de conflitos e recomeçada
+	EventSagaStep = "SAGA_STEP" // Mudança de estado de um passo de saga
+)
+
+// Event é um acontecimento da transação, na ordem em que ocorreu.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"` // Tipo do registro do log (BEGIN, VOTE, ...) ou EventRestart/EventSagaStep
+	City   string    `json:"city,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Participant é o que se sabe de uma cidade da rota.
+type Participant struct {
+	City     string     `json:"city"`
+	Endpoint string     `json:"endpoint,omitempty"`
+	Vote     string     `json:"vote,omitempty"`
+	Reason   string     `json:"reason,omitempty"` // Motivo do voto NÃO
+	VotedAt  *time.Time `json:"voted_at,omitempty"`
+	AckedAt  *time.Time `json:"acked_at,omitempty"` // Confirmação da decisão global
+
+	CancelAckedAt  *time.Time `json:"cancel_acked_at,omitempty"` // Confirmação do cancelamento pedido pelo veículo
+	HeuristicMixed bool       `json:"heuristic_mixed,omitempty"` // Confirmou a decisão global contrariando uma decisão heurística
+}
+
+// Transaction é a linha do tempo de uma transação coordenada por esta API.
+type Transaction struct {
+	TransactionID  string                   `json:"transaction_id"`
+	VehicleID      string                   `json:"vehicle_id"`
+	RequestID      string                   `json:"request_id"`
+	Protocol       string                   `json:"protocol"`
+	Route          []schemas.RouteSegment   `json:"route"`
+	Participants   []*Participant           `json:"participants"`
+	BeganAt        time.Time                `json:"began_at"`
+	PreCommitAt    *time.Time               `json:"precommit_at,omitempty"`
+	DecidedAt      *time.Time               `json:"decided_at,omitempty"`
+	Decision       string                   `json:"decision,omitempty"`
+	DecisionReason string                   `json:"decision_reason,omitempty"`
+	FinishedAt     *time.Time               `json:"finished_at,omitempty"` // Publicação do status final ao veículo
+	Outcome        string                   `json:"outcome,omitempty"`     // Status final publicado (CONFIRMED, REJECTED, ...)
+	OutcomeMessage string                   `json:"outcome_message,omitempty"`
+	Segments       []schemas.SegmentOutcome `json:"segments,omitempty"`
+	HeuristicMixed bool                     `json:"heuristic_mixed,omitempty"` // Alguma cidade tinha aplicado a decisão heurística contrária
+	Events         []Event                  `json:"events"`
+}
+
+// Summary é a versão resumida de uma transação, usada na listagem.
+type Summary struct {
+	TransactionID  string     `json:"transaction_id"`
+	VehicleID      string     `json:"vehicle_id"`
+	RequestID      string     `json:"request_id"`
+	Protocol       string     `json:"protocol"`
+	BeganAt        time.Time  `json:"began_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	Decision       string     `json:"decision,omitempty"`
+	Outcome        string     `json:"outcome,omitempty"`
+	OutcomeMessage string     `json:"outcome_message,omitempty"`
+	HeuristicMixed bool       `json:"heuristic_mixed,omitempty"`
+}
+
+// History guarda as transações mais recentes, descartando as mais antigas quando cheio.
+type History struct {
+	mux      sync.Mutex
+	capacity int
+	order    []string // TransactionIDs, da mais antiga para a mais recente
+	byID     map[string]*Transaction
+}
+
+// New cria um histórico com a capacidade informada (DefaultCapacity se não positiva).
+func New(capacity int) *History {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &History{capacity: capacity, byID: make(map[string]*Transaction)}
+}
+
+// Observe atualiza o histórico com um registro do log de decisões (ver txlog.Log.Subscribe).
+// Registros de transações já descartadas ou sem BEGIN são ignorados.
+func (h *History) Observe(rec txlog.Record) {
+	if rec.TransactionID == "" {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if rec.Type == txlog.RecordBegin {
+		h.begin(rec)
+		return
+	}
+	tx, ok := h.byID[rec.TransactionID]
+	if !ok {
+		return
+	}
+	at := rec.Timestamp
+	event := Event{Time: at, Type: rec.Type, City: rec.City}
+	switch rec.Type {
+	case txlog.RecordVote:
+		p := tx.participant(rec.City)
+		p.Endpoint, p.Vote, p.Reason, p.VotedAt = rec.Endpoint, rec.Vote, rec.Reason, &at
+		event.Detail = joinDetail(rec.Vote, rec.Reason)
+	case txlog.RecordPreCommit:
+		tx.PreCommitAt = &at
+	case txlog.RecordDecision:
+		tx.Decision, tx.DecisionReason, tx.DecidedAt = rec.Decision, rec.Reason, &at
+		event.Detail = joinDetail(rec.Decision, rec.Reason)
+	case txlog.RecordAck:
+		p := tx.participant(rec.City)
+		p.AckedAt = &at
+		if rec.Endpoint != "" {
+			p.Endpoint = rec.Endpoint
+		}
+	case txlog.RecordCancel:
+		event.Detail = rec.Reason
+	case txlog.RecordCancelAck:
+		tx.participant(rec.City).CancelAckedAt = &at
+	case txlog.RecordMixed:
+		tx.participant(rec.City).HeuristicMixed = true
+		tx.HeuristicMixed = true
+		event.Detail = rec.Decision
+	case txlog.RecordStatus:
+		if rec.Status == nil {
+			return
+		}
+		tx.Outcome, tx.OutcomeMessage, tx.Segments, tx.FinishedAt = rec.Status.Status, rec.Status.Message, rec.Status.Segments, &at
+		event.Detail = joinDetail(rec.Status.Status, rec.Status.Message)
+	}
+	tx.Events = append(tx.Events, event)
+}
+
+// AddEvent registra um evento que não passa pelo log de decisões.
+func (h *History) AddEvent(transactionID, eventType, city, detail string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if tx, ok := h.byID[transactionID]; ok {
+		tx.Events = append(tx.Events, Event{Time: time.Now().UTC(), Type: eventType, City: city, Detail: detail})
+	}
+}
+
+// begin inicia a linha do tempo de uma transação. Requer h.mux travado.
+func (h *History) begin(rec txlog.Record) {
+	if _, ok := h.byID[rec.TransactionID]; ok {
+		return
+	}
+	tx := &Transaction{
+		TransactionID: rec.TransactionID,
+		VehicleID:     rec.VehicleID,
+		RequestID:     rec.RequestID,
+		Protocol:      rec.Protocol,
+		Route:         rec.Route,
+		BeganAt:       rec.Timestamp,
+		Events:        []Event{{Time: rec.Timestamp, Type: rec.Type}},
+	}
+	if tx.Protocol == "" {
+		tx.Protocol = "2pc" // Registros antigos não gravavam o protocolo
+	}
+	for _, segment := range rec.Route {
+		tx.participant(segment.City)
+	}
+	h.byID[tx.TransactionID] = tx
+	h.order = append(h.order, tx.TransactionID)
+	if len(h.order) > h.capacity {
+		delete(h.byID, h.order[0])
+		h.order = h.order[1:]
+	}
+}
+
+// List retorna as transações mais recentes primeiro, opcionalmente só as de um veículo ou com um
+// status final, até limit (todas se limit <= 0).
+func (h *History) List(vehicleID, outcome string, limit int) []Summary {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	summaries := make([]Summary, 0)
+	for i := len(h.order) - 1; i >= 0; i-- {
+		tx := h.byID[h.order[i]]
+		if (vehicleID != "" && tx.VehicleID != vehicleID) || (outcome != "" && tx.Outcome != outcome) {
+			continue
+		}
+		summaries = append(summaries, Summary{
+			TransactionID:  tx.TransactionID,
+			VehicleID:      tx.VehicleID,
+			RequestID:      tx.RequestID,
+			Protocol:       tx.Protocol,
+			BeganAt:        tx.BeganAt,
+			FinishedAt:     tx.FinishedAt,
+			Decision:       tx.Decision,
+			Outcome:        tx.Outcome,
+			OutcomeMessage: tx.OutcomeMessage,
+			HeuristicMixed: tx.HeuristicMixed,
+		})
+		if limit > 0 && len(summaries) == limit {
+			break
+		}
+	}
+	return summaries
+}
+
+// Get retorna uma cópia da linha do tempo da transação.
+func (h *History) Get(transactionID string) (Transaction, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	tx, ok := h.byID[transactionID]
+	if !ok {
+		return Transaction{}, false
+	}
+	cp := *tx
+	cp.Participants = make([]*Participant, len(tx.Participants))
+	for i, p := range tx.Participants {
+		pc := *p
+		cp.Participants[i] = &pc
+	}
+	cp.Events = append([]Event(nil), tx.Events...)
+	sort.SliceStable(cp.Events, func(i, j int) bool { return cp.Events[i].Time.Before(cp.Events[j].Time) })
+	return cp, true
+}
+
+func (t *Transaction) participant(city string) *Participant {
+	for _, p := range t.Participants {
+		if p.City == city {
+			return p
+		}
+	}
+	p := &Participant{City: city}
+	t.Participants = append(t.Participants, p)
+	return p
+}
+
+func joinDetail(value, reason string) string {
+	if reason == "" {
+		return value
+	}
+	return value + ": " + reason
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/4r7hur0/PBL-2/api/timeline"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// history guarda a linha do tempo das transações recentes coordenadas por esta API.
+var history = timeline.New(timeline.DefaultCapacity)
+
+// handleListTransactions lista as transações recentes, da mais nova para a mais antiga.
+// Filtros opcionais: ?vehicle_id=, ?outcome= (ex.: REJECTED) e ?limit=.
+func handleListTransactions(c *gin.Context) {
+	limit := 0
+	if limitStr := c.Query("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+			c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "limit inválido: " + limitStr})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, history.List(c.Query("vehicle_id"), c.Query("outcome"), limit))
+}
+
+// handleGetTransaction retorna a linha do tempo completa de uma transação.
+func handleGetTransaction(c *gin.Context) {
+	transactionID := c.Param("id")
+	tx, ok := history.Get(transactionID)
+	if !ok {
+		c.JSON(http.StatusNotFound, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: transactionID, Reason: "Transação desconhecida ou fora do histórico"})
+		return
+	}
+	c.JSON(http.StatusOK, tx)
+}
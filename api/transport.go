@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/4r7hur0/PBL-2/api/mqtt"
+)
+
+// Transportes pelos quais esta API recebe as chamadas das outras empresas (2PC, 3PC, saga,
+// votos e consultas), selecionados com INTERAPI_TRANSPORT.
+const (
+	transportHTTP = "http" // URL http:// registrada no Registry
+	transportMQTT = "mqtt" // URL mqtt://<empresa>; requisições e respostas pelo broker
+)
+
+// interAPIRouteGroups são os grupos de rotas que as outras empresas chamam. Só eles são servidos
+// pelo MQTT; as rotas administrativas e as dos veículos ficam apenas no HTTP.
+var interAPIRouteGroups = []string{"2pc_remote", "3pc_remote", "saga_remote", "2pc_coordinator"}
+
+// interAPITransportMode é o transporte anunciado por esta API no Registry.
+var interAPITransportMode = transportHTTP
+
+// interAPITransport é usado por todos os clientes HTTP entre APIs. Independente do modo desta
+// API, ele alcança tanto as empresas anunciadas com http:// quanto as anunciadas com mqtt://.
+var interAPITransport = newInterAPITransport()
+
+func newInterAPITransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.RegisterProtocol(mqtt.URLScheme, mqtt.RPCTransport)
+	return t
+}
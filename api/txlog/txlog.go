@@ -0,0 +1,660 @@
+// PBL-2/api/txlog/txlog.go
+package txlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/durable"
+	"github.com/4r7hur0/PBL-2/schemas"
+)
+
+// Tipos de registro gravados no log do coordenador.
+const (
+	RecordBegin     = "BEGIN"
+	RecordVote      = "VOTE"
+	RecordDecision  = "DECISION"
+	RecordAck       = "ACK"
+	RecordPreCommit = "PRECOMMIT"       // Início da fase de PRE-COMMIT (somente 3PC)
+	RecordIssued    = "ISSUED"          // RequestID emitido na etapa de opções de rota (sem TransactionID)
+	RecordStatus    = "STATUS"          // ReservationStatus final publicado para o veículo
+	RecordCancel    = "CANCEL"          // Cancelamento de uma rota efetivada, pedido pelo veículo
+	RecordCancelAck = "CANCEL_ACK"      // Cidade confirmou o cancelamento
+	RecordDisplaced = "DISPLACED"       // Cidade tirou a vaga do segmento efetivado numa redução de capacidade
+	RecordMixed     = "HEURISTIC_MIXED" // Cidade confirmou a decisão global, mas tinha aplicado a decisão heurística contrária
+)
+
+// Valores de voto e de decisão global.
+const (
+	VoteYes        = "YES"
+	VoteNo         = "NO"
+	DecisionCommit = schemas.DecisionCommit
+	DecisionAbort  = schemas.DecisionAbort
+)
+
+// EndpointLocal identifica o participante servido pelo próprio StateManager desta API.
+const EndpointLocal = "local"
+
+// Record é uma linha do log (JSON por linha, somente anexação).
+type Record struct {
+	Type              string                     `json:"type"`
+	TransactionID     string                     `json:"transaction_id"`
+	Timestamp         time.Time                  `json:"timestamp"`
+	VehicleID         string                     `json:"vehicle_id,omitempty"`
+	RequestID         string                     `json:"request_id,omitempty"`
+	Route             []schemas.RouteSegment     `json:"route,omitempty"`
+	City              string                     `json:"city,omitempty"`     // Participante (cidade) do registro VOTE/ACK
+	Endpoint          string                     `json:"endpoint,omitempty"` // "local" ou URL da API remota
+	Vote              string                     `json:"vote,omitempty"`
+	Decision          string                     `json:"decision,omitempty"`
+	Status            *schemas.ReservationStatus `json:"status,omitempty"`
+	Protocol          string                     `json:"protocol,omitempty"`           // Protocolo da transação no BEGIN; vazio = 2PC
+	Reason            string                     `json:"reason,omitempty"`             // Motivo do voto NÃO ou da decisão ABORT
+	ChargingPointID   string                     `json:"charging_point_id,omitempty"`  // Posto pré-alocado pelo participante no voto SIM
+	ReservationWindow *schemas.ReservationWindow `json:"reservation_window,omitempty"` // Janela reservada no voto SIM, ajustada à potência do posto
+	Replaces          string                     `json:"replaces,omitempty"`           // BEGIN de uma remarcação: transação cuja rota ela substitui
+}
+
+// Allocation é o que um participante reservou: o posto e a janela que a recarga ocupa nele.
+type Allocation struct {
+	ChargingPointID   string
+	ReservationWindow *schemas.ReservationWindow // nil se o participante não informou a janela
+}
+
+// RequestInfo é o que o coordenador sabe sobre um RequestID emitido por ele.
+type RequestInfo struct {
+	VehicleID     string
+	TransactionID string                     // Vazio enquanto nenhuma rota escolhida foi recebida
+	Status        *schemas.ReservationStatus // Último status final publicado, se houver
+	IssuedAt      time.Time
+}
+
+// Participant é o estado de um participante reconstruído a partir do log.
+type Participant struct {
+	City        string
+	Endpoint    string
+	Vote        string
+	Acked       bool
+	CancelAcked bool // Confirmou o cancelamento pedido pelo veículo
+	Displaced   bool // Tirou a vaga do segmento numa redução de capacidade; não há o que cancelar
+	Allocation       // Do voto SIM
+}
+
+// Transaction é o estado de uma transação reconstruído a partir do log.
+type Transaction struct {
+	ID           string
+	VehicleID    string
+	RequestID    string
+	Route        []schemas.RouteSegment
+	Participants map[string]*Participant // Chave: cidade
+	Decision     string
+	Protocol     string
+	PreCommitted bool   // 3PC: a fase de PRE-COMMIT foi iniciada
+	Cancelled    bool   // O veículo cancelou a rota depois do COMMIT
+	Replaces     string // Remarcação: transação cuja rota esta substitui se for efetivada
+	BeganAt      time.Time
+}
+
+// Completed indica se a transação já tem decisão e todos os participantes envolvidos confirmaram.
+func (t *Transaction) Completed() bool {
+	return t.Decision != "" && len(t.PendingCities()) == 0
+}
+
+// PendingCities retorna as cidades que ainda precisam receber a decisão global.
+// Para COMMIT, apenas quem votou SIM; para ABORT (ou sem decisão), todas as cidades da rota,
+// pois um PREPARE pode ter sido aplicado sem que o voto chegasse a ser registrado.
+func (t *Transaction) PendingCities() []string {
+	var cities []string
+	seen := make(map[string]bool)
+	for _, segment := range t.Route {
+		city := segment.City
+		if seen[city] {
+			continue
+		}
+		seen[city] = true
+		p, ok := t.Participants[city]
+		if t.Decision == DecisionCommit && (!ok || p.Vote != VoteYes) {
+			continue
+		}
+		if ok && p.Acked {
+			continue
+		}
+		cities = append(cities, city)
+	}
+	return cities
+}
+
+// PendingCancellations retorna as cidades de uma transação cancelada que ainda precisam remover
+// a reserva: as que votaram SIM, não confirmaram o cancelamento e não tiraram a vaga antes.
+func (t *Transaction) PendingCancellations() []string {
+	if !t.Cancelled {
+		return nil
+	}
+	var cities []string
+	for _, city := range RouteCities(t.Route) {
+		if p, ok := t.Participants[city]; ok && p.Vote == VoteYes && !p.CancelAcked && !p.Displaced {
+			cities = append(cities, city)
+		}
+	}
+	return cities
+}
+
+// RouteCities retorna as cidades da rota, sem repetição e na ordem em que aparecem.
+func RouteCities(route []schemas.RouteSegment) []string {
+	var cities []string
+	seen := make(map[string]bool)
+	for _, segment := range route {
+		if !seen[segment.City] {
+			seen[segment.City] = true
+			cities = append(cities, segment.City)
+		}
+	}
+	return cities
+}
+
+// Log é o log de decisões do coordenador, gravado em disco e sincronizado a cada registro.
+type Log struct {
+	path      string
+	file      *os.File
+	size      int64 // Tamanho do arquivo até o último registro gravado por inteiro
+	mux       sync.Mutex
+	decisions map[string]string                // TransactionID -> decisão ("" enquanto não decidida)
+	requests  map[string]*RequestInfo          // RequestID -> informações da requisição de rota
+	protocols map[string]string                // TransactionID -> protocolo gravado no BEGIN
+	yesVotes  map[string]map[string]bool       // TransactionID -> cidades que votaram SIM
+	allocs    map[string]map[string]Allocation // TransactionID -> cidade -> posto e janela pré-alocados
+	replaces  map[string]reschedule            // TransactionID da remarcação -> transação que ela substitui
+	replaced  map[string]string                // TransactionID substituída -> remarcação efetivada
+	txs       map[string]*Transaction          // Estado de cada transação, atualizado a cada registro
+	order     []string                         // TransactionIDs na ordem do primeiro registro
+	observers []func(Record)                   // Recebem cada registro gravado (ver Subscribe)
+}
+
+// reschedule é o que o índice guarda de uma remarcação até a decisão dela.
+type reschedule struct {
+	replaces  string
+	requestID string
+}
+
+// Open abre (ou cria) o arquivo de log no caminho informado.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("falha ao criar diretório do log de transações: %w", err)
+	}
+	if err := repairTail(path); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao abrir log de transações %s: %w", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("falha ao ler o tamanho do log de transações: %w", err)
+	}
+	l := &Log{path: path, file: file, size: info.Size()}
+	if err := l.loadIndex(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	log.Printf("[TxLog] Log de transações aberto em %s (%d transações conhecidas)", path, len(l.order))
+	return l, nil
+}
+
+// repairTail descarta a linha parcial deixada no final do arquivo por uma queda durante a escrita.
+// Sem isso, o próximo registro anexado seria colado nela e a linha inteira, ilegível, se perderia.
+func repairTail(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("falha ao abrir log de transações %s: %w", path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("falha ao ler o tamanho do log de transações: %w", err)
+	}
+
+	// Procura o último '\n' lendo o arquivo de trás para frente
+	size := info.Size()
+	keep := int64(0)
+	buf := make([]byte, 64*1024)
+	for end := size; end > 0 && keep == 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return fmt.Errorf("falha ao ler o final do log de transações: %w", err)
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			keep = start + int64(i) + 1
+		}
+		end = start
+	}
+	if keep == size {
+		return nil
+	}
+	log.Printf("[TxLog] AVISO: descartando %d bytes de uma linha parcial no final de %s", size-keep, path)
+	if err := file.Truncate(keep); err != nil {
+		return fmt.Errorf("falha ao reparar o final do log de transações: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("falha ao sincronizar log em disco: %w", err)
+	}
+	return nil
+}
+
+// Append grava um registro no final do log e força a escrita em disco.
+func (l *Log) Append(rec Record) error {
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = time.Now().UTC()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("falha ao serializar registro do log: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if _, err := l.file.Write(line); err != nil {
+		l.discardPartialWrite()
+		return fmt.Errorf("falha ao gravar registro do log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		l.discardPartialWrite()
+		return fmt.Errorf("falha ao sincronizar log em disco: %w", err)
+	}
+	l.size += int64(len(line))
+	l.index(rec)
+	for _, fn := range l.observers {
+		fn(rec)
+	}
+	return nil
+}
+
+// discardPartialWrite corta do arquivo o que uma escrita que falhou deixou depois do último
+// registro inteiro, para que o próximo registro não seja colado nessa sobra. Requer l.mux travado.
+func (l *Log) discardPartialWrite() {
+	if err := l.file.Truncate(l.size); err != nil {
+		log.Printf("[TxLog] AVISO: falha ao descartar escrita parcial em %s: %v", l.path, err)
+	}
+}
+
+// Subscribe entrega a fn todos os registros já gravados e, depois, cada novo registro no momento
+// em que é gravado. fn é chamada com o log travado e não deve chamar métodos do Log.
+func (l *Log) Subscribe(fn func(Record)) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if err := l.scan(fn); err != nil {
+		return err
+	}
+	l.observers = append(l.observers, fn)
+	return nil
+}
+
+// index atualiza os índices em memória com um registro. Requer l.mux travado.
+func (l *Log) index(rec Record) {
+	l.track(rec)
+	switch rec.Type {
+	case RecordBegin:
+		if _, ok := l.decisions[rec.TransactionID]; !ok {
+			l.decisions[rec.TransactionID] = ""
+		}
+		l.protocols[rec.TransactionID] = rec.Protocol
+		if rec.Replaces != "" {
+			// A requisição só passa para a remarcação quando ela for efetivada
+			l.replaces[rec.TransactionID] = reschedule{replaces: rec.Replaces, requestID: rec.RequestID}
+			return
+		}
+		if info, ok := l.requests[rec.RequestID]; ok {
+			info.TransactionID = rec.TransactionID
+		}
+	case RecordVote:
+		if rec.Vote != VoteYes {
+			return
+		}
+		if l.yesVotes[rec.TransactionID] == nil {
+			l.yesVotes[rec.TransactionID] = make(map[string]bool)
+		}
+		l.yesVotes[rec.TransactionID][rec.City] = true
+		if rec.ChargingPointID != "" || rec.ReservationWindow != nil {
+			if l.allocs[rec.TransactionID] == nil {
+				l.allocs[rec.TransactionID] = make(map[string]Allocation)
+			}
+			l.allocs[rec.TransactionID][rec.City] = Allocation{ChargingPointID: rec.ChargingPointID, ReservationWindow: rec.ReservationWindow}
+		}
+	case RecordDecision:
+		l.decisions[rec.TransactionID] = rec.Decision
+		if rs, ok := l.replaces[rec.TransactionID]; ok && rec.Decision == DecisionCommit {
+			l.replaced[rs.replaces] = rec.TransactionID
+			if info, ok := l.requests[rs.requestID]; ok && info.TransactionID == rs.replaces {
+				info.TransactionID = rec.TransactionID
+			}
+		}
+	case RecordIssued:
+		l.requests[rec.RequestID] = &RequestInfo{VehicleID: rec.VehicleID, IssuedAt: rec.Timestamp}
+	case RecordStatus:
+		if rec.Status == nil {
+			return
+		}
+		if info, ok := l.requests[rec.RequestID]; ok && info.TransactionID == rec.TransactionID {
+			info.Status = rec.Status
+		}
+	}
+}
+
+// track aplica o registro ao estado da transação a que ele pertence. Requer l.mux travado.
+func (l *Log) track(rec Record) {
+	if rec.TransactionID == "" {
+		return // Registros de requisição (ISSUED) não pertencem a uma transação
+	}
+	tx, ok := l.txs[rec.TransactionID]
+	if !ok {
+		tx = &Transaction{ID: rec.TransactionID, Participants: make(map[string]*Participant)}
+		l.txs[rec.TransactionID] = tx
+		l.order = append(l.order, rec.TransactionID)
+	}
+	switch rec.Type {
+	case RecordBegin:
+		tx.VehicleID = rec.VehicleID
+		tx.RequestID = rec.RequestID
+		tx.Route = rec.Route
+		tx.Protocol = rec.Protocol
+		tx.Replaces = rec.Replaces
+		tx.BeganAt = rec.Timestamp
+	case RecordVote:
+		p := tx.participant(rec.City)
+		p.Vote = rec.Vote
+		p.Allocation = Allocation{ChargingPointID: rec.ChargingPointID, ReservationWindow: rec.ReservationWindow}
+		if rec.Endpoint != "" {
+			p.Endpoint = rec.Endpoint
+		}
+	case RecordDecision:
+		tx.Decision = rec.Decision
+	case RecordPreCommit:
+		tx.PreCommitted = true
+	case RecordAck:
+		p := tx.participant(rec.City)
+		p.Acked = true
+		if rec.Endpoint != "" {
+			p.Endpoint = rec.Endpoint
+		}
+	case RecordCancel:
+		tx.Cancelled = true
+	case RecordCancelAck:
+		tx.participant(rec.City).CancelAcked = true
+	case RecordDisplaced:
+		tx.participant(rec.City).Displaced = true
+	}
+}
+
+// loadIndex zera os índices em memória e os reconstrói a partir do arquivo. Requer l.mux travado
+// (ou o Log ainda não publicado).
+func (l *Log) loadIndex() error {
+	l.decisions = make(map[string]string)
+	l.requests = make(map[string]*RequestInfo)
+	l.protocols = make(map[string]string)
+	l.yesVotes = make(map[string]map[string]bool)
+	l.allocs = make(map[string]map[string]Allocation)
+	l.replaces = make(map[string]reschedule)
+	l.replaced = make(map[string]string)
+	l.txs = make(map[string]*Transaction)
+	l.order = nil
+	return l.scan(func(rec Record) { l.index(rec) })
+}
+
+// Protocol retorna o protocolo gravado no BEGIN da transação ("" para registros antigos de 2PC).
+func (l *Log) Protocol(transactionID string) string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.protocols[transactionID]
+}
+
+// ReplacedBy retorna a remarcação efetivada que substituiu a transação, ou "" se não houver.
+func (l *Log) ReplacedBy(transactionID string) string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.replaced[transactionID]
+}
+
+// IssueRequest registra um RequestID emitido para o veículo na etapa de opções de rota.
+func (l *Log) IssueRequest(requestID, vehicleID string) error {
+	return l.Append(Record{Type: RecordIssued, RequestID: requestID, VehicleID: vehicleID})
+}
+
+// Request retorna o que se sabe sobre um RequestID. issued é false se ele não foi emitido aqui.
+func (l *Log) Request(requestID string) (info RequestInfo, issued bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	stored, issued := l.requests[requestID]
+	if !issued {
+		return RequestInfo{}, false
+	}
+	return *stored, true
+}
+
+// Decision retorna a decisão gravada para a transação. known é false se a transação
+// nunca foi iniciada por este coordenador; decision é "" se ainda não há decisão.
+func (l *Log) Decision(transactionID string) (decision string, known bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	decision, known = l.decisions[transactionID]
+	return decision, known
+}
+
+// DecisionFor retorna a decisão que se aplica a uma cidade da transação: um COMMIT só vale para
+// as cidades que votaram SIM; as demais (segmentos opcionais que falharam) são abortadas.
+func (l *Log) DecisionFor(transactionID, city string) (decision string, known bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	decision, known = l.decisions[transactionID]
+	if decision == DecisionCommit && !l.yesVotes[transactionID][city] {
+		return DecisionAbort, known
+	}
+	return decision, known
+}
+
+// Allocations retorna o que as cidades que votaram SIM pré-alocaram (cidade -> posto e janela).
+func (l *Log) Allocations(transactionID string) map[string]Allocation {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	allocs := make(map[string]Allocation, len(l.allocs[transactionID]))
+	for city, alloc := range l.allocs[transactionID] {
+		allocs[city] = alloc
+	}
+	return allocs
+}
+
+// Replay retorna o estado de cada transação do log, na ordem de início.
+func (l *Log) Replay() ([]*Transaction, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	transactions := make([]*Transaction, 0, len(l.order))
+	for _, id := range l.order {
+		transactions = append(transactions, l.txs[id].clone())
+	}
+	return transactions, nil
+}
+
+// Transaction retorna o estado de uma transação, ou nil se ela é desconhecida.
+func (l *Log) Transaction(transactionID string) (*Transaction, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	tx, ok := l.txs[transactionID]
+	if !ok {
+		return nil, nil
+	}
+	return tx.clone(), nil
+}
+
+// Compact reescreve o log sem as transações encerradas antes de cutoff e sem os RequestIDs emitidos
+// antes de cutoff que não levam a uma transação mantida. finished diz se uma transação encerrou (é
+// chamada com o log travado e não deve alterar a transação nem chamar métodos do Log). Uma
+// remarcação e a transação que ela substitui são mantidas ou descartadas juntas. Retorna quantos
+// registros foram descartados.
+func (l *Log) Compact(cutoff time.Time, finished func(*Transaction) bool) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	keepTx := make(map[string]bool)
+	for _, id := range l.order {
+		if tx := l.txs[id]; !tx.BeganAt.Before(cutoff) || !finished(tx) {
+			keepTx[id] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, id := range l.order {
+			if !keepTx[id] {
+				continue
+			}
+			for _, linked := range []string{l.txs[id].Replaces, l.replaced[id]} {
+				if linked != "" && !keepTx[linked] {
+					keepTx[linked] = true
+					changed = true
+				}
+			}
+		}
+	}
+	keepRequest := make(map[string]bool)
+	for requestID, info := range l.requests {
+		if !info.IssuedAt.Before(cutoff) || keepTx[info.TransactionID] {
+			keepRequest[requestID] = true
+		}
+	}
+	keep := func(rec Record) bool {
+		if rec.Type == RecordIssued {
+			return keepRequest[rec.RequestID]
+		}
+		return keepTx[rec.TransactionID]
+	}
+
+	removed := 0
+	if err := l.scan(func(rec Record) {
+		if !keep(rec) {
+			removed++
+		}
+	}); err != nil {
+		return 0, err
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := l.rewrite(keep); err != nil {
+		return 0, err
+	}
+	if err := l.loadIndex(); err != nil {
+		return removed, err
+	}
+	log.Printf("[TxLog] Log de transações compactado: %d registros descartados, %d transações mantidas", removed, len(l.order))
+	return removed, nil
+}
+
+// rewrite substitui o arquivo pelos registros aceitos por keep (ver durable.Replace) e reabre o
+// log para anexação. Requer l.mux travado.
+func (l *Log) rewrite(keep func(Record) bool) error {
+	err := durable.Replace(l.path, func(w io.Writer) error {
+		var writeErr error
+		err := l.scan(func(rec Record) {
+			if writeErr != nil || !keep(rec) {
+				return
+			}
+			line, err := json.Marshal(rec)
+			if err == nil {
+				_, err = w.Write(append(line, '\n'))
+			}
+			writeErr = err
+		})
+		if err != nil {
+			return err
+		}
+		return writeErr
+	})
+	if err != nil {
+		return fmt.Errorf("falha ao gravar log compactado: %w", err)
+	}
+	// O arquivo antigo não está mais no caminho: anexar nele perderia os registros
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("falha ao reabrir log de transações %s: %w", l.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("falha ao ler o tamanho do log de transações: %w", err)
+	}
+	l.file.Close()
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// scan lê o arquivo do início ao fim entregando cada registro válido. Requer l.mux travado.
+func (l *Log) scan(fn func(rec Record)) error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("falha ao abrir log para leitura: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// Linhas parciais são descartadas na abertura (ver repairTail); esta é só uma salvaguarda.
+			log.Printf("[TxLog] AVISO: linha %d inválida ignorada: %v", lineNum, err)
+			continue
+		}
+		fn(rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("falha ao ler log de transações: %w", err)
+	}
+	return nil
+}
+
+// clone copia a transação, para que quem a recebe não veja as alterações seguintes do índice.
+func (t *Transaction) clone() *Transaction {
+	clone := *t
+	clone.Route = append([]schemas.RouteSegment(nil), t.Route...)
+	clone.Participants = make(map[string]*Participant, len(t.Participants))
+	for city, p := range t.Participants {
+		participant := *p
+		clone.Participants[city] = &participant
+	}
+	return &clone
+}
+
+func (t *Transaction) participant(city string) *Participant {
+	p, ok := t.Participants[city]
+	if !ok {
+		p = &Participant{City: city}
+		t.Participants[city] = p
+	}
+	return p
+}
+
+// Close fecha o arquivo de log.
+func (l *Log) Close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.file.Close()
+}
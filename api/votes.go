@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/4r7hur0/PBL-2/api/participant"
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// Modos de envio do PREPARE aos participantes remotos, selecionados com PREPARE_MODE.
+const (
+	prepareModeSync  = "sync"  // O voto é a resposta HTTP do /prepare
+	prepareModeAsync = "async" // O /prepare é aceito na hora e o voto chega pelas URLs de callback
+)
+
+// prepareMode é o modo de PREPARE usado pelas transações coordenadas por esta API.
+var prepareMode = prepareModeSync
+
+// Tentativas do participante para entregar seu voto ao coordenador.
+const (
+	voteCallbackAttempts = 5
+	voteCallbackBackoff  = 1 * time.Second
+)
+
+// asyncVotes liga os callbacks de voto às fases de PREPARE assíncronas em andamento.
+var asyncVotes = participant.NewVoteRegistry()
+
+// voteCallbackURLs monta as URLs desta API que recebem o voto de um segmento.
+func voteCallbackURLs(transactionID, segmentID string) schemas.CoordinatorCallbackURLs {
+	base := fmt.Sprintf("%s/2pc_coordinator/votes/%s/%s", selfAPIURL, url.PathEscape(transactionID), url.PathEscape(segmentID))
+	return schemas.CoordinatorCallbackURLs{CommitURL: base + "/commit", AbortURL: base + "/abort"}
+}
+
+// handleVoteCommit recebe o voto SIM de um participante assíncrono.
+func handleVoteCommit(c *gin.Context) {
+	var body schemas.PrepareSuccessResponse
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	acceptVote(c, participant.Vote{Yes: true, PreparedUntilUTC: body.PreparedUntilUTC, ChargingPointID: body.ChargingPointID, ReservationWindow: body.ReservationWindow})
+}
+
+// handleVoteAbort recebe o voto NÃO de um participante assíncrono.
+func handleVoteAbort(c *gin.Context) {
+	var body schemas.ErrorResponse
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	acceptVote(c, participant.Vote{Yes: false, Reason: body.Reason, Conflicts: body.Conflicts})
+}
+
+// acceptVote sempre confirma o callback: um voto que chega tarde não muda a decisão, e o
+// participante recebe o ABORT pela fila de entregas.
+func acceptVote(c *gin.Context, vote participant.Vote) {
+	transactionID, segmentID := c.Param("id"), c.Param("segment")
+	if !asyncVotes.Deliver(transactionID, segmentID, vote) {
+		log.Printf("[%s] TX[%s]: Voto de %s recebido fora da fase de PREPARE. Ignorado.", enterpriseName, transactionID, segmentID)
+		c.JSON(http.StatusOK, gin.H{"status": "IGNORED", "transaction_id": transactionID, "segment_id": segmentID})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "RECEIVED", "transaction_id": transactionID, "segment_id": segmentID})
+}
+
+// handleRemotePrepareAsync aceita o PREPARE na hora (202) e prepara a reserva em segundo plano,
+// enviando depois o voto às URLs de callback do coordenador.
+func handleRemotePrepareAsync(c *gin.Context, sm *state.StateManager, localEntName string) {
+	var body schemas.PrepareRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	if body.City != ownedCity {
+		errMsg := fmt.Sprintf("Requisição de PREPARE ASSÍNCRONO para cidade %s, mas esta API gerencia %s", body.City, ownedCity)
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: body.TransactionID, SegmentID: body.SegmentID, Reason: errMsg})
+		return
+	}
+	if body.CoordinatorCallbackURLs.CommitURL == "" || body.CoordinatorCallbackURLs.AbortURL == "" {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: body.TransactionID, SegmentID: body.SegmentID, Reason: "URLs de callback do coordenador ausentes"})
+		return
+	}
+	if strings.HasPrefix(c.FullPath(), "/3pc_remote/") {
+		body.Protocol = protocol3PC
+	}
+
+	log.Printf("[%s] TX[%s]: Recebido PREPARE ASSÍNCRONO para VehicleID %s na cidade %s", localEntName, body.TransactionID, body.VehicleID, body.City)
+	go func() {
+		reservation, err := sm.PrepareReservation(body.RemotePrepareRequest())
+		if err != nil {
+			log.Printf("[%s] TX[%s]: FALHA PREPARE ASSÍNCRONO: %v", localEntName, body.TransactionID, err)
+			vote := schemas.ErrorResponse{Status: schemas.StatusAborted, TransactionID: body.TransactionID, SegmentID: body.SegmentID, Reason: err.Error()}
+			var conflict *state.ConflictError
+			if errors.As(err, &conflict) {
+				vote.Conflicts = conflict.Conflicts
+			}
+			sendVote(body.TransactionID, body.CoordinatorCallbackURLs.AbortURL, vote)
+			return
+		}
+		sendVote(body.TransactionID, body.CoordinatorCallbackURLs.CommitURL, schemas.PrepareSuccessResponse{Status: schemas.StatusPrepared, TransactionID: body.TransactionID, SegmentID: body.SegmentID, PreparedUntilUTC: reservation.PreparedUntilUTC.Format(schemas.ISOFormat), ChargingPointID: reservation.ChargingPointID, ReservationWindow: &reservation.ReservationWindow})
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"status": schemas.StatusAccepted, "transaction_id": body.TransactionID, "segment_id": body.SegmentID})
+}
+
+// sendVote envia o voto ao coordenador, com algumas novas tentativas. Se o voto nunca chegar,
+// a reserva PREPARED é resolvida quando sua concessão expirar.
+func sendVote(transactionID, callbackURL string, vote interface{}) {
+	payloadBytes, _ := json.Marshal(vote)
+	delay := voteCallbackBackoff
+	for attempt := 1; attempt <= voteCallbackAttempts; attempt++ {
+		resp, err := decisionHTTPClient.Post(callbackURL, "application/json", bytes.NewBuffer(payloadBytes))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+		log.Printf("[%s] TX[%s]: Falha ao enviar voto para %s (tentativa %d): %v", enterpriseName, transactionID, callbackURL, attempt, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
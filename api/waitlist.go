@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/4r7hur0/PBL-2/api/state"
+	"github.com/4r7hur0/PBL-2/schemas"
+	"github.com/gin-gonic/gin"
+)
+
+// Tópicos da fila de espera e do fim antecipado da recarga. Todas as APIs escutam os tópicos e
+// cada uma trata as mensagens das cidades que serve.
+const (
+	waitlistJoinTopic   = "car/waitlist/join"
+	waitlistAcceptTopic = "car/waitlist/accept"
+	checkOutTopic       = "car/checkout"
+)
+
+// handleWaitlistJoinMessage trata um pedido de entrada na fila de espera recebido por MQTT.
+func handleWaitlistJoinMessage(payload string) {
+	var msg schemas.WaitlistJoinMsg
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil || msg.VehicleID == "" {
+		log.Printf("[%s] Pedido de fila de espera inválido: %v. Mensagem original: %s", enterpriseName, err, payload)
+		return
+	}
+	sm, err := cityStateManager(msg.City)
+	if err != nil {
+		return
+	}
+	log.Printf("[%s] FILA DE ESPERA: pedido recebido no tópico '%s': %s", enterpriseName, waitlistJoinTopic, payload)
+	if _, err := sm.JoinWaitlist(msg); err != nil {
+		log.Printf("[%s] FILA DE ESPERA: pedido do veículo %s em %s recusado: %v", enterpriseName, msg.VehicleID, msg.City, err)
+	}
+}
+
+// handleWaitlistAcceptMessage trata a aceitação de uma oferta recebida por MQTT. Se for aceita, o
+// veículo recebe o evento da reserva COMMITTED.
+func handleWaitlistAcceptMessage(payload string) {
+	var msg schemas.WaitlistAcceptMsg
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil || msg.OfferID == "" || msg.VehicleID == "" {
+		log.Printf("[%s] Aceitação de oferta inválida: %v. Mensagem original: %s", enterpriseName, err, payload)
+		return
+	}
+	sm, err := cityStateManager(msg.City)
+	if err != nil {
+		return
+	}
+	if _, err := sm.AcceptOffer(msg.OfferID, msg.VehicleID); err != nil {
+		log.Printf("[%s] FILA DE ESPERA: aceitação da oferta %s pelo veículo %s recusada: %v", enterpriseName, msg.OfferID, msg.VehicleID, err)
+	}
+}
+
+// handleCheckOutMessage trata o fim antecipado de uma recarga recebido por MQTT.
+func handleCheckOutMessage(payload string) {
+	var msg schemas.CheckInMsg
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil || msg.TransactionID == "" || msg.VehicleID == "" {
+		log.Printf("[%s] Check-out inválido: %v. Mensagem original: %s", enterpriseName, err, payload)
+		return
+	}
+	sm, err := cityStateManager(msg.City)
+	if err != nil {
+		return
+	}
+	if err := sm.CheckOut(msg.TransactionID, msg.VehicleID); err != nil {
+		log.Printf("[%s] TX[%s]: Check-out recusado para VehicleID %s em %s: %v", enterpriseName, msg.TransactionID, msg.VehicleID, msg.City, err)
+	}
+}
+
+// waitlistErrorCode traduz um erro da fila de espera em código HTTP.
+func waitlistErrorCode(err error) int {
+	switch {
+	case errors.Is(err, state.ErrWaitlistInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errCityNotServed), errors.Is(err, state.ErrNoOffer), errors.Is(err, state.ErrNoReservation):
+		return http.StatusNotFound
+	case errors.Is(err, state.ErrOfferRefused), errors.Is(err, state.ErrCheckInRefused):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleJoinWaitlist é a entrada na fila de espera por HTTP (POST /waitlist), com a cidade
+// (padrão: a cidade desta API) e a janela no corpo. Responde 201 com a entrada, já com a oferta se
+// havia posto livre.
+func handleJoinWaitlist(c *gin.Context) {
+	var msg schemas.WaitlistJoinMsg
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	if msg.VehicleID == "" {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "vehicle_id é obrigatório"})
+		return
+	}
+	if msg.City == "" {
+		msg.City = ownedCity
+	}
+	sm, err := cityStateManager(msg.City)
+	if err != nil {
+		c.JSON(waitlistErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, Reason: err.Error()})
+		return
+	}
+	entry, err := sm.JoinWaitlist(msg)
+	if err != nil {
+		c.JSON(waitlistErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, Reason: err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, entry)
+}
+
+// handleListWaitlist lista a fila de espera da cidade (query "city", padrão: a cidade desta API).
+func handleListWaitlist(c *gin.Context) {
+	sm, err := cityStateManager(c.DefaultQuery("city", ownedCity))
+	if err != nil {
+		c.JSON(waitlistErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, Reason: err.Error()})
+		return
+	}
+	entries := sm.Waitlist()
+	c.JSON(http.StatusOK, gin.H{"count": len(entries), "waitlist": entries})
+}
+
+// handleLeaveWaitlist tira a entrada da fila de espera da cidade (query "city", padrão: a cidade
+// desta API), liberando o posto de uma oferta em aberto.
+func handleLeaveWaitlist(c *gin.Context) {
+	entryID := c.Param("id")
+	sm, err := cityStateManager(c.DefaultQuery("city", ownedCity))
+	if err != nil {
+		c.JSON(waitlistErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, Reason: err.Error()})
+		return
+	}
+	if !sm.LeaveWaitlist(entryID) {
+		c.JSON(http.StatusNotFound, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Entrada não encontrada na fila de espera: " + entryID})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "REMOVED", "id": entryID})
+}
+
+// handleAcceptOffer é a aceitação de uma oferta por HTTP (POST /waitlist/:id/accept), com o
+// VehicleID e a cidade (padrão: a cidade desta API) no corpo. Responde com a reserva COMMITTED.
+func handleAcceptOffer(c *gin.Context) {
+	var msg schemas.WaitlistAcceptMsg
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	msg.OfferID = c.Param("id")
+	if msg.VehicleID == "" {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: msg.OfferID, Reason: "vehicle_id é obrigatório"})
+		return
+	}
+	if msg.City == "" {
+		msg.City = ownedCity
+	}
+	sm, err := cityStateManager(msg.City)
+	if err == nil {
+		var res schemas.ActiveReservation
+		if res, err = sm.AcceptOffer(msg.OfferID, msg.VehicleID); err == nil {
+			c.JSON(http.StatusOK, res)
+			return
+		}
+	}
+	c.JSON(waitlistErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: msg.OfferID, Reason: err.Error()})
+}
+
+// handleCheckOut é o fim antecipado da recarga por HTTP (POST /reservations/:id/checkout), com o
+// VehicleID e a cidade (padrão: a cidade desta API) no corpo. O posto é oferecido à fila de espera.
+func handleCheckOut(c *gin.Context) {
+	var msg schemas.CheckInMsg
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, Reason: "Payload inválido: " + err.Error()})
+		return
+	}
+	msg.TransactionID = c.Param("id")
+	if msg.VehicleID == "" {
+		c.JSON(http.StatusBadRequest, schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: msg.TransactionID, Reason: "vehicle_id é obrigatório"})
+		return
+	}
+	if msg.City == "" {
+		msg.City = ownedCity
+	}
+	sm, err := cityStateManager(msg.City)
+	if err == nil {
+		err = sm.CheckOut(msg.TransactionID, msg.VehicleID)
+	}
+	if err != nil {
+		c.JSON(waitlistErrorCode(err), schemas.ErrorResponse{Status: schemas.StatusError, TransactionID: msg.TransactionID, Reason: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "CHECKED_OUT", "transaction_id": msg.TransactionID})
+}
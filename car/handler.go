@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/4r7hur0/PBL-2/schemas"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -26,3 +27,30 @@ func addEnterprise(enterprise schemas.Enterprises) {
 	defer mu.Unlock()
 	enterprises = append(enterprises, enterprise)
 }
+
+// waitlistOfferHandler accepts the post offered by a city waitlist and checks in at the start of the window
+func waitlistOfferHandler(client mqtt.Client, msg mqtt.Message) {
+	var offer schemas.WaitlistOfferMsg
+	if err := json.Unmarshal(msg.Payload(), &offer); err != nil {
+		fmt.Printf("Error deserializing message: %v\n", err)
+		return
+	}
+	if offer.Status == schemas.StatusOfferExpired {
+		fmt.Printf("Waitlist offer %s in %s expired; the car left the waitlist\n", offer.OfferID, offer.City)
+		return
+	}
+	fmt.Printf("Waitlist offer in %s: post %s until %s. Accepting...\n", offer.City, offer.ChargingPointID, offer.ExpiresAtUTC.Format(time.Kitchen))
+	PublishWaitlistAccept(client, offer)
+	segment := schemas.RouteSegment{City: offer.City, ReservationWindow: offer.ReservationWindow, ChargingPointID: offer.ChargingPointID}
+	go checkInAtStart(client, offer.OfferID, offer.VehicleID, segment) // The offer ID is the transaction of the accepted reservation
+}
+
+// reservationEventHandler prints the lifecycle events of the car's reservations
+func reservationEventHandler(client mqtt.Client, msg mqtt.Message) {
+	var event schemas.ReservationEventMessage
+	if err := json.Unmarshal(msg.Payload(), &event); err != nil {
+		fmt.Printf("Error deserializing message: %v\n", err)
+		return
+	}
+	fmt.Printf("Reservation %s in %s: %s - %s\n", event.TransactionID, event.City, event.Status, event.Message)
+}
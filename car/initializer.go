@@ -3,7 +3,11 @@ package main
 import (
 	"fmt"
 	"math/rand"
+	"os"
+	"strconv"
 	"time"
+
+	"github.com/4r7hur0/PBL-2/schemas"
 )
 
 // Generate Car ID in the format "CAR" followed by 4 random letters or numbers
@@ -30,3 +34,48 @@ func initializeDischargeRate() string {
 	dischargeRate := rand.Intn(21) + 10 // Random value between 10 and 30
 	return fmt.Sprintf("%d%%", dischargeRate)
 }
+
+// Initialize the charging profile: connector type (CAR_CONNECTOR, CCS2 by default) and a random max charge power in kW
+func initializeChargingProfile() (string, float64) {
+	rand.Seed(time.Now().UnixNano())
+	connector := os.Getenv("CAR_CONNECTOR")
+	if connector == "" {
+		connector = schemas.ConnectorCCS2
+	}
+	powers := []float64{22, 50, 100, 150}
+	return connector, powers[rand.Intn(len(powers))]
+}
+
+// Initialize the probability (CAR_CANCEL_PROBABILITY, between 0 and 1, 0 by default) of cancelling a confirmed route
+func initializeCancelProbability() float64 {
+	return initializeProbability("CAR_CANCEL_PROBABILITY")
+}
+
+// Initialize the probability (CAR_RESCHEDULE_PROBABILITY, between 0 and 1, 0 by default) of rescheduling a confirmed route
+func initializeRescheduleProbability() float64 {
+	return initializeProbability("CAR_RESCHEDULE_PROBABILITY")
+}
+
+// Initialize the probability (CAR_NO_SHOW_PROBABILITY, between 0 and 1, 0 by default) of not showing up for a reserved charge
+func initializeNoShowProbability() float64 {
+	return initializeProbability("CAR_NO_SHOW_PROBABILITY")
+}
+
+// Initialize the probability (CAR_WAITLIST_PROBABILITY, between 0 and 1, 0 by default) of joining the waitlist of a city that rejected the charge
+func initializeWaitlistProbability() float64 {
+	return initializeProbability("CAR_WAITLIST_PROBABILITY")
+}
+
+// Read a probability between 0 and 1 from the environment variable, 0 by default
+func initializeProbability(name string) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	probability, err := strconv.ParseFloat(value, 64)
+	if err != nil || probability < 0 || probability > 1 {
+		fmt.Printf("Invalid %s (%q). Using 0.\n", name, value)
+		return 0
+	}
+	return probability
+}
@@ -45,6 +45,16 @@ func main() {
 		subscribeToTopic(client, "car/enterprises", messageHandler)
 	}()
 
+	// Reservation lifecycle events (CHARGING, NO_SHOW, CHECKIN_REJECTED, DISPLACED) from the cities
+	go func() {
+		subscribeToTopic(client, fmt.Sprintf("car/reservation/event/%s", CarID), reservationEventHandler)
+	}()
+
+	// Posts offered by the waitlists the car joined
+	go func() {
+		subscribeToTopic(client, fmt.Sprintf("car/waitlist/offer/%s", CarID), waitlistOfferHandler)
+	}()
+
 	// Go rounine for messages from topic carID
 	go func() {
 		subscribeToTopic(client, CarID, func(c mqtt.Client, m mqtt.Message) {
@@ -61,8 +71,14 @@ func main() {
 	// Initialize battery level and discharge rate
 	batteryLevel := initializeBatteryLevel()
 	dischargeRate := initializeDischargeRate()
+	connector, maxChargePowerKW := initializeChargingProfile()
+	cancelProbability := initializeCancelProbability()
+	rescheduleProbability := initializeRescheduleProbability()
+	noShowProbability := initializeNoShowProbability()
+	waitlistProbability := initializeWaitlistProbability()
 	fmt.Printf("Battery level: %d%%\n", batteryLevel)
 	fmt.Printf("Discharge rate: %s\n", dischargeRate)
+	fmt.Printf("Connector: %s, max charge power: %.0f kW\n", connector, maxChargePowerKW)
 
 	var selectedEnterprise *schemas.Enterprises
 	for {
@@ -88,7 +104,7 @@ func main() {
 		fmt.Printf("Origin: %s, Destination: %s\n", origin, destination)
 
 		// Publish the charging request
-		PublishChargingRequest(client, origin, destination, CarID, selectedEnterprise.Name)
+		PublishChargingRequest(client, origin, destination, CarID, connector, maxChargePowerKW, selectedEnterprise.Name)
 		fmt.Println("Waiting for response...")
 		// Wait for a response from the MQTT broker
 		// This is a blocking call, so it will wait until a message is received
@@ -148,6 +164,58 @@ func main() {
 		fmt.Println("\nWaiting for response...")
 		finalMsg := <-finalResponse
 		fmt.Printf("Response received: %v\n", finalMsg.Message)
+		for _, segment := range finalMsg.ConfirmedRoute {
+			fmt.Printf("Charge in %s at post %s from %s to %s\n", segment.City, segment.ChargingPointID, segment.ReservationWindow.StartTimeUTC.Format(time.Kitchen), segment.ReservationWindow.EndTimeUTC.Format(time.Kitchen))
+		}
+		confirmed := finalMsg.Status == schemas.StatusConfirmed || finalMsg.Status == schemas.StatusPartiallyConfirmed
+		coordinator := finalMsg.Coordinator
+		if coordinator == "" {
+			coordinator = selectedEnterprise.Name
+		}
+		if (finalMsg.Status == schemas.StatusRejected || finalMsg.Status == schemas.StatusPartiallyConfirmed) && rand.Float64() < waitlistProbability {
+			// Wait for a post in the cities that had no room
+			reserved := make(map[string]bool)
+			for _, segment := range finalMsg.ConfirmedRoute {
+				reserved[segment.City] = true
+			}
+			for _, segment := range selectedRoute {
+				if !reserved[segment.City] {
+					fmt.Printf("Joining the waitlist in %s\n", segment.City)
+					PublishWaitlistJoin(client, CarID, segment)
+				}
+			}
+		}
+		if confirmed && len(finalMsg.ConfirmedRoute) > 0 && rand.Float64() < rescheduleProbability {
+			// Running late: move the first charge 30 minutes later
+			segment := finalMsg.ConfirmedRoute[0]
+			window := schemas.ReservationWindow{
+				StartTimeUTC: segment.ReservationWindow.StartTimeUTC.Add(30 * time.Minute),
+				EndTimeUTC:   segment.ReservationWindow.EndTimeUTC.Add(30 * time.Minute),
+			}
+			fmt.Printf("\nRescheduling reservation %s in %s to %s...\n", finalMsg.TransactionID, segment.City, window.StartTimeUTC.Format(time.Kitchen))
+			PublishRescheduleRequest(client, finalMsg.TransactionID, CarID, coordinator, segment.City, window)
+			rescheduleMsg := <-finalResponse
+			fmt.Printf("Reschedule response: %s - %s\n", rescheduleMsg.Status, rescheduleMsg.Message)
+			if rescheduleMsg.Status == schemas.StatusConfirmed {
+				finalMsg = rescheduleMsg
+			}
+		}
+		if confirmed && rand.Float64() < cancelProbability {
+			fmt.Printf("\nCancelling reservation %s...\n", finalMsg.TransactionID)
+			PublishCancelRequest(client, finalMsg.TransactionID, CarID, coordinator)
+			cancelMsg := <-finalResponse
+			fmt.Printf("Cancellation response: %s - %s\n", cancelMsg.Status, cancelMsg.Message)
+			confirmed = cancelMsg.Status != schemas.StatusCancelled
+		}
+		if confirmed {
+			for _, segment := range finalMsg.ConfirmedRoute {
+				if rand.Float64() < noShowProbability {
+					fmt.Printf("Skipping the charge in %s (no-show)\n", segment.City)
+					continue
+				}
+				go checkInAtStart(client, finalMsg.TransactionID, CarID, segment)
+			}
+		}
 		time.Sleep(5 * time.Minute)
 	}
 
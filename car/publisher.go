@@ -3,17 +3,20 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/4r7hur0/PBL-2/schemas"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 // PublishToEnterprise publishes a message to all enterprises in the list
-func PublishChargingRequest(client mqtt.Client, origin, destination, carID, topic string) {
+func PublishChargingRequest(client mqtt.Client, origin, destination, carID, connector string, maxChargePowerKW float64, topic string) {
 	request := schemas.RouteRequest{
-		VehicleID:   carID,
-		Origin:      origin,
-		Destination: destination,
+		VehicleID:        carID,
+		Origin:           origin,
+		Destination:      destination,
+		Connector:        connector,
+		MaxChargePowerKW: maxChargePowerKW,
 	}
 
 	payload, err := json.Marshal(request)
@@ -29,3 +32,105 @@ func PublishChargingRequest(client mqtt.Client, origin, destination, carID, topi
 		fmt.Printf("Published message: %v to topic: %v\n", request, topic)
 	}
 }
+
+// PublishCancelRequest asks the enterprise that coordinated the reservation to cancel it
+func PublishCancelRequest(client mqtt.Client, transactionID, carID, enterprise string) {
+	request := schemas.CancelReservationMsg{
+		TransactionID: transactionID,
+		VehicleID:     carID,
+		Reason:        "trip cancelled by the driver",
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		fmt.Printf("Error serializing cancel request: %v\n", err)
+		return
+	}
+	token := client.Publish(fmt.Sprintf("car/cancel/%s", enterprise), 0, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		fmt.Printf("Error publishing message: %v\n", token.Error())
+	}
+}
+
+// PublishRescheduleRequest asks the enterprise that coordinated the reservation to move the charge in a city to a new window
+func PublishRescheduleRequest(client mqtt.Client, transactionID, carID, enterprise, city string, window schemas.ReservationWindow) {
+	request := schemas.RescheduleRequestMsg{
+		TransactionID: transactionID,
+		VehicleID:     carID,
+		Segments:      []schemas.SegmentReschedule{{City: city, ReservationWindow: window}},
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		fmt.Printf("Error serializing reschedule request: %v\n", err)
+		return
+	}
+	token := client.Publish(fmt.Sprintf("car/reschedule/%s", enterprise), 0, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		fmt.Printf("Error publishing message: %v\n", token.Error())
+	}
+}
+
+// PublishWaitlistJoin asks the city of the segment to put the car in its waitlist for the segment window
+func PublishWaitlistJoin(client mqtt.Client, carID string, segment schemas.RouteSegment) {
+	request := schemas.WaitlistJoinMsg{
+		VehicleID:         carID,
+		City:              segment.City,
+		ReservationWindow: segment.ReservationWindow,
+		Charge:            segment.Charge,
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		fmt.Printf("Error serializing waitlist request: %v\n", err)
+		return
+	}
+	token := client.Publish("car/waitlist/join", 0, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		fmt.Printf("Error publishing message: %v\n", token.Error())
+	}
+}
+
+// PublishWaitlistAccept accepts the post offered by the waitlist
+func PublishWaitlistAccept(client mqtt.Client, offer schemas.WaitlistOfferMsg) {
+	request := schemas.WaitlistAcceptMsg{
+		OfferID:   offer.OfferID,
+		VehicleID: offer.VehicleID,
+		City:      offer.City,
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		fmt.Printf("Error serializing offer acceptance: %v\n", err)
+		return
+	}
+	token := client.Publish("car/waitlist/accept", 0, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		fmt.Printf("Error publishing message: %v\n", token.Error())
+	}
+}
+
+// checkInAtStart waits for the start of the reserved window and checks in at the post
+func checkInAtStart(client mqtt.Client, transactionID, carID string, segment schemas.RouteSegment) {
+	time.Sleep(time.Until(segment.ReservationWindow.StartTimeUTC))
+	request := schemas.CheckInMsg{
+		TransactionID: transactionID,
+		VehicleID:     carID,
+		City:          segment.City,
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		fmt.Printf("Error serializing check-in: %v\n", err)
+		return
+	}
+	token := client.Publish("car/checkin", 0, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		fmt.Printf("Error publishing message: %v\n", token.Error())
+	}
+}
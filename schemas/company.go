@@ -17,14 +17,59 @@ type CoordinatorCallbackURLs struct {
 }
 
 type ActiveReservation struct {
-	TransactionID     string            `json:"transaction_id"`
-	VehicleID         string            `json:"vehicle_id"`
-	RequestID         string            `json:"request_id"` // ID da requisição de rota original
-	City              string            `json:"city"`
-	ReservationWindow ReservationWindow `json:"reservation_window"`
-	Status            string            `json:"status"` // Ex: "PREPARED", "COMMITTED"
+	TransactionID         string            `json:"transaction_id"`
+	VehicleID             string            `json:"vehicle_id"`
+	RequestID             string            `json:"request_id"` // ID da requisição de rota original
+	City                  string            `json:"city"`
+	ReservationWindow     ReservationWindow `json:"reservation_window"`
+	Status                string            `json:"status"`                            // Ex: "PREPARED", "COMMITTED"
+	PreparedUntilUTC      time.Time         `json:"prepared_until_utc,omitempty"`      // Fim da concessão (lease) de uma reserva PREPARED
+	CoordinatorURL        string            `json:"coordinator_url,omitempty"`         // API do coordenador a consultar quando a concessão expira
+	ParticipantCities     []string          `json:"participant_cities,omitempty"`      // Cidades dos segmentos obrigatórios da rota, para a terminação cooperativa
+	Protocol              string            `json:"protocol,omitempty"`                // "2pc" ou "3pc"; define como a concessão expirada é resolvida
+	PriorityUTC           time.Time         `json:"priority_utc,omitempty"`            // Idade da transação, para wait-die/wound-wait
+	Optional              bool              `json:"optional,omitempty"`                // Segmento opcional de uma rota com aceitação parcial
+	ChargingPointID       string            `json:"charging_point_id,omitempty"`       // Posto da cidade reservado para o veículo
+	ChargePowerKW         float64           `json:"charge_power_kw,omitempty"`         // Potência da recarga: a do posto, limitada pela do veículo
+	ReplacesTransactionID string            `json:"replaces_transaction_id,omitempty"` // Remarcação: transação cuja reserva é liberada no COMMIT desta
+}
+
+// Níveis de potência dos postos de recarga.
+const (
+	PowerLevelSlow      = "slow"       // AC, 22 kW
+	PowerLevelFast      = "fast"       // DC, 50 kW
+	PowerLevelUltraFast = "ultra-fast" // DC, 150 kW
+)
+
+// Tipos de conector dos postos e dos veículos.
+const (
+	ConnectorType2   = "Type2"
+	ConnectorCCS2    = "CCS2"
+	ConnectorCHAdeMO = "CHAdeMO"
+)
 
+// ChargingPoint é um posto de recarga de uma cidade.
+type ChargingPoint struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	PowerLevel string  `json:"power_level"` // PowerLevelSlow, PowerLevelFast ou PowerLevelUltraFast
+	PowerKW    float64 `json:"power_kw"`
+	Connector  string  `json:"connector"`
 }
+
+// ChargeProfile descreve a recarga que o veículo precisa em uma parada. Os postos incompatíveis
+// com o conector são descartados, e a janela reservada é dimensionada pela potência resultante.
+type ChargeProfile struct {
+	Connector        string  `json:"connector,omitempty"`           // Vazio aceita qualquer posto
+	MaxChargePowerKW float64 `json:"max_charge_power_kw,omitempty"` // Potência máxima aceita pelo veículo; 0 = sem limite
+	EnergyKWh        float64 `json:"energy_kwh,omitempty"`          // Energia a recarregar; 0 mantém a janela pedida
+}
+
+// ChargeDuration retorna quanto tempo leva para recarregar energyKWh a powerKW.
+func ChargeDuration(energyKWh, powerKW float64) time.Duration {
+	return time.Duration(energyKWh / powerKW * float64(time.Hour)).Round(time.Second)
+}
+
 type ReservationEndMessage struct {
     VehicleID     string    `json:"vehicle_id"`
     TransactionID string    `json:"transaction_id"`
@@ -35,24 +80,59 @@ type ReservationEndMessage struct {
 
 
 type RemotePrepareResponse struct {
-	Status        string `json:"status"` // "PREPARED" ou "REJECTED"
-	TransactionID string `json:"transaction_id"`
-	Reason        string `json:"reason,omitempty"`
+	Status           string `json:"status"` // "PREPARED" ou "REJECTED"
+	TransactionID    string `json:"transaction_id"`
+	Reason           string `json:"reason,omitempty"`
+	PreparedUntilUTC  string             `json:"prepared_until_utc,omitempty"` // Formato ISOFormat
+	Conflicts         []PrepareConflict  `json:"conflicts,omitempty"`          // Reservas PREPARED que impediram o PREPARE
+	ChargingPointID   string             `json:"charging_point_id,omitempty"`  // Posto reservado
+	ReservationWindow *ReservationWindow `json:"reservation_window,omitempty"` // Janela reservada, dimensionada pela potência do posto
+}
+
+// PrepareConflict descreve uma reserva ainda não decidida que ocupa o posto pedido por outra transação.
+type PrepareConflict struct {
+	TransactionID  string    `json:"transaction_id"`
+	PriorityUTC    time.Time `json:"priority_utc,omitempty"`
+	CoordinatorURL string    `json:"coordinator_url,omitempty"`
 }
 
 // Novas structs para comunicação inter-APIs (para os Passos 3 e 4)
 type RemotePrepareRequest struct {
-	TransactionID     string            `json:"transaction_id"`
-	VehicleID         string            `json:"vehicle_id"`
-	RequestID         string            `json:"request_id"`
-	City              string            `json:"city"` // A cidade para preparar
-	ReservationWindow ReservationWindow `json:"reservation_window"`
+	TransactionID         string            `json:"transaction_id"`
+	VehicleID             string            `json:"vehicle_id"`
+	RequestID             string            `json:"request_id"`
+	City                  string            `json:"city"` // A cidade para preparar
+	ReservationWindow     ReservationWindow `json:"reservation_window"`
+	CoordinatorURL        string            `json:"coordinator_url,omitempty"`         // URL base da API coordenadora
+	ParticipantCities     []string          `json:"participant_cities,omitempty"`      // Cidades dos segmentos obrigatórios da rota (terminação cooperativa)
+	Protocol              string            `json:"protocol,omitempty"`                // "2pc" (padrão) ou "3pc"
+	PriorityUTC           time.Time         `json:"priority_utc,omitempty"`            // Início da primeira tentativa da transação (mais antiga = maior prioridade)
+	Optional              bool              `json:"optional,omitempty"`                // Se falhar, o resto da rota ainda pode ser confirmado
+	ChargingPointID       string            `json:"charging_point_id,omitempty"`       // Posto preferido; se ocupado, outro é escolhido
+	Charge                *ChargeProfile    `json:"charge,omitempty"`                  // Conector, potência e energia pedidos pelo veículo
+	ReplacesTransactionID string            `json:"replaces_transaction_id,omitempty"` // Remarcação: a reserva desta transação não conta como ocupação e é liberada no COMMIT
 }
 
 type RemoteCommitAbortRequest struct {
 	TransactionID string `json:"transaction_id"`
 }
 
+// Decisões globais de uma transação, como informadas pelo coordenador.
+const (
+	DecisionCommit = "COMMIT"
+	DecisionAbort  = "ABORT"
+)
+
+// TransactionStatusResponse é a resposta de GET /2pc_remote/transactions/:id.
+// State é o estado local da transação nesta cidade; Decision só é preenchido quando
+// esta API é a coordenadora da transação ("COMMIT", "ABORT" ou "PENDING").
+type TransactionStatusResponse struct {
+	TransactionID string `json:"transaction_id"`
+	City          string `json:"city"`
+	State         string `json:"state"` // "UNKNOWN", "PREPARED", "PRECOMMITTED", "COMMITTED" ou "ABORTED"
+	Decision      string `json:"decision,omitempty"`
+}
+
 // ReservationStatus informa o veículo sobre o resultado da tentativa de reserva.
 type ReservationStatus struct {
     TransactionID  string         `json:"transaction_id"`
@@ -61,39 +141,89 @@ type ReservationStatus struct {
     Status         string         `json:"status"`     // Ex: "CONFIRMED", "REJECTED"
     Message        string         `json:"message"`
     ConfirmedRoute []RouteSegment `json:"confirmed_route,omitempty"` // Rota confirmada, se aplicável
+    Segments       []SegmentOutcome `json:"segments,omitempty"`      // Resultado de cada segmento da rota escolhida
+    Coordinator    string         `json:"coordinator,omitempty"`     // Empresa que coordenou a reserva; recebe os pedidos de cancelamento
+}
+
+// SegmentOutcome é o resultado da reserva de um segmento da rota escolhida.
+type SegmentOutcome struct {
+	City              string            `json:"city"`
+	ReservationWindow ReservationWindow `json:"reservation_window"`
+	Optional          bool              `json:"optional,omitempty"`
+	Status            string            `json:"status"` // "CONFIRMED" ou "REJECTED"
+	Reason            string            `json:"reason,omitempty"`
+	ChargingPointID   string            `json:"charging_point_id,omitempty"` // Posto reservado, se confirmado
 }
 
 
 // Constantes para Status da Reserva Ativa
 const (
-	StatusReservationPrepared  = "PREPARED"
-	StatusReservationCommitted = "COMMITTED"
+	StatusReservationPrepared     = "PREPARED"
+	StatusReservationPreCommitted = "PRECOMMITTED" // Fase intermediária do 3PC
+	StatusReservationCommitted    = "COMMITTED"
+	StatusReservationCharging     = "CHARGING"    // O veículo fez check-in e está recarregando
+	StatusReservationNoShow       = "NO_SHOW"     // O veículo não fez check-in no prazo; o posto foi liberado
+	StatusReservationOffered      = "OFFERED"     // Posto guardado para a oferta da fila de espera, até ser aceita ou expirar
+	StatusReservationMaintenance  = "MAINTENANCE" // Bloqueio de um posto em manutenção; não pertence a nenhum veículo
+	StatusReservationDisplaced    = "DISPLACED"   // Evento: a reserva perdeu o posto numa redução de capacidade
 )
 
-// PrepareRequestBody é a estrutura para a requisição /prepare.
+// PrepareRequestBody é a estrutura para a requisição /prepare_async. O participante responde
+// imediatamente e depois envia seu voto a CommitURL (SIM) ou AbortURL (NÃO).
 type PrepareRequestBody struct {
 	TransactionID           string                  `json:"transaction_id"`
 	SegmentID               string                  `json:"segment_id"`
 	ChargingPointID         string                  `json:"charging_point_id"`
 	VehicleID               string                  `json:"vehicle_id"`
+	RequestID               string                  `json:"request_id"`
+	City                    string                  `json:"city"`
 	ReservationWindow       ReservationWindow       `json:"reservation_window"`
+	CoordinatorURL          string                  `json:"coordinator_url,omitempty"`
+	ParticipantCities       []string                `json:"participant_cities,omitempty"`
+	Protocol                string                  `json:"protocol,omitempty"`
+	PriorityUTC             time.Time               `json:"priority_utc,omitempty"`
+	Optional                bool                    `json:"optional,omitempty"`
+	Charge                  *ChargeProfile          `json:"charge,omitempty"`
+	ReplacesTransactionID   string                  `json:"replaces_transaction_id,omitempty"`
 	CoordinatorCallbackURLs CoordinatorCallbackURLs `json:"coordinator_callback_urls"`
 }
 
+// RemotePrepareRequest retorna o PREPARE síncrono equivalente, aplicado ao StateManager.
+func (b PrepareRequestBody) RemotePrepareRequest() RemotePrepareRequest {
+	return RemotePrepareRequest{
+		TransactionID:         b.TransactionID,
+		VehicleID:             b.VehicleID,
+		RequestID:             b.RequestID,
+		City:                  b.City,
+		ReservationWindow:     b.ReservationWindow,
+		CoordinatorURL:        b.CoordinatorURL,
+		ParticipantCities:     b.ParticipantCities,
+		Protocol:              b.Protocol,
+		PriorityUTC:           b.PriorityUTC,
+		Optional:              b.Optional,
+		ChargingPointID:       b.ChargingPointID,
+		Charge:                b.Charge,
+		ReplacesTransactionID: b.ReplacesTransactionID,
+	}
+}
+
 // PrepareSuccessResponse é a estrutura para uma resposta /prepare bem-sucedida.
 type PrepareSuccessResponse struct {
-	Status           string `json:"status"` // "PREPARED"
-	TransactionID    string `json:"transaction_id"`
-	SegmentID        string `json:"segment_id"`
-	PreparedUntilUTC string `json:"prepared_until_utc,omitempty"`
+	Status            string             `json:"status"` // "PREPARED"
+	TransactionID     string             `json:"transaction_id"`
+	SegmentID         string             `json:"segment_id"`
+	PreparedUntilUTC  string             `json:"prepared_until_utc,omitempty"`
+	ChargingPointID   string             `json:"charging_point_id,omitempty"`  // Posto reservado
+	ReservationWindow *ReservationWindow `json:"reservation_window,omitempty"` // Janela reservada, dimensionada pela potência do posto
 }
 
 // ErrorResponse é uma resposta de erro genérica.
 type ErrorResponse struct {
 	Status        string `json:"status"`
 	TransactionID string `json:"transaction_id,omitempty"`
-	SegmentID     string `json:"segment_id,omitempty"`
-	Reason        string `json:"reason"`
+	SegmentID     string            `json:"segment_id,omitempty"`
+	Reason        string            `json:"reason"`
+	Conflicts     []PrepareConflict `json:"conflicts,omitempty"` // Preenchido quando um PREPARE assíncrono é recusado por conflito
 }
 
 // TransactionState representa o estado de um segmento de transação.
@@ -120,11 +250,21 @@ type ProvisionalReservation struct {
 const (
 	StatusPrepared              = "PREPARED"
 	StatusAborted               = "ABORTED"
+	StatusHeuristicMixed        = "HEURISTIC_MIXED" // A cidade confirmou a decisão global, mas já tinha aplicado a decisão heurística contrária
 	StatusError                 = "ERROR"
 	StatusCommitted             = "COMMITTED"
 	StatusPreparedPendingCommit = "PREPARED_PENDING_COMMIT"
 	StatusConfirmed             = "CONFIRMED"
+	StatusPartiallyConfirmed    = "PARTIALLY_CONFIRMED" // Só parte dos segmentos opcionais foi reservada
+	StatusRejected              = "REJECTED"
 	StatusCancelled             = "CANCELLED"
+	StatusCancelRejected        = "CANCEL_REJECTED"     // Pedido de cancelamento recusado; a reserva continua valendo
+	StatusRescheduleRejected    = "RESCHEDULE_REJECTED" // Remarcação recusada ou abortada; a reserva anterior continua valendo
+	StatusCheckInRejected       = "CHECKIN_REJECTED"    // Check-in recusado pela cidade
+	StatusOfferExpired          = "OFFER_EXPIRED"       // Oferta da fila de espera não aceita no prazo; o veículo saiu da fila
+	StatusUnknown               = "UNKNOWN"
+	StatusPending               = "PENDING"
+	StatusAccepted              = "ACCEPTED" // PREPARE assíncrono recebido; o voto chega depois pelo callback
 	ISOFormat                   = "2006-01-02T15:04:05Z"
 )
 
@@ -132,6 +272,9 @@ const (
 type RouteSegment struct {
 	City              string            `json:"city"`
 	ReservationWindow ReservationWindow `json:"reservation_window"`
+	Optional          bool              `json:"optional,omitempty"`          // Marcado pelo carro: a rota pode ser confirmada sem este segmento
+	ChargingPointID   string            `json:"charging_point_id,omitempty"` // Na rota confirmada: posto onde o veículo deve recarregar
+	Charge            *ChargeProfile    `json:"charge,omitempty"`            // Preenchido pelo roteamento a partir do RouteRequest
 }
 
 // RouteReservationResponse é a estrutura da mensagem MQTT para enviar uma resposta para o carro.
@@ -148,9 +291,11 @@ type RouteReservationOptions struct {
 }
 
 type RouteRequest struct {
-	VehicleID   string `json:"vehicle_id"`
-	Origin      string `json:"origin"`
-	Destination string `json:"destination"`
+	VehicleID        string  `json:"vehicle_id"`
+	Origin           string  `json:"origin"`
+	Destination      string  `json:"destination"`
+	Connector        string  `json:"connector,omitempty"`           // Conector do veículo (ConnectorType2, ConnectorCCS2, ...)
+	MaxChargePowerKW float64 `json:"max_charge_power_kw,omitempty"` // Potência máxima de recarga do veículo
 }
 
 type Enterprises struct {
@@ -159,9 +304,127 @@ type Enterprises struct {
 }
 
 type ChosenRouteMsg struct {
-	RequestID string         `json:"request_id"` // ID único para esta requisição de rota
-	VehicleID string         `json:"vehicle_id"`
-	Route     []RouteSegment `json:"route"`
+	RequestID     string         `json:"request_id"`               // ID único para esta requisição de rota
+	VehicleID     string         `json:"vehicle_id"`
+	Route         []RouteSegment `json:"route"`
+	ForwardedBy   string         `json:"forwarded_by,omitempty"`   // Empresa que recebeu a rota do carro e delegou a coordenação
+	ForwarderCity string         `json:"forwarder_city,omitempty"` // Cidade da empresa que delegou, usada para confirmar com ela o RequestID
+	Replaces      string         `json:"replaces,omitempty"`       // Remarcação: transação confirmada cuja rota esta substitui
+}
+
+// CancelReservationMsg é o pedido do veículo para cancelar uma rota já confirmada, enviado à
+// empresa coordenadora (campo coordinator do status) no tópico car/cancel/<empresa>.
+type CancelReservationMsg struct {
+	TransactionID string `json:"transaction_id"`
+	VehicleID     string `json:"vehicle_id"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// CheckInMsg é o aviso de chegada do veículo ao posto reservado, publicado no tópico car/checkin
+// e tratado pela API que gerencia a cidade.
+type CheckInMsg struct {
+	TransactionID string `json:"transaction_id"`
+	VehicleID     string `json:"vehicle_id"`
+	City          string `json:"city"`
+}
+
+// ReservationEventMessage informa o veículo de uma mudança no ciclo de vida da reserva em uma
+// cidade (CHARGING, NO_SHOW ou CHECKIN_REJECTED), no tópico car/reservation/event/<veículo>.
+type ReservationEventMessage struct {
+	VehicleID       string    `json:"vehicle_id"`
+	TransactionID   string    `json:"transaction_id"`
+	City            string    `json:"city"`
+	ChargingPointID string    `json:"charging_point_id,omitempty"`
+	Status          string    `json:"status"`
+	Message         string    `json:"message"`
+	TimeUTC         time.Time `json:"time_utc"`
+}
+
+// WaitlistEntry é um veículo na fila de espera de uma cidade por uma janela que estava lotada.
+// Quando um posto vaga, a primeira entrada que cabe recebe uma oferta com prazo para aceitar.
+type WaitlistEntry struct {
+	ID                string            `json:"id"` // Também o TransactionID da reserva criada se a oferta for aceita
+	VehicleID         string            `json:"vehicle_id"`
+	City              string            `json:"city"`
+	ReservationWindow ReservationWindow `json:"reservation_window"`
+	Charge            *ChargeProfile    `json:"charge,omitempty"`
+	JoinedAtUTC       time.Time         `json:"joined_at_utc"`
+	OfferedUntilUTC   time.Time         `json:"offered_until_utc,omitempty"` // Prazo da oferta em aberto; zero enquanto espera
+	ChargingPointID   string            `json:"charging_point_id,omitempty"` // Posto guardado para a oferta em aberto
+}
+
+// WaitlistJoinMsg é o pedido do veículo para entrar na fila de espera de uma cidade, publicado no
+// tópico car/waitlist/join e tratado pela API que gerencia a cidade.
+type WaitlistJoinMsg struct {
+	VehicleID         string            `json:"vehicle_id"`
+	City              string            `json:"city"`
+	ReservationWindow ReservationWindow `json:"reservation_window"`
+	Charge            *ChargeProfile    `json:"charge,omitempty"`
+}
+
+// WaitlistOfferMsg oferece ao veículo da fila de espera o posto que vagou, no tópico
+// car/waitlist/offer/<veículo>. A oferta vale até ExpiresAtUTC; se não for aceita, a mesma mensagem
+// é publicada de novo com Status OFFER_EXPIRED.
+type WaitlistOfferMsg struct {
+	OfferID           string            `json:"offer_id"` // ID da entrada da fila
+	Status            string            `json:"status"`   // OFFERED ou OFFER_EXPIRED
+	VehicleID         string            `json:"vehicle_id"`
+	City              string            `json:"city"`
+	ChargingPointID   string            `json:"charging_point_id"`
+	ReservationWindow ReservationWindow `json:"reservation_window"`
+	ExpiresAtUTC      time.Time         `json:"expires_at_utc"`
+}
+
+// WaitlistAcceptMsg é a aceitação de uma oferta da fila de espera, publicada no tópico
+// car/waitlist/accept.
+type WaitlistAcceptMsg struct {
+	OfferID   string `json:"offer_id"`
+	VehicleID string `json:"vehicle_id"`
+	City      string `json:"city"`
+}
+
+// AddPostsRequest é o corpo de POST /admin/posts: postos iguais a acrescentar à cidade.
+type AddPostsRequest struct {
+	Quantity   int    `json:"quantity"`
+	PowerLevel string `json:"power_level"` // PowerLevelSlow, PowerLevelFast ou PowerLevelUltraFast
+	Connector  string `json:"connector"`
+}
+
+// MaintenanceRequest é o corpo de POST /admin/posts/:id/maintenance.
+type MaintenanceRequest struct {
+	ReservationWindow ReservationWindow `json:"reservation_window"`
+	Policy            string            `json:"policy,omitempty"` // Escolha das reservas deslocadas; vazio usa a política da API
+}
+
+// CapacityChangeResult descreve o efeito da remoção de um posto ou de uma manutenção nas reservas
+// da cidade.
+type CapacityChangeResult struct {
+	City        string              `json:"city"`
+	Policy      string              `json:"policy"`
+	Maintenance *ActiveReservation  `json:"maintenance,omitempty"` // Bloqueio criado pela manutenção
+	Moved       []ActiveReservation `json:"moved"`                 // Reservas transferidas para outro posto, já com o novo posto
+	Displaced   []ActiveReservation `json:"displaced"`             // Reservas que perderam o posto; os veículos foram avisados
+}
+
+// DisplacementReport avisa a empresa coordenadora de que a cidade tirou a vaga do segmento
+// efetivado da transação numa redução de capacidade.
+type DisplacementReport struct {
+	TransactionID string `json:"transaction_id"`
+	City          string `json:"city"`
+}
+
+// RescheduleRequestMsg é o pedido do veículo para mover segmentos de uma rota confirmada para
+// novas janelas, enviado à empresa coordenadora no tópico car/reschedule/<empresa>.
+type RescheduleRequestMsg struct {
+	TransactionID string              `json:"transaction_id"`
+	VehicleID     string              `json:"vehicle_id"`
+	Segments      []SegmentReschedule `json:"segments"`
+}
+
+// SegmentReschedule é a nova janela pedida para o segmento da rota em uma cidade.
+type SegmentReschedule struct {
+	City              string            `json:"city"`
+	ReservationWindow ReservationWindow `json:"reservation_window"`
 }
 
 // RegisterRequest é o payload para registrar uma API de cidade.